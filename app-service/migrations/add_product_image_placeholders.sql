@@ -0,0 +1,17 @@
+-- Migration: Add placeholder fields to product_images table
+-- Run this migration to store the BlurHash/LQIP data returned by media-service uploads
+
+-- Add new columns to product_images table
+ALTER TABLE product_images
+ADD COLUMN IF NOT EXISTS width INTEGER,
+ADD COLUMN IF NOT EXISTS height INTEGER,
+ADD COLUMN IF NOT EXISTS blurhash VARCHAR(64),
+ADD COLUMN IF NOT EXISTS lqip TEXT,
+ADD COLUMN IF NOT EXISTS dominant_color VARCHAR(7);
+
+-- Add comments for documentation
+COMMENT ON COLUMN product_images.width IS 'Width in pixels of the processed image';
+COMMENT ON COLUMN product_images.height IS 'Height in pixels of the processed image';
+COMMENT ON COLUMN product_images.blurhash IS 'BlurHash placeholder string';
+COMMENT ON COLUMN product_images.lqip IS 'Tiny base64 JPEG data URI shown while the image loads';
+COMMENT ON COLUMN product_images.dominant_color IS 'Dominant colour of the image as #rrggbb';
@@ -134,6 +134,11 @@ CREATE TABLE product_images (
   product_id INTEGER,
   url VARCHAR(255) NOT NULL,
   is_primary BOOLEAN DEFAULT FALSE,
+  width INTEGER,
+  height INTEGER,
+  blurhash VARCHAR(64),
+  lqip TEXT,
+  dominant_color VARCHAR(7),
   FOREIGN KEY (product_id) REFERENCES products(id) ON DELETE CASCADE ON UPDATE NO ACTION
 );
 
@@ -14,6 +14,7 @@ import { AdminModule } from './admin/admin.module';
 import { NotificationModule } from './notification/notification.module';
 import { PaymentModule } from './payment/payment.module';
 import { OrderModule } from './order/order.module';
+import { MediaModule } from './media/media.module';
 import { WinstonModule, utilities as nestWinstonModuleUtilities } from 'nest-winston';
 import * as winston from 'winston';
 import { ElasticsearchTransport } from 'winston-elasticsearch';
@@ -51,6 +52,7 @@ import { ElasticsearchTransport } from 'winston-elasticsearch';
       ],
     }),
     PrismaModule,
+    MediaModule,
     NotificationModule,
     AuthModule,
     AdminModule,
@@ -0,0 +1,70 @@
+import { Inject, Injectable } from '@nestjs/common';
+import { ConfigService } from '@nestjs/config';
+import { WINSTON_MODULE_NEST_PROVIDER, WinstonLogger } from 'nest-winston';
+import axios from 'axios';
+
+// Order columns holding media-service documents, by the name media-service uses
+const ORDER_DOCUMENTS = {
+    receipt: 'payment_receipt_url',
+    shipping: 'shipping_tracking_url',
+} as const;
+
+// media-service signs the links of at most this many orders per request
+const ORDER_LINK_BATCH = 100;
+
+type OrderDocuments = {
+    id: number;
+    payment_receipt_url?: string | null;
+    shipping_tracking_url?: string | null;
+};
+
+@Injectable()
+export class MediaService {
+    constructor(
+        private config: ConfigService,
+        @Inject(WINSTON_MODULE_NEST_PROVIDER) private readonly logger: WinstonLogger,
+    ) { }
+
+    async withOrderDocumentLinks<T extends OrderDocuments>(order: T, authorization?: string): Promise<T> {
+        const [linked] = await this.withOrdersDocumentLinks([order], authorization);
+        return linked;
+    }
+
+    // Receipts and shipping documents are private: the URL saved with the
+    // order is a signed link that expires after a few minutes. Responses get
+    // fresh links from media-service instead, one request per batch of
+    // orders, which also checks that the user is the buyer or seller. The
+    // saved URLs are kept if that fails.
+    async withOrdersDocumentLinks<T extends OrderDocuments>(orders: T[], authorization?: string): Promise<T[]> {
+        const mediaUrl = this.config.get<string>('MEDIA_SERVICE_URL');
+        if (!mediaUrl || !authorization) return orders;
+
+        const ids = orders
+            .filter(order => Object.values(ORDER_DOCUMENTS).some(column => order[column]))
+            .map(order => order.id);
+        const links: Record<string, Record<string, string>> = {};
+        for (let i = 0; i < ids.length; i += ORDER_LINK_BATCH) {
+            const batch = ids.slice(i, i + ORDER_LINK_BATCH);
+            try {
+                const response = await axios.post(
+                    `${mediaUrl.replace(/\/+$/, '')}/api/v1/media/orders/documents`,
+                    { orders: batch },
+                    { headers: { Authorization: authorization }, timeout: 5000 },
+                );
+                Object.assign(links, response.data.orders);
+            } catch (error) {
+                this.logger.warn(`Order document links failed for orders ${batch.join(', ')}: ${error.message}`);
+            }
+        }
+
+        return orders.map(order => {
+            const documents = links[order.id];
+            if (!documents) return order;
+            const linked: Partial<OrderDocuments> = {};
+            for (const [document, column] of Object.entries(ORDER_DOCUMENTS)) {
+                if (documents[document]) linked[column] = documents[document];
+            }
+            return { ...order, ...linked };
+        });
+    }
+}
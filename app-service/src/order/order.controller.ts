@@ -27,7 +27,7 @@ export class OrdersController {
   @ApiResponse({ status: 200, description: 'Orders retrieved successfully' })
   @ApiResponse({ status: 401, description: 'Unauthorized' })
   findAll(@Req() req) {
-    return this.ordersService.getOrders(req.user.id);
+    return this.ordersService.getOrders(req.user.id, req.headers.authorization);
   }
 
   @Get(':id')
@@ -37,7 +37,7 @@ export class OrdersController {
   @ApiResponse({ status: 404, description: 'Order not found' })
   @ApiResponse({ status: 401, description: 'Unauthorized' })
   findOne(@Req() req, @Param('id') id: string) {
-    return this.ordersService.getOrder(req.user.id, Number(id));
+    return this.ordersService.getOrder(req.user.id, Number(id), req.headers.authorization);
   }
 
   @Patch(':id/payment-receipt')
@@ -50,7 +50,7 @@ export class OrdersController {
   @ApiResponse({ status: 404, description: 'Order not found' })
   @ApiResponse({ status: 401, description: 'Unauthorized' })
   uploadPaymentReceipt(@Req() req, @Param('id') id: string, @Body() dto: UploadPaymentReceiptDto) {
-    return this.ordersService.uploadPaymentReceipt(req.user.id, Number(id), dto.paymentReceiptUrl, dto.shippingAddress);
+    return this.ordersService.uploadPaymentReceipt(req.user.id, Number(id), dto.paymentReceiptUrl, dto.shippingAddress, req.headers.authorization);
   }
 
   @Patch(':id/shipping-tracking')
@@ -67,7 +67,7 @@ export class OrdersController {
       trackingCode: dto.trackingCode,
       company: dto.company,
       trackingUrl: dto.trackingUrl
-    });
+    }, req.headers.authorization);
   }
 
   @Patch(':id/confirm-delivery')
@@ -79,6 +79,6 @@ export class OrdersController {
   @ApiResponse({ status: 404, description: 'Order not found' })
   @ApiResponse({ status: 401, description: 'Unauthorized' })
   confirmDelivery(@Req() req, @Param('id') id: string) {
-    return this.ordersService.confirmDelivery(req.user.id, Number(id));
+    return this.ordersService.confirmDelivery(req.user.id, Number(id), req.headers.authorization);
   }
 }
\ No newline at end of file
@@ -1,5 +1,6 @@
 import { BadRequestException, ForbiddenException, Injectable } from '@nestjs/common';
 import { PrismaService } from 'src/prisma/prisma.service';
+import { MediaService } from 'src/media/media.service';
 
 import { WINSTON_MODULE_NEST_PROVIDER, WinstonLogger } from 'nest-winston';
 import { Inject } from '@nestjs/common';
@@ -8,6 +9,7 @@ import { Inject } from '@nestjs/common';
 export class OrderService {
     constructor(
         private prisma: PrismaService,
+        private media: MediaService,
         @Inject(WINSTON_MODULE_NEST_PROVIDER) private readonly logger: WinstonLogger,
     ) { }
 
@@ -55,7 +57,7 @@ export class OrderService {
         return order;
     }
 
-    async getOrder(userId: number, orderId: number) {
+    async getOrder(userId: number, orderId: number, authorization?: string) {
         const order = await this.prisma.orders.findUnique({
             where: { id: orderId },
             include: {
@@ -71,11 +73,11 @@ export class OrderService {
             throw new ForbiddenException('Không có quyền xem đơn hàng này');
         }
 
-        return order;
+        return this.media.withOrderDocumentLinks(order, authorization);
     }
 
-    async getOrders(userId: number) {
-        return this.prisma.orders.findMany({
+    async getOrders(userId: number, authorization?: string) {
+        const orders = await this.prisma.orders.findMany({
             where: {
                 OR: [
                     { buyer_id: userId },
@@ -98,9 +100,11 @@ export class OrderService {
             },
             orderBy: { created_at: 'desc' }
         });
+
+        return this.media.withOrdersDocumentLinks(orders, authorization);
     }
 
-    async uploadPaymentReceipt(userId: number, orderId: number, paymentReceiptUrl: string, shippingAddress: string) {
+    async uploadPaymentReceipt(userId: number, orderId: number, paymentReceiptUrl: string, shippingAddress: string, authorization?: string) {
         const order = await this.prisma.orders.findUnique({
             where: { id: orderId }
         });
@@ -146,14 +150,14 @@ export class OrderService {
             })
         );
 
-        return updatedOrder;
+        return this.media.withOrderDocumentLinks(updatedOrder, authorization);
     }
 
     async uploadShippingTracking(userId: number, orderId: number, trackingInfo: {
         trackingCode: string;
         company?: string;
         trackingUrl?: string;
-    }) {
+    }, authorization?: string) {
         const order = await this.prisma.orders.findUnique({
             where: { id: orderId }
         });
@@ -196,10 +200,10 @@ export class OrderService {
             })
         );
 
-        return updatedOrder;
+        return this.media.withOrderDocumentLinks(updatedOrder, authorization);
     }
 
-    async confirmDelivery(userId: number, orderId: number) {
+    async confirmDelivery(userId: number, orderId: number, authorization?: string) {
         const order = await this.prisma.orders.findUnique({
             where: { id: orderId }
         });
@@ -239,6 +243,6 @@ export class OrderService {
             })
         );
 
-        return updatedOrder;
+        return this.media.withOrderDocumentLinks(updatedOrder, authorization);
     }
 }
\ No newline at end of file
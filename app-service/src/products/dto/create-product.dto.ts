@@ -1,5 +1,33 @@
-import { IsArray, IsBoolean, IsDateString, IsNotEmpty, IsNumber, IsOptional, IsString, Min, ArrayMinSize } from 'class-validator';
+import { IsArray, IsBoolean, IsDateString, IsInt, IsNotEmpty, IsNumber, IsOptional, IsString, Min, ArrayMinSize, ValidateNested } from 'class-validator';
 import { ApiProperty, ApiPropertyOptional } from '@nestjs/swagger';
+import { Type } from 'class-transformer';
+
+export class ProductImagePlaceholderDto {
+    @ApiPropertyOptional({ description: 'Image width in pixels', example: 1024 })
+    @IsOptional()
+    @IsInt()
+    width?: number;
+
+    @ApiPropertyOptional({ description: 'Image height in pixels', example: 683 })
+    @IsOptional()
+    @IsInt()
+    height?: number;
+
+    @ApiPropertyOptional({ description: 'BlurHash returned by media-service', example: 'L3GSGocEA?X-++fPa|fPdMf7fRf7' })
+    @IsOptional()
+    @IsString()
+    blurhash?: string;
+
+    @ApiPropertyOptional({ description: 'Tiny base64 JPEG data URI returned by media-service' })
+    @IsOptional()
+    @IsString()
+    lqip?: string;
+
+    @ApiPropertyOptional({ description: 'Dominant colour as #rrggbb', example: '#37a1d3' })
+    @IsOptional()
+    @IsString()
+    dominant_color?: string;
+}
 
 export class CreateProductDto {
     @ApiProperty({ description: 'Product name', example: 'Vintage Camera' })
@@ -48,4 +76,11 @@ export class CreateProductDto {
     @ArrayMinSize(3, { message: 'Need at least 3 images' })
     @IsString({ each: true })
     images: string[];
-}
\ No newline at end of file
+
+    @ApiPropertyOptional({ description: 'Placeholder data for each image, in the same order as images', type: [ProductImagePlaceholderDto] })
+    @IsOptional()
+    @IsArray()
+    @ValidateNested({ each: true })
+    @Type(() => ProductImagePlaceholderDto)
+    image_placeholders?: ProductImagePlaceholderDto[];
+}
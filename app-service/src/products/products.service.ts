@@ -57,10 +57,18 @@ export class ProductsService {
         end_time: dto.end_time,
         is_auto_extend: dto.is_auto_extend ?? true,
         product_images: {
-          create: dto.images.map((url, idx) => ({
-            url,
-            is_primary: idx === 0
-          }))
+          create: dto.images.map((url, idx) => {
+            const placeholder = dto.image_placeholders?.[idx];
+            return {
+              url,
+              is_primary: idx === 0,
+              width: placeholder?.width,
+              height: placeholder?.height,
+              blurhash: placeholder?.blurhash,
+              lqip: placeholder?.lqip,
+              dominant_color: placeholder?.dominant_color
+            };
+          })
         }
       }
     });
@@ -108,7 +108,7 @@ export class UsersController {
   @ApiResponse({ status: 200, description: 'Sold products retrieved' })
   @ApiResponse({ status: 401, description: 'Unauthorized' })
   getSold(@Req() req) {
-    return this.usersService.getSoldProducts(req.user.id);
+    return this.usersService.getSoldProducts(req.user.id, req.headers.authorization);
   }
 
   @Post('cancel-transaction')
@@ -1,5 +1,6 @@
 import { BadRequestException, ForbiddenException, Injectable, NotFoundException } from '@nestjs/common';
 import { PrismaService } from 'src/prisma/prisma.service';
+import { MediaService } from 'src/media/media.service';
 import { UpdateUserDto } from './dto/update-user.dto';
 import { UpdateProfileDto } from './dto/update-profile.dto';
 import * as bcrypt from 'bcrypt';
@@ -7,7 +8,7 @@ import { Prisma } from '@prisma/client'; // Import Prisma namespace
 
 @Injectable()
 export class UsersService {
-    constructor(private prisma: PrismaService) { }
+    constructor(private prisma: PrismaService, private media: MediaService) { }
 
     // --- PRIVATE HELPER METHOD TO REUSE SQL LOGIC ---
     private async getProductsWithRawQuery(whereCondition: Prisma.Sql, extraJoin: Prisma.Sql = Prisma.empty) {
@@ -322,7 +323,7 @@ export class UsersService {
         }));
     }
 
-    async getSoldProducts(userId: number) {
+    async getSoldProducts(userId: number, authorization?: string) {
         const products = await this.prisma.products.findMany({
             where: {
                 seller_id: userId,
@@ -354,8 +355,12 @@ export class UsersService {
             orderBy: { updated_at: 'desc' }
         });
 
+        const orders = await this.media.withOrdersDocumentLinks(products.flatMap(p => p.orders ? [p.orders] : []), authorization);
+        const ordersById = new Map(orders.map(order => [order.id, order]));
+
         return products.map(p => ({
             ...p,
+            orders: p.orders && ordersById.get(p.orders.id),
             winner: p.users_products_winner_idTousers,
             bid_count: p._count.bids,
             is_rated: p.feedbacks.length > 0
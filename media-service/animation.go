@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/gif"
+	"net/http"
+
+	"github.com/disintegration/imaging"
+)
+
+const codeAnimationTooLong = "ANIMATION_LIMIT_EXCEEDED"
+
+// animationConfig holds the limits for GIFs whose purpose keeps the
+// animation. Every GIF also gets a static poster from the first frame
+// through the normal pipeline.
+type animationConfig struct {
+	width         int
+	maxFrames     int
+	maxDurationMS int
+}
+
+// loadAnimatedPurposes reads MEDIA_ANIMATED_PURPOSES, the built-in purposes
+// that keep GIF animation.
+func loadAnimatedPurposes() (map[string]bool, error) {
+	return envPurposes("MEDIA_ANIMATED_PURPOSES", purposeProduct)
+}
+
+func loadAnimationConfig() (animationConfig, error) {
+	width, err := envInt("MEDIA_ANIMATION_WIDTH", 480)
+	if err != nil {
+		return animationConfig{}, err
+	}
+	maxFrames, err := envInt("MEDIA_ANIMATION_MAX_FRAMES", 100)
+	if err != nil {
+		return animationConfig{}, err
+	}
+	maxDuration, err := envInt("MEDIA_ANIMATION_MAX_DURATION_MS", 10000)
+	if err != nil {
+		return animationConfig{}, err
+	}
+	return animationConfig{width: width, maxFrames: maxFrames, maxDurationMS: maxDuration}, nil
+}
+
+type animationResult struct {
+	Key        string `json:"key"`
+	URL        string `json:"url"`
+	Width      int    `json:"width"`
+	Height     int    `json:"height"`
+	Bytes      int    `json:"bytes"`
+	Frames     int    `json:"frames"`
+	DurationMS int    `json:"duration_ms"`
+	// Deduplicated is set when identical content was already stored
+	Deduplicated bool `json:"deduplicated,omitempty"`
+}
+
+// animation is a decoded GIF with every frame composited onto the full
+// canvas, so frames can be resized independently of each other.
+type animation struct {
+	src    *gif.GIF
+	frames []*image.NRGBA
+}
+
+// gifDurationMS sums the frame delays, which GIF stores in 1/100 s.
+func gifDurationMS(g *gif.GIF) int {
+	total := 0
+	for _, d := range g.Delay {
+		total += d * 10
+	}
+	return total
+}
+
+// check enforces the frame and duration limits for animations that are kept.
+func (a animationConfig) check(g *gif.GIF) error {
+	if len(g.Image) > a.maxFrames {
+		return &uploadError{
+			Status:  http.StatusRequestEntityTooLarge,
+			Code:    codeAnimationTooLong,
+			Message: fmt.Sprintf("Animation has %d frames, the maximum is %d", len(g.Image), a.maxFrames),
+		}
+	}
+	if d := gifDurationMS(g); d > a.maxDurationMS {
+		return &uploadError{
+			Status:  http.StatusRequestEntityTooLarge,
+			Code:    codeAnimationTooLong,
+			Message: fmt.Sprintf("Animation lasts %d ms, the maximum is %d ms", d, a.maxDurationMS),
+		}
+	}
+	return nil
+}
+
+// compositeGIF replays the frames on the logical screen, applying each
+// frame's disposal method the way a browser would.
+func compositeGIF(g *gif.GIF) *animation {
+	w, h := g.Config.Width, g.Config.Height
+	if w == 0 || h == 0 {
+		w, h = g.Image[0].Bounds().Dx(), g.Image[0].Bounds().Dy()
+	}
+	canvas := image.NewNRGBA(image.Rect(0, 0, w, h))
+	frames := make([]*image.NRGBA, 0, len(g.Image))
+
+	for i, frame := range g.Image {
+		disposal := byte(gif.DisposalNone)
+		if i < len(g.Disposal) {
+			disposal = g.Disposal[i]
+		}
+		var previous *image.NRGBA
+		if disposal == gif.DisposalPrevious {
+			previous = imaging.Clone(canvas)
+		}
+
+		draw.Draw(canvas, frame.Bounds(), frame, frame.Bounds().Min, draw.Over)
+		frames = append(frames, imaging.Clone(canvas))
+
+		switch disposal {
+		case gif.DisposalBackground:
+			draw.Draw(canvas, frame.Bounds(), image.Transparent, image.Point{}, draw.Src)
+		case gif.DisposalPrevious:
+			canvas = previous
+		}
+	}
+	return &animation{src: g, frames: frames}
+}
+
+// poster is the first frame, used for the static variants.
+func (a *animation) poster() image.Image {
+	return a.frames[0]
+}
+
+// render resizes every frame, applies the watermark and stores the result
+// as a GIF with the original timing and loop count.
+func (a *animation) render(width int, opts renderOptions) (*animationResult, error) {
+	out := &gif.GIF{
+		Delay:     a.src.Delay,
+		LoopCount: a.src.LoopCount,
+	}
+	for i, frame := range a.frames {
+		var dst image.Image = shrinkInside(frame, width, 0)
+		if opts.Watermark != nil {
+			dst = opts.Watermark.apply(dst)
+		}
+		out.Image = append(out.Image, quantize(dst, framePalette(a.src, i)))
+	}
+
+	buf := new(bytes.Buffer)
+	if err := gif.EncodeAll(buf, out); err != nil {
+		return nil, fmt.Errorf("encode gif: %w", err)
+	}
+	size := buf.Len()
+
+	key, url, reused, err := opts.store("animated", buf.Bytes(), ".gif", "image/gif")
+	if err != nil {
+		return nil, fmt.Errorf("store: %w", err)
+	}
+
+	bounds := out.Image[0].Bounds()
+	return &animationResult{
+		Key:          key,
+		URL:          url,
+		Width:        bounds.Dx(),
+		Height:       bounds.Dy(),
+		Bytes:        size,
+		Frames:       len(out.Image),
+		DurationMS:   gifDurationMS(a.src),
+		Deduplicated: reused,
+	}, nil
+}
+
+// framePalette returns the colours the source frame was drawn with, plus a
+// transparent entry for areas cleared by disposal, so resizing does not
+// need a fresh quantisation pass. Encoders pad palettes to a power of two,
+// so duplicates are dropped first to make room; a palette with 256 distinct
+// colours loses its last one.
+func framePalette(g *gif.GIF, i int) color.Palette {
+	var pal color.Palette
+	seen := make(map[color.RGBA64]bool)
+	for _, c := range g.Image[i].Palette {
+		key := color.RGBA64Model.Convert(c).(color.RGBA64)
+		if key.A == 0 {
+			return g.Image[i].Palette
+		}
+		if !seen[key] {
+			seen[key] = true
+			pal = append(pal, c)
+		}
+	}
+	if len(pal) == 256 {
+		pal = pal[:255]
+	}
+	return append(pal, color.Transparent)
+}
+
+func quantize(img image.Image, pal color.Palette) *image.Paletted {
+	dst := image.NewPaletted(img.Bounds(), pal)
+	draw.FloydSteinberg.Draw(dst, img.Bounds(), img, img.Bounds().Min)
+	return dst
+}
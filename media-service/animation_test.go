@@ -0,0 +1,118 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"image/gif"
+	"testing"
+)
+
+func TestAnimationConfigCheck(t *testing.T) {
+	limits := animationConfig{width: 480, maxFrames: 3, maxDurationMS: 1000}
+	frames := func(n, delay int) *gif.GIF {
+		g := &gif.GIF{}
+		for i := 0; i < n; i++ {
+			g.Image = append(g.Image, image.NewPaletted(image.Rect(0, 0, 1, 1), color.Palette{color.Black}))
+			g.Delay = append(g.Delay, delay)
+		}
+		return g
+	}
+
+	tests := []struct {
+		name    string
+		gif     *gif.GIF
+		wantErr bool
+	}{
+		{name: "within limits", gif: frames(3, 33)},
+		{name: "exactly the duration", gif: frames(2, 50)},
+		{name: "too many frames", gif: frames(4, 1), wantErr: true},
+		{name: "too long", gif: frames(2, 51), wantErr: true},
+	}
+	for _, tt := range tests {
+		err := limits.check(tt.gif)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: check() error = %v, want error %v", tt.name, err, tt.wantErr)
+		}
+		if err != nil && errorCode(err) != codeAnimationTooLong {
+			t.Errorf("%s: code = %q, want %q", tt.name, errorCode(err), codeAnimationTooLong)
+		}
+	}
+
+	if got := gifDurationMS(frames(4, 7)); got != 280 {
+		t.Errorf("gifDurationMS() = %d, want 280", got)
+	}
+}
+
+func TestCompositeGIFDisposal(t *testing.T) {
+	red, blue := color.RGBA{255, 0, 0, 255}, color.RGBA{0, 0, 255, 255}
+	pal := color.Palette{color.Transparent, red, blue}
+	fill := func(r image.Rectangle, index uint8) *image.Paletted {
+		p := image.NewPaletted(r, pal)
+		for i := range p.Pix {
+			p.Pix[i] = index
+		}
+		return p
+	}
+
+	g := &gif.GIF{
+		Image: []*image.Paletted{
+			fill(image.Rect(0, 0, 4, 4), 1),
+			fill(image.Rect(0, 0, 2, 2), 2),
+			fill(image.Rect(2, 2, 4, 4), 2),
+			fill(image.Rect(0, 0, 1, 1), 2),
+		},
+		Disposal: []byte{gif.DisposalNone, gif.DisposalPrevious, gif.DisposalBackground, gif.DisposalNone},
+		Config:   image.Config{Width: 4, Height: 4},
+	}
+	anim := compositeGIF(g)
+	if len(anim.frames) != 4 {
+		t.Fatalf("compositeGIF() = %d frames, want 4", len(anim.frames))
+	}
+
+	tests := []struct {
+		frame int
+		x, y  int
+		want  color.NRGBA
+	}{
+		{frame: 0, x: 3, y: 3, want: color.NRGBA{255, 0, 0, 255}},
+		{frame: 1, x: 0, y: 0, want: color.NRGBA{0, 0, 255, 255}},
+		// Frame 1 is undone before frame 2 is drawn
+		{frame: 2, x: 0, y: 0, want: color.NRGBA{255, 0, 0, 255}},
+		{frame: 2, x: 3, y: 3, want: color.NRGBA{0, 0, 255, 255}},
+		// Frame 2 is cleared to transparent before frame 3
+		{frame: 3, x: 3, y: 3, want: color.NRGBA{}},
+		{frame: 3, x: 0, y: 0, want: color.NRGBA{0, 0, 255, 255}},
+	}
+	for _, tt := range tests {
+		if got := anim.frames[tt.frame].NRGBAAt(tt.x, tt.y); got != tt.want {
+			t.Errorf("frame %d at %d,%d = %v, want %v", tt.frame, tt.x, tt.y, got, tt.want)
+		}
+	}
+	if anim.poster() != anim.frames[0] {
+		t.Error("poster() is not the first frame")
+	}
+}
+
+func TestFramePalette(t *testing.T) {
+	opaque := color.Palette{color.Black, color.White, color.Black}
+	g := &gif.GIF{Image: []*image.Paletted{image.NewPaletted(image.Rect(0, 0, 1, 1), opaque)}}
+	pal := framePalette(g, 0)
+	if len(pal) != 3 || pal[2] != color.Transparent {
+		t.Errorf("framePalette() = %v, want black, white, transparent", pal)
+	}
+
+	withAlpha := color.Palette{color.Black, color.Transparent}
+	g.Image[0].Palette = withAlpha
+	if pal := framePalette(g, 0); len(pal) != 2 {
+		t.Errorf("framePalette() = %v, want the palette unchanged", pal)
+	}
+
+	full := make(color.Palette, 256)
+	for i := range full {
+		full[i] = color.RGBA{uint8(i), 0, 0, 255}
+	}
+	g.Image[0].Palette = full
+	if pal := framePalette(g, 0); len(pal) != 256 || pal[255] != color.Transparent {
+		t.Errorf("framePalette() of 256 colours = %d entries", len(pal))
+	}
+}
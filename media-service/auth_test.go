@@ -0,0 +1,72 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func signedToken(t *testing.T, method jwt.SigningMethod, key any, claims jwt.MapClaims) string {
+	t.Helper()
+	token, err := jwt.NewWithClaims(method, claims).SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func TestParseAccessToken(t *testing.T) {
+	t.Setenv("JWT_SECRET", "secret")
+	future := time.Now().Add(time.Hour).Unix()
+	past := time.Now().Add(-time.Hour).Unix()
+	valid := jwt.MapClaims{"sub": 42, "email": "a@example.com", "role": roleAdmin, "exp": future}
+
+	tests := []struct {
+		name    string
+		token   string
+		wantErr bool
+	}{
+		{name: "valid", token: signedToken(t, jwt.SigningMethodHS256, []byte("secret"), valid)},
+		{name: "wrong secret", token: signedToken(t, jwt.SigningMethodHS256, []byte("other"), valid), wantErr: true},
+		{name: "other hmac algorithm", token: signedToken(t, jwt.SigningMethodHS512, []byte("secret"), valid), wantErr: true},
+		{name: "unsigned", token: signedToken(t, jwt.SigningMethodNone, jwt.UnsafeAllowNoneSignatureType, valid), wantErr: true},
+		{
+			name:    "expired",
+			token:   signedToken(t, jwt.SigningMethodHS256, []byte("secret"), jwt.MapClaims{"sub": 42, "exp": past}),
+			wantErr: true,
+		},
+		{
+			name:    "no expiry",
+			token:   signedToken(t, jwt.SigningMethodHS256, []byte("secret"), jwt.MapClaims{"sub": 42}),
+			wantErr: true,
+		},
+		{name: "garbage", token: "not.a.token", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			user, err := parseAccessToken(tt.token)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("parseAccessToken() = %+v, want error", user)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseAccessToken() error = %v", err)
+			}
+			want := authUser{ID: 42, Email: "a@example.com", Role: roleAdmin}
+			if *user != want {
+				t.Errorf("parseAccessToken() = %+v, want %+v", *user, want)
+			}
+		})
+	}
+}
+
+func TestParseAccessTokenWithoutSecret(t *testing.T) {
+	t.Setenv("JWT_SECRET", "")
+	token := signedToken(t, jwt.SigningMethodHS256, []byte(""), jwt.MapClaims{"sub": 1, "exp": time.Now().Add(time.Hour).Unix()})
+	if _, err := parseAccessToken(token); err == nil {
+		t.Error("token accepted without JWT_SECRET")
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/disintegration/imaging"
+)
+
+const codeAuthRequired = "AUTH_REQUIRED"
+
+// Avatar sizes, square and cropped before resizing so cover never has
+// anything left to cut.
+const defaultAvatarVariants = "64:64x64,128:128x128,256:256x256"
+
+// parseCropRect reads "x,y,width,height" in pixels of the uploaded image
+// as displayed, i.e. after EXIF orientation, which is what browser
+// croppers report.
+func parseCropRect(s string) (image.Rectangle, error) {
+	parts := strings.Split(s, ",")
+	if len(parts) != 4 {
+		return image.Rectangle{}, fmt.Errorf("crop must be x,y,width,height")
+	}
+	var v [4]int
+	for i, p := range parts {
+		f, err := strconv.ParseFloat(strings.TrimSpace(p), 64)
+		// Written so NaN fails too, and so the sum with the offset fits
+		if err != nil || !(f >= 0 && f <= math.MaxInt32) {
+			return image.Rectangle{}, fmt.Errorf("crop must be x,y,width,height with non-negative numbers")
+		}
+		v[i] = int(math.Round(f))
+	}
+	if v[2] == 0 || v[3] == 0 {
+		return image.Rectangle{}, fmt.Errorf("crop width and height must be positive")
+	}
+	return image.Rect(v[0], v[1], v[0]+v[2], v[1]+v[3]), nil
+}
+
+// squareCrop cuts the centred square out of crop, or out of the whole
+// image when crop is nil. Croppers locked to 1:1 can still be a pixel off,
+// so a near-square rectangle loses the difference evenly on both sides.
+func squareCrop(img image.Image, crop *image.Rectangle) (image.Image, error) {
+	b := img.Bounds()
+	area := b
+	if crop != nil {
+		area = crop.Add(b.Min).Intersect(b)
+		if area.Empty() {
+			return nil, badUpload("Crop rectangle is outside the %dx%d image", b.Dx(), b.Dy())
+		}
+	}
+
+	side := min(area.Dx(), area.Dy())
+	x := area.Min.X + (area.Dx()-side)/2
+	y := area.Min.Y + (area.Dy()-side)/2
+	return imaging.Crop(img, image.Rect(x, y, x+side, y+side)), nil
+}
+
+// userFolder holds the files of one user for a per-user preset. Every
+// upload writes a fresh set named by its version, <version>_<variant>.
+func userFolder(prefix string, owner int) string {
+	return fmt.Sprintf("%s%d/", prefix, owner)
+}
+
+// olderUserFiles picks the names in a user folder that belong to uploads
+// before version. Newer sets are left alone, they come from an upload that
+// finished at the same time and replaces this one.
+func olderUserFiles(names []string, version int64) []string {
+	var older []string
+	for _, name := range names {
+		v, _, ok := strings.Cut(name, "_")
+		if n, err := strconv.ParseInt(v, 10, 64); ok && err == nil && n < version {
+			older = append(older, name)
+		}
+	}
+	return older
+}
+
+// replaceUserFiles deletes the previous files of a per-user upload. It
+// runs once the new set is stored and recorded, so an upload failing part
+// way leaves the current avatar in place. The new URLs differ from the old
+// ones, browsers and CDNs cannot serve the replaced file from cache.
+func (s *mediaService) replaceUserFiles(ctx context.Context, result *uploadResult) {
+	var names []string
+	for offset := 0; ; offset += retentionPageSize {
+		objects, err := s.store.List(result.bucket, result.userFolder, retentionPageSize, offset)
+		if err != nil {
+			fmt.Printf("Storage List Error: %v\n", err)
+			return
+		}
+		for _, obj := range objects {
+			names = append(names, obj.Name)
+		}
+		if len(objects) < retentionPageSize {
+			break
+		}
+	}
+
+	var stale []objectRef
+	for _, name := range olderUserFiles(names, result.Version) {
+		stale = append(stale, objectRef{result.bucket, result.userFolder + name})
+	}
+	if len(stale) == 0 {
+		return
+	}
+	if err := s.deleteObjects(ctx, stale); err != nil {
+		fmt.Printf("Storage Delete Error: %v\n", err)
+	}
+}
+
+func authRequired(purpose string) error {
+	return &uploadError{
+		Status:  http.StatusUnauthorized,
+		Code:    codeAuthRequired,
+		Message: fmt.Sprintf("An access token is required for %s uploads", purpose),
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"image"
+	"image/color"
+	"reflect"
+	"testing"
+
+	"github.com/disintegration/imaging"
+)
+
+func TestParseCropRect(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    image.Rectangle
+		wantErr bool
+	}{
+		{in: "10,20,100,100", want: image.Rect(10, 20, 110, 120)},
+		{in: " 0, 0, 50.4 ,49.6", want: image.Rect(0, 0, 50, 50)},
+		{in: "1e1,0,5,5", want: image.Rect(10, 0, 15, 5)},
+		{in: "10,20,100", wantErr: true},
+		{in: "10,20,100,100,1", wantErr: true},
+		{in: "-1,0,10,10", wantErr: true},
+		{in: "0,0,0,10", wantErr: true},
+		{in: "0,0,10,0.2", wantErr: true},
+		{in: "0,0,Inf,10", wantErr: true},
+		{in: "0,0,NaN,10", wantErr: true},
+		{in: "0,0,1e300,10", wantErr: true},
+		{in: "a,b,c,d", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseCropRect(tt.in)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("parseCropRect(%q) = %v, %v, want %v (error %v)", tt.in, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestSquareCrop(t *testing.T) {
+	img := imaging.New(200, 100, color.Black)
+	// Offset bounds, as decoders of cropped sources can return
+	offset := imaging.Clone(img).SubImage(image.Rect(20, 10, 220, 110))
+
+	crop := func(x0, y0, x1, y1 int) *image.Rectangle {
+		r := image.Rect(x0, y0, x1, y1)
+		return &r
+	}
+	tests := []struct {
+		name    string
+		img     image.Image
+		crop    *image.Rectangle
+		want    image.Point
+		wantErr bool
+	}{
+		{name: "centre of the image", img: img, want: image.Pt(100, 100)},
+		{name: "near-square crop", img: img, crop: crop(10, 10, 61, 60), want: image.Pt(50, 50)},
+		{name: "crop past the edge", img: img, crop: crop(150, 50, 250, 150), want: image.Pt(50, 50)},
+		{name: "offset bounds", img: offset, crop: crop(0, 0, 40, 40), want: image.Pt(40, 40)},
+		{name: "crop outside", img: img, crop: crop(300, 0, 400, 100), wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := squareCrop(tt.img, tt.crop)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("%s: squareCrop() = %v, want error", tt.name, got.Bounds())
+			}
+			continue
+		}
+		if err != nil || got.Bounds().Size() != tt.want {
+			t.Errorf("%s: squareCrop() = %v, %v, want %v", tt.name, got.Bounds().Size(), err, tt.want)
+		}
+	}
+}
+
+func TestOlderUserFiles(t *testing.T) {
+	if got := userFolder("avatars/", 42); got != "avatars/42/" {
+		t.Errorf("userFolder() = %q", got)
+	}
+
+	names := []string{"100_64.jpg", "100_128.jpg", "200_64.webp", "300_64.jpg", "x_64.jpg", "cover.jpg"}
+	want := []string{"100_64.jpg", "100_128.jpg"}
+	if got := olderUserFiles(names, 200); !reflect.DeepEqual(got, want) {
+		t.Errorf("olderUserFiles() = %v, want %v", got, want)
+	}
+}
+
+func TestReplaceUserFiles(t *testing.T) {
+	t.Setenv("MEDIA_TRANSFORM_CACHE_DIR", "")
+	rdb, _ := testRedis(t)
+	cache, err := newRenderCache()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &mediaService{
+		store:       testLocalStore(t),
+		registry:    &mediaRegistry{rdb: rdb},
+		phash:       &phashIndex{rdb: rdb},
+		renderCache: cache,
+	}
+	for _, key := range []string{"avatars/42/100_64.jpg", "avatars/42/200_64.jpg", "avatars/42/300_64.jpg", "avatars/7/100_64.jpg"} {
+		if err := s.store.Put("public", key, []byte("jpg"), "image/jpeg", nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	s.replaceUserFiles(context.Background(), &uploadResult{Version: 200, bucket: "public", userFolder: "avatars/42/"})
+	for key, want := range map[string]bool{
+		"avatars/42/100_64.jpg": false,
+		"avatars/42/200_64.jpg": true,
+		"avatars/42/300_64.jpg": true,
+		"avatars/7/100_64.jpg":  true,
+	} {
+		if _, err := s.store.Stat("public", key); (err == nil) != want {
+			t.Errorf("after replaceUserFiles() %s exists = %v, want %v", key, err == nil, want)
+		}
+	}
+}
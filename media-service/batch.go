@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+)
+
+type batchConfig struct {
+	maxFiles int
+	workers  int
+}
+
+func loadBatchConfig() (batchConfig, error) {
+	maxFiles, err := envInt("MEDIA_BATCH_MAX_FILES", 10)
+	if err != nil {
+		return batchConfig{}, err
+	}
+	workers, err := envInt("MEDIA_BATCH_WORKERS", 4)
+	if err != nil {
+		return batchConfig{}, err
+	}
+	return batchConfig{maxFiles: maxFiles, workers: workers}, nil
+}
+
+type batchItem struct {
+	Index        int           `json:"index"`
+	OriginalName string        `json:"original_name"`
+	Status       int           `json:"status"`
+	Error        string        `json:"error,omitempty"`
+	Code         string        `json:"code,omitempty"`
+	Result       *uploadResult `json:"result,omitempty"`
+}
+
+// handleBatchUpload processes every "files" part concurrently and reports
+// per-file results in request order. With atomic=true any failure rolls
+// back the files that did succeed.
+func (s *mediaService) handleBatchUpload(c *gin.Context) {
+	form, err := c.MultipartForm()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Multipart form is required"})
+		return
+	}
+	headers := form.File["files"]
+	if len(headers) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "At least one file is required"})
+		return
+	}
+	if len(headers) > s.batch.maxFiles {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("At most %d files can be uploaded at once", s.batch.maxFiles)})
+		return
+	}
+
+	base, err := s.parseUploadOptions(c)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	if base.Preset.UserKey {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Only one file can be uploaded at a time for %s", base.Purpose)})
+		return
+	}
+	atomic := c.PostForm("atomic") == "true"
+
+	ctx := c.Request.Context()
+	items := make([]batchItem, len(headers))
+	sem := make(chan struct{}, s.batch.workers)
+	var wg sync.WaitGroup
+
+	for i, header := range headers {
+		items[i] = batchItem{Index: i, OriginalName: header.Filename}
+
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(item *batchItem) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			req := base
+			req.Filename = header.Filename
+			req.ContentType = header.Header.Get("Content-Type")
+			data, err := readUploadFile(header, req.Preset.MaxBytes)
+			if err == nil {
+				req.Data = data
+				item.Result, err = s.processUpload(ctx, req)
+			}
+			if err != nil {
+				item.Status = errorStatus(err)
+				item.Error = err.Error()
+				item.Code = errorCode(err)
+				return
+			}
+			item.Status = http.StatusOK
+		}(&items[i])
+	}
+	wg.Wait()
+
+	if gate := base.Preset.Gate; gate != nil && gate.Duplicate > 0 {
+		s.flagDuplicateShots(ctx, gate, items)
+	}
+
+	failed := 0
+	for _, item := range items {
+		if item.Error != "" {
+			failed++
+		}
+	}
+
+	rolledBack := false
+	if atomic && failed > 0 {
+		s.discardUploads(ctx, batchResults(items, -1), nil)
+		for i := range items {
+			if items[i].Result != nil {
+				items[i].Result = nil
+				items[i].Status = http.StatusConflict
+				items[i].Error = "Rolled back because another file in the batch failed"
+			}
+		}
+		rolledBack = true
+	}
+
+	succeeded := 0
+	for i := range items {
+		if items[i].Result == nil {
+			continue
+		}
+		if err := s.recordUpload(ctx, items[i].Result, base.Owner, batchResults(items, i)); err != nil {
+			items[i].Result = nil
+			items[i].Status = errorStatus(err)
+			items[i].Error = err.Error()
+			items[i].Code = errorCode(err)
+			failed++
+			continue
+		}
+		succeeded++
+	}
+
+	status := http.StatusOK
+	if rolledBack {
+		status = http.StatusUnprocessableEntity
+	} else if failed > 0 {
+		status = http.StatusMultiStatus
+	}
+
+	c.JSON(status, gin.H{
+		"results":     items,
+		"succeeded":   succeeded,
+		"failed":      failed,
+		"atomic":      atomic,
+		"rolled_back": rolledBack,
+	})
+}
+
+// flagDuplicateShots compares every stored photo with the earlier ones in
+// the batch, so a seller who uploads the same shot twice is told about it.
+// Depending on the gate mode the later copy is rejected or gets a warning.
+// PDFs have no frame to compare and are left alone.
+func (s *mediaService) flagDuplicateShots(ctx context.Context, gate *qualityGate, items []batchItem) {
+	for i := range items {
+		if !hasFrameHash(items[i].Result) {
+			continue
+		}
+		for j := 0; j < i; j++ {
+			if !hasFrameHash(items[j].Result) || !gate.sameShot(items[i].Result.frameHash, items[j].Result.frameHash) {
+				continue
+			}
+
+			issue := qualityIssue{
+				Code:    codeImageDuplicateShot,
+				Message: fmt.Sprintf("Looks like the same shot as %s", items[j].OriginalName),
+			}
+			if gate.Mode == gateModeReject {
+				// Identical files share stored objects, the earlier copy
+				// still needs them
+				s.discardUploads(ctx, []*uploadResult{items[i].Result}, batchResults(items, i))
+				items[i].Result = nil
+				items[i].Status = http.StatusUnprocessableEntity
+				items[i].Error = issue.Message
+				items[i].Code = issue.Code
+			} else {
+				report := items[i].Result.QualityCheck
+				report.Issues = append(report.Issues, issue)
+				report.Passed = false
+			}
+			break
+		}
+	}
+}
+
+// hasFrameHash reports whether result is a stored photo that went through
+// the quality gate and can be compared with others. A flat photo hashes to
+// zero too, so the report is what tells photos and PDFs apart.
+func hasFrameHash(result *uploadResult) bool {
+	return result != nil && result.QualityCheck != nil
+}
+
+// batchResults returns the stored results of items, leaving out the one at
+// skip.
+func batchResults(items []batchItem, skip int) []*uploadResult {
+	var results []*uploadResult
+	for i := range items {
+		if i != skip && items[i].Result != nil {
+			results = append(results, items[i].Result)
+		}
+	}
+	return results
+}
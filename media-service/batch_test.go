@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+)
+
+func TestLoadBatchConfig(t *testing.T) {
+	tests := []struct {
+		maxFiles, workers string
+		want              batchConfig
+		wantErr           bool
+	}{
+		{want: batchConfig{maxFiles: 10, workers: 4}},
+		{maxFiles: "25", workers: "8", want: batchConfig{maxFiles: 25, workers: 8}},
+		{maxFiles: "0", wantErr: true},
+		{workers: "-1", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Setenv("MEDIA_BATCH_MAX_FILES", tt.maxFiles)
+		t.Setenv("MEDIA_BATCH_WORKERS", tt.workers)
+		got, err := loadBatchConfig()
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("loadBatchConfig(%q, %q) = %+v, %v, want %+v (error %v)", tt.maxFiles, tt.workers, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestBatchResults(t *testing.T) {
+	a, b := &uploadResult{URL: "a"}, &uploadResult{URL: "b"}
+	items := []batchItem{{Result: a}, {Error: "failed"}, {Result: b}}
+
+	tests := []struct {
+		skip int
+		want []*uploadResult
+	}{
+		{skip: -1, want: []*uploadResult{a, b}},
+		{skip: 0, want: []*uploadResult{b}},
+		{skip: 2, want: []*uploadResult{a}},
+	}
+	for _, tt := range tests {
+		got := batchResults(items, tt.skip)
+		if len(got) != len(tt.want) {
+			t.Errorf("batchResults(skip %d) = %d results, want %d", tt.skip, len(got), len(tt.want))
+			continue
+		}
+		for i := range got {
+			if got[i] != tt.want[i] {
+				t.Errorf("batchResults(skip %d)[%d] = %s, want %s", tt.skip, i, got[i].URL, tt.want[i].URL)
+			}
+		}
+	}
+}
+
+func TestFlagDuplicateShots(t *testing.T) {
+	photo := func(hash uint64) *uploadResult {
+		return &uploadResult{QualityCheck: &qualityReport{Passed: true}, frameHash: hash}
+	}
+	// PDFs skip the gate, they have no report and no frame hash
+	pdf := func() *uploadResult { return &uploadResult{} }
+
+	tests := []struct {
+		name        string
+		mode        string
+		items       []batchItem
+		wantFlagged []bool
+	}{
+		{
+			name:        "pdfs in warn mode",
+			mode:        gateModeWarn,
+			items:       []batchItem{{Result: pdf()}, {Result: pdf()}},
+			wantFlagged: []bool{false, false},
+		},
+		{
+			name:        "pdfs in reject mode",
+			mode:        gateModeReject,
+			items:       []batchItem{{Result: pdf()}, {Result: pdf()}},
+			wantFlagged: []bool{false, false},
+		},
+		{
+			name:        "pdf between flat photos",
+			mode:        gateModeWarn,
+			items:       []batchItem{{Result: photo(0)}, {Result: pdf()}, {Result: photo(0)}},
+			wantFlagged: []bool{false, false, true},
+		},
+		{
+			name:        "same shot in warn mode",
+			mode:        gateModeWarn,
+			items:       []batchItem{{Result: photo(0xf0f0)}, {Error: "failed"}, {Result: photo(0xf0f1)}},
+			wantFlagged: []bool{false, false, true},
+		},
+		{
+			name:        "same shot in reject mode",
+			mode:        gateModeReject,
+			items:       []batchItem{{Result: photo(0xf0f0)}, {Result: photo(0xf0f0)}},
+			wantFlagged: []bool{false, true},
+		},
+		{
+			name:        "different shots",
+			mode:        gateModeReject,
+			items:       []batchItem{{Result: photo(0xf0f0)}, {Result: photo(0x0f0f)}},
+			wantFlagged: []bool{false, false},
+		},
+	}
+	for _, tt := range tests {
+		s := &mediaService{}
+		gate := &qualityGate{Duplicate: 2, Mode: tt.mode}
+		s.flagDuplicateShots(context.Background(), gate, tt.items)
+
+		for i, item := range tt.items {
+			var flagged bool
+			if tt.mode == gateModeReject {
+				flagged = item.Code == codeImageDuplicateShot
+				if flagged && (item.Result != nil || item.Status != http.StatusUnprocessableEntity) {
+					t.Errorf("%s: item %d rejected but kept %+v", tt.name, i, item)
+				}
+			} else if item.Result != nil && item.Result.QualityCheck != nil {
+				issues := item.Result.QualityCheck.Issues
+				flagged = len(issues) == 1 && issues[0].Code == codeImageDuplicateShot
+				if flagged == item.Result.QualityCheck.Passed {
+					t.Errorf("%s: item %d passed = %v with issues %v", tt.name, i, item.Result.QualityCheck.Passed, issues)
+				}
+			}
+			if flagged != tt.wantFlagged[i] {
+				t.Errorf("%s: item %d flagged = %v, want %v", tt.name, i, flagged, tt.wantFlagged[i])
+			}
+		}
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// lruCache is a size-bounded LRU index. Values are kept in memory when
+// dir is empty, otherwise they are written to files in dir and only the
+// bookkeeping stays in memory.
+type lruCache struct {
+	mu       sync.Mutex
+	maxBytes int64
+	size     int64
+	dir      string
+	ll       *list.List
+	items    map[string]*list.Element
+}
+
+type lruEntry struct {
+	key         string
+	contentType string
+	value       []byte
+	size        int64
+}
+
+func newMemoryCache(maxBytes int64) *lruCache {
+	return &lruCache{
+		maxBytes: maxBytes,
+		ll:       list.New(),
+		items:    make(map[string]*list.Element),
+	}
+}
+
+// Cache files are named <sha256 of key><diskCacheSuffix>, nothing else in
+// the directory is touched.
+const diskCacheSuffix = ".transform"
+
+// newDiskCache creates a cache backed by dir. Cache files left over from a
+// previous run are dropped since their keys cannot be recovered.
+func newDiskCache(dir string, maxBytes int64) (*lruCache, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		if e.Type().IsRegular() && isDiskCacheFile(e.Name()) {
+			if err := os.Remove(filepath.Join(dir, e.Name())); err != nil {
+				return nil, err
+			}
+		}
+	}
+	c := newMemoryCache(maxBytes)
+	c.dir = dir
+	return c, nil
+}
+
+func isDiskCacheFile(name string) bool {
+	sum, ok := strings.CutSuffix(name, diskCacheSuffix)
+	if !ok || len(sum) != sha256.Size*2 {
+		return false
+	}
+	_, err := hex.DecodeString(sum)
+	return err == nil
+}
+
+func (c *lruCache) path(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(c.dir, hex.EncodeToString(sum[:])+diskCacheSuffix)
+}
+
+func (c *lruCache) Get(key string) ([]byte, string, bool) {
+	c.mu.Lock()
+	el, ok := c.items[key]
+	if !ok {
+		c.mu.Unlock()
+		return nil, "", false
+	}
+	c.ll.MoveToFront(el)
+	entry := el.Value.(*lruEntry)
+	c.mu.Unlock()
+
+	if c.dir == "" {
+		return entry.value, entry.contentType, true
+	}
+	data, err := os.ReadFile(c.path(key))
+	if err != nil {
+		c.remove(key)
+		return nil, "", false
+	}
+	return data, entry.contentType, true
+}
+
+func (c *lruCache) Put(key string, value []byte, contentType string) {
+	size := int64(len(value))
+	if size > c.maxBytes {
+		return
+	}
+
+	entry := &lruEntry{key: key, contentType: contentType, size: size}
+	if c.dir == "" {
+		entry.value = value
+	} else if err := os.WriteFile(c.path(key), value, 0o644); err != nil {
+		fmt.Printf("Cache write error: %v\n", err)
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.items[key]; ok {
+		c.size -= el.Value.(*lruEntry).size
+		el.Value = entry
+		c.ll.MoveToFront(el)
+	} else {
+		c.items[key] = c.ll.PushFront(entry)
+	}
+	c.size += size
+
+	for c.size > c.maxBytes {
+		c.evictOldest()
+	}
+}
+
+func (c *lruCache) remove(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.items[key]; ok {
+		c.removeElement(el)
+	}
+}
+
+func (c *lruCache) removePrefix(prefix string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for key, el := range c.items {
+		if strings.HasPrefix(key, prefix) {
+			c.removeElement(el)
+		}
+	}
+}
+
+func (c *lruCache) evictOldest() {
+	if el := c.ll.Back(); el != nil {
+		c.removeElement(el)
+	}
+}
+
+func (c *lruCache) removeElement(el *list.Element) {
+	entry := el.Value.(*lruEntry)
+	c.ll.Remove(el)
+	delete(c.items, entry.key)
+	c.size -= entry.size
+	if c.dir != "" {
+		os.Remove(c.path(entry.key))
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestNewDiskCacheKeepsForeignFiles(t *testing.T) {
+	dir := t.TempDir()
+	stale := strings.Repeat("ab", 32) + diskCacheSuffix
+	foreign := []string{
+		"notes.txt",
+		strings.Repeat("ab", 32),
+		"short" + diskCacheSuffix,
+		strings.Repeat("zz", 32) + diskCacheSuffix,
+	}
+	for _, name := range append([]string{stale}, foreign...) {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte("x"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Mkdir(filepath.Join(dir, "sub"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := newDiskCache(dir, 1<<20); err != nil {
+		t.Fatalf("newDiskCache() error = %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, stale)); !os.IsNotExist(err) {
+		t.Errorf("leftover cache file was kept")
+	}
+	for _, name := range append(foreign, "sub") {
+		if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			t.Errorf("%s was removed: %v", name, err)
+		}
+	}
+}
+
+func TestLRUCacheEviction(t *testing.T) {
+	disk, err := newDiskCache(t.TempDir(), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caches := map[string]*lruCache{"memory": newMemoryCache(10), "disk": disk}
+
+	for name, c := range caches {
+		t.Run(name, func(t *testing.T) {
+			c.Put("a?w=1", []byte("aaaa"), "image/jpeg")
+			c.Put("b?w=1", []byte("bbbb"), "image/png")
+			c.Put("huge", []byte("01234567890"), "image/png")
+			if _, _, ok := c.Get("huge"); ok {
+				t.Error("value larger than the cache was stored")
+			}
+
+			// Touch a so b is the least recently used
+			if data, contentType, ok := c.Get("a?w=1"); !ok || string(data) != "aaaa" || contentType != "image/jpeg" {
+				t.Fatalf("Get(a) = %q, %q, %v", data, contentType, ok)
+			}
+			c.Put("c?w=1", []byte("cccc"), "image/jpeg")
+			if _, _, ok := c.Get("b?w=1"); ok {
+				t.Error("least recently used entry was not evicted")
+			}
+			if _, _, ok := c.Get("a?w=1"); !ok {
+				t.Error("recently used entry was evicted")
+			}
+
+			c.removePrefix("a?")
+			if _, _, ok := c.Get("a?w=1"); ok {
+				t.Error("removePrefix kept a matching entry")
+			}
+			if _, _, ok := c.Get("c?w=1"); !ok {
+				t.Error("removePrefix dropped another key")
+			}
+			if c.size != 4 {
+				t.Errorf("size = %d, want 4", c.size)
+			}
+		})
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// envInt reads a positive integer setting, falling back to def when unset.
+func envInt(name string, def int) (int, error) {
+	v := os.Getenv(name)
+	if v == "" {
+		return def, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("%s must be a positive integer", name)
+	}
+	return n, nil
+}
+
+// envPurposes reads a comma separated list of built-in purposes, or
+// "none".
+func envPurposes(name, def string) (map[string]bool, error) {
+	spec := os.Getenv(name)
+	if spec == "" {
+		spec = def
+	}
+	purposes := make(map[string]bool)
+	for _, p := range strings.Split(spec, ",") {
+		p = strings.TrimSpace(p)
+		if p == "" || p == "none" {
+			continue
+		}
+		if !validPurpose(p) {
+			return nil, fmt.Errorf("%s: unknown purpose %q", name, p)
+		}
+		purposes[p] = true
+	}
+	return purposes, nil
+}
+
+// publicServiceURL is where clients reach this service, used in links it
+// hands out.
+func publicServiceURL() string {
+	if u := os.Getenv("MEDIA_PUBLIC_URL"); u != "" {
+		return strings.TrimRight(u, "/")
+	}
+	port := os.Getenv("PORT")
+	if port == "" {
+		port = "8080"
+	}
+	return "http://localhost:" + port
+}
+
+// trustedProxies lists the proxies whose X-Forwarded-For is believed when
+// working out a client's address, from MEDIA_TRUSTED_PROXIES as comma
+// separated IPs or CIDRs. None by default, so clients cannot pick the
+// address their quota is counted against.
+func trustedProxies() []string {
+	var proxies []string
+	for _, p := range strings.Split(os.Getenv("MEDIA_TRUSTED_PROXIES"), ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			proxies = append(proxies, p)
+		}
+	}
+	return proxies
+}
+
+// redisAddr uses the same REDIS_HOST/REDIS_PORT settings as app-service.
+func redisAddr() string {
+	host := os.Getenv("REDIS_HOST")
+	if host == "" {
+		host = "localhost"
+	}
+	port := os.Getenv("REDIS_PORT")
+	if port == "" {
+		port = "6379"
+	}
+	return host + ":" + port
+}
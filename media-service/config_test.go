@@ -0,0 +1,87 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestEnvInt(t *testing.T) {
+	tests := []struct {
+		env     string
+		want    int
+		wantErr bool
+	}{
+		{env: "", want: 7},
+		{env: "1", want: 1},
+		{env: "250", want: 250},
+		{env: "0", wantErr: true},
+		{env: "-3", wantErr: true},
+		{env: "2.5", wantErr: true},
+		{env: "ten", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Setenv("MEDIA_TEST_INT", tt.env)
+		got, err := envInt("MEDIA_TEST_INT", 7)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("envInt(%q) = %d, %v, want %d (error %v)", tt.env, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestEnvPurposes(t *testing.T) {
+	tests := []struct {
+		env     string
+		want    map[string]bool
+		wantErr bool
+	}{
+		{env: "", want: map[string]bool{purposeProduct: true}},
+		{env: "none", want: map[string]bool{}},
+		{env: " avatar , receipt,", want: map[string]bool{purposeAvatar: true, purposeReceipt: true}},
+		{env: "product,banner", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Setenv("MEDIA_TEST_PURPOSES", tt.env)
+		got, err := envPurposes("MEDIA_TEST_PURPOSES", "product")
+		if (err != nil) != tt.wantErr {
+			t.Errorf("envPurposes(%q) error = %v, want error %v", tt.env, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("envPurposes(%q) = %v, want %v", tt.env, got, tt.want)
+		}
+	}
+}
+
+func TestPublicServiceURL(t *testing.T) {
+	tests := []struct {
+		publicURL, port, want string
+	}{
+		{publicURL: "", port: "", want: "http://localhost:8080"},
+		{publicURL: "", port: "9000", want: "http://localhost:9000"},
+		{publicURL: "https://media.example.com/", port: "9000", want: "https://media.example.com"},
+	}
+	for _, tt := range tests {
+		t.Setenv("MEDIA_PUBLIC_URL", tt.publicURL)
+		t.Setenv("PORT", tt.port)
+		if got := publicServiceURL(); got != tt.want {
+			t.Errorf("publicServiceURL() = %q, want %q", got, tt.want)
+		}
+	}
+}
+
+func TestTrustedProxies(t *testing.T) {
+	tests := []struct {
+		env  string
+		want []string
+	}{
+		{env: "", want: nil},
+		{env: " , ", want: nil},
+		{env: "10.0.0.1, 172.16.0.0/12,", want: []string{"10.0.0.1", "172.16.0.0/12"}},
+	}
+	for _, tt := range tests {
+		t.Setenv("MEDIA_TRUSTED_PROXIES", tt.env)
+		if got := trustedProxies(); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("trustedProxies() with %q = %v, want %v", tt.env, got, tt.want)
+		}
+	}
+}
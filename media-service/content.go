@@ -0,0 +1,52 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"sync"
+)
+
+// contentLocks serialise the check and upload of the same key, so two
+// identical files in one batch cannot both decide to create the object
+// and later delete it from under each other.
+var contentLocks [64]sync.Mutex
+
+// contentKey is where data is stored: the hex SHA-256 of the bytes under
+// prefix, so identical files share one object and keys never depend on
+// what the file was called.
+func contentKey(prefix string, data []byte, ext string) string {
+	sum := sha256.Sum256(data)
+	return prefix + hex.EncodeToString(sum[:]) + ext
+}
+
+// storeContent writes data to its content key with the original file
+// name as metadata. When reuse is set and the object already exists the
+// upload is skipped and reused reports it, such objects may be shared with
+// other uploads and must not be deleted on their behalf.
+func storeContent(store objectStore, bucket, key string, data []byte, contentType, originalName string, reuse bool) (url string, reused bool, err error) {
+	h := fnv.New32a()
+	h.Write([]byte(bucket + "/" + key))
+	mu := &contentLocks[h.Sum32()%uint32(len(contentLocks))]
+	mu.Lock()
+	defer mu.Unlock()
+
+	if reuse {
+		_, err := store.Stat(bucket, key)
+		if err == nil {
+			fmt.Printf("Reusing stored %s for %s\n", key, originalName)
+			return store.URL(bucket, key), true, nil
+		}
+		if !errors.Is(err, errObjectNotFound) {
+			// Uploading again is always safe, just slower
+			fmt.Printf("Storage Stat Error: %v\n", err)
+		}
+	}
+
+	if err := store.Put(bucket, key, data, contentType, map[string]string{"original_name": originalName}); err != nil {
+		return "", false, err
+	}
+	return store.URL(bucket, key), false, nil
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestContentKey(t *testing.T) {
+	// SHA-256 of "abc"
+	const sum = "ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad"
+	tests := []struct {
+		prefix, ext string
+		data        string
+		want        string
+	}{
+		{prefix: "products/", data: "abc", ext: ".jpg", want: "products/" + sum + ".jpg"},
+		{prefix: "", data: "abc", ext: ".png", want: sum + ".png"},
+		{prefix: "originals/receipts/", data: "abc", ext: "", want: "originals/receipts/" + sum},
+	}
+	for _, tt := range tests {
+		if got := contentKey(tt.prefix, []byte(tt.data), tt.ext); got != tt.want {
+			t.Errorf("contentKey(%q, %q, %q) = %q, want %q", tt.prefix, tt.data, tt.ext, got, tt.want)
+		}
+	}
+	if contentKey("", []byte("abc"), "") == contentKey("", []byte("abd"), "") {
+		t.Error("contentKey() is the same for different data")
+	}
+}
+
+func TestStoreContent(t *testing.T) {
+	t.Setenv("MEDIA_LOCAL_STORAGE_DIR", t.TempDir())
+	t.Setenv("MEDIA_LOCAL_STORAGE_URL", "http://media.test/files")
+	store, err := newLocalStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := contentKey("products/", []byte("first"), ".jpg")
+
+	url, reused, err := storeContent(store, "public", key, []byte("first"), "image/jpeg", "Ảnh sản phẩm.jpg", true)
+	if err != nil || reused || !strings.HasSuffix(url, "/public/"+key) {
+		t.Fatalf("first store = %q, %v, %v", url, reused, err)
+	}
+
+	// Already stored, the upload is skipped and the same URL returned
+	again, reused, err := storeContent(store, "public", key, []byte("other bytes"), "image/jpeg", "copy.jpg", true)
+	if err != nil || !reused || again != url {
+		t.Errorf("second store = %q, %v, %v, want %q reused", again, reused, err, url)
+	}
+	if data, err := store.Get("public", key); err != nil || string(data) != "first" {
+		t.Errorf("stored data = %q, %v, want the first upload", data, err)
+	}
+
+	// Without reuse the object is written again
+	if _, reused, err := storeContent(store, "public", key, []byte("rewritten"), "image/jpeg", "copy.jpg", false); err != nil || reused {
+		t.Errorf("rewrite = %v, %v", reused, err)
+	}
+	if data, _ := store.Get("public", key); string(data) != "rewritten" {
+		t.Errorf("stored data = %q after rewrite", data)
+	}
+
+	if _, err := store.Stat("public", contentKey("products/", []byte("missing"), ".jpg")); !errors.Is(err, errObjectNotFound) {
+		t.Errorf("Stat() of a missing object = %v, want errObjectNotFound", err)
+	}
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	codeMediaNotFound = "MEDIA_NOT_FOUND"
+	codeNotMediaOwner = "NOT_MEDIA_OWNER"
+	codeMediaInUse    = "MEDIA_IN_USE"
+)
+
+// storedUpload is what a delete request resolved to. Files stored before
+// uploads were recorded have no objects or owners.
+type storedUpload struct {
+	primary objectRef
+	objects []objectRef
+	owners  []int
+}
+
+// candidateBuckets orders the buckets a key may be in, those of presets
+// whose prefix it starts with first.
+func (s *mediaService) candidateBuckets(key string) []string {
+	presets := make([]*purposePreset, 0, len(s.presets))
+	for _, p := range s.presets {
+		if strings.HasPrefix(key, p.Prefix) {
+			presets = append(presets, p)
+		}
+	}
+	sort.Slice(presets, func(i, j int) bool {
+		return len(presets[i].Prefix) > len(presets[j].Prefix)
+	})
+
+	var buckets []string
+	for _, p := range presets {
+		if !slices.Contains(buckets, p.Bucket) {
+			buckets = append(buckets, p.Bucket)
+		}
+	}
+	for _, b := range s.buckets() {
+		if !slices.Contains(buckets, b) {
+			buckets = append(buckets, b)
+		}
+	}
+	return buckets
+}
+
+// locateUpload finds the upload a key is the primary of, or failing that
+// any stored object with that key.
+func (s *mediaService) locateUpload(ctx context.Context, key string) (*storedUpload, error) {
+	buckets := s.candidateBuckets(key)
+	for _, bucket := range buckets {
+		primary := objectRef{Bucket: bucket, Key: key}
+		objs, owners, err := s.registry.Upload(ctx, primary)
+		if err != nil {
+			return nil, err
+		}
+		if len(objs) > 0 {
+			return &storedUpload{primary: primary, objects: objs, owners: owners}, nil
+		}
+	}
+	for _, bucket := range buckets {
+		_, err := s.store.Stat(bucket, key)
+		if err == nil {
+			return &storedUpload{primary: objectRef{Bucket: bucket, Key: key}}, nil
+		}
+		if !errors.Is(err, errObjectNotFound) {
+			return nil, err
+		}
+	}
+	return nil, nil
+}
+
+// deletableBy reports whether user may delete the upload, or at least
+// their claim on it.
+func (u *storedUpload) deletableBy(user *authUser) bool {
+	if user.Role == roleAdmin {
+		return true
+	}
+	return user.ID != anonymousOwner && slices.Contains(u.owners, user.ID)
+}
+
+// claimOnly reports whether deleting for user only drops their claim,
+// because someone else uploaded the same content too. An anonymous upload
+// counts as someone else.
+func (u *storedUpload) claimOnly(user *authUser) bool {
+	return user.Role != roleAdmin && len(u.owners) > 1
+}
+
+// handleDelete deletes an upload with all its variants. Only its uploader
+// or an admin may, and only once no database row refers to it any more.
+// When others uploaded the same content, anonymously included, only the
+// user's claim is dropped, and objects shared with another upload are
+// kept for it.
+func (s *mediaService) handleDelete(c *gin.Context) {
+	user := currentUser(c)
+	key := strings.TrimPrefix(c.Param("key"), "/")
+	if !validObjectKey(key) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid media key"})
+		return
+	}
+	ctx := c.Request.Context()
+
+	upload, err := s.locateUpload(ctx, key)
+	if err != nil {
+		fmt.Printf("Media Lookup Error: %v\n", err)
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Failed to look up media"})
+		return
+	}
+	if upload == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Media not found", "code": codeMediaNotFound})
+		return
+	}
+
+	if !upload.deletableBy(user) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Only the uploader can delete this media", "code": codeNotMediaOwner})
+		return
+	}
+
+	if s.db != nil {
+		refs, err := s.referencesTo(ctx, upload.primary)
+		if err != nil {
+			fmt.Printf("Reference Check Error: %v\n", err)
+			c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Failed to check where the media is used"})
+			return
+		}
+		if len(refs) > 0 {
+			c.JSON(http.StatusConflict, gin.H{
+				"error":      "Media is still in use, remove the references first",
+				"code":       codeMediaInUse,
+				"references": refs,
+			})
+			return
+		}
+	}
+
+	if upload.claimOnly(user) {
+		if err := s.registry.RemoveOwner(ctx, upload.primary, user.ID); err != nil {
+			fmt.Printf("Media Registry Error: %v\n", err)
+			c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Failed to delete media"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"key": key, "deleted": false, "shared": true})
+		return
+	}
+
+	doomed := []objectRef{upload.primary}
+	if len(upload.objects) > 0 {
+		doomed, err = s.unsharedObjects(ctx, upload)
+		if err != nil {
+			fmt.Printf("Media Registry Error: %v\n", err)
+			c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Failed to delete media"})
+			return
+		}
+	}
+	if err := s.deleteObjects(ctx, doomed); err != nil {
+		fmt.Printf("Storage Delete Error: %v\n", err)
+		c.JSON(http.StatusBadGateway, gin.H{"error": "Failed to delete media"})
+		return
+	}
+	if len(upload.objects) > 0 {
+		if err := s.registry.Forget(ctx, upload.primary); err != nil {
+			fmt.Printf("Media Registry Error: %v\n", err)
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{"key": key, "deleted": true, "deleted_objects": len(doomed)})
+}
+
+// unsharedObjects returns the objects of an upload that no other upload
+// uses.
+func (s *mediaService) unsharedObjects(ctx context.Context, upload *storedUpload) ([]objectRef, error) {
+	usedBy, err := s.registry.UsedBy(ctx, upload.objects)
+	if err != nil {
+		return nil, err
+	}
+	var objs []objectRef
+	for _, obj := range upload.objects {
+		shared := false
+		for _, other := range usedBy[obj] {
+			if other != upload.primary {
+				shared = true
+			}
+		}
+		if !shared {
+			objs = append(objs, obj)
+		}
+	}
+	return objs, nil
+}
+
+// deleteObjects removes objects from storage together with everything
+// kept about them: the duplicate index, cached transforms and the upload
+// registry.
+func (s *mediaService) deleteObjects(ctx context.Context, objs []objectRef) error {
+	byBucket := make(map[string][]string)
+	for _, obj := range objs {
+		byBucket[obj.Bucket] = append(byBucket[obj.Bucket], obj.Key)
+	}
+	for bucket, keys := range byBucket {
+		if err := s.store.Delete(bucket, keys); err != nil {
+			return err
+		}
+	}
+
+	for _, obj := range objs {
+		if err := s.phash.Remove(ctx, obj.Key); err != nil {
+			fmt.Printf("Phash Index Error: %v\n", err)
+		}
+		if obj.Bucket == s.publicBucket {
+			s.renderCache.Invalidate(obj.Key)
+		}
+	}
+	if err := s.registry.ForgetObjects(ctx, objs); err != nil {
+		fmt.Printf("Media Registry Error: %v\n", err)
+	}
+	return nil
+}
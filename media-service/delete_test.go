@@ -0,0 +1,69 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestStoredUploadOwnership(t *testing.T) {
+	user := &authUser{ID: 7, Role: "USER"}
+	admin := &authUser{ID: 1, Role: roleAdmin}
+	anonymous := &authUser{ID: anonymousOwner, Role: "USER"}
+
+	tests := []struct {
+		name          string
+		owners        []int
+		user          *authUser
+		wantDeletable bool
+		wantClaimOnly bool
+	}{
+		{name: "sole owner", owners: []int{7}, user: user, wantDeletable: true},
+		{name: "shared with another user", owners: []int{7, 9}, user: user, wantDeletable: true, wantClaimOnly: true},
+		{name: "shared with an anonymous upload", owners: []int{anonymousOwner, 7}, user: user, wantDeletable: true, wantClaimOnly: true},
+		{name: "someone else's", owners: []int{9}, user: user},
+		{name: "anonymous upload", owners: []int{anonymousOwner}, user: user},
+		{name: "untracked", user: user},
+		{name: "token without a user id", owners: []int{anonymousOwner}, user: anonymous},
+		{name: "admin", owners: []int{anonymousOwner, 7}, user: admin, wantDeletable: true},
+		{name: "admin on untracked", user: admin, wantDeletable: true},
+	}
+	for _, tt := range tests {
+		upload := &storedUpload{owners: tt.owners}
+		if got := upload.deletableBy(tt.user); got != tt.wantDeletable {
+			t.Errorf("%s: deletableBy() = %v, want %v", tt.name, got, tt.wantDeletable)
+		}
+		if !tt.wantDeletable {
+			continue
+		}
+		if got := upload.claimOnly(tt.user); got != tt.wantClaimOnly {
+			t.Errorf("%s: claimOnly() = %v, want %v", tt.name, got, tt.wantClaimOnly)
+		}
+	}
+}
+
+func TestCandidateBuckets(t *testing.T) {
+	s := &mediaService{
+		publicBucket:  "public",
+		privateBucket: "private",
+		presets: map[string]*purposePreset{
+			purposeProduct: {Bucket: "public", Prefix: "products/"},
+			purposeReceipt: {Bucket: "private", Prefix: "receipts/"},
+			"invoice":      {Bucket: "invoices", Prefix: "receipts/invoices/"},
+		},
+	}
+	tests := []struct {
+		key  string
+		want []string
+	}{
+		{key: "receipts/a.pdf", want: []string{"private", "public", "invoices"}},
+		{key: "receipts/invoices/a.pdf", want: []string{"invoices", "private", "public"}},
+		{key: "products/a.jpg", want: []string{"public", "private", "invoices"}},
+		// Keys stored at the root before purposes had prefixes
+		{key: "1700000000_a.jpg", want: []string{"public", "private", "invoices"}},
+	}
+	for _, tt := range tests {
+		if got := s.candidateBuckets(tt.key); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("candidateBuckets(%q) = %v, want %v", tt.key, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+	"net/http"
+	"regexp"
+
+	"github.com/disintegration/imaging"
+)
+
+const codeInvalidPDF = "INVALID_PDF"
+
+// Document sizes keep small print such as transfer reference numbers
+// readable, the preview is for lists.
+const defaultDocumentVariants = "preview:800,document:2400"
+
+// formatPDF is only reported for PDFs stored as uploaded, nothing is ever
+// encoded to it.
+const formatPDF outputFormat = "pdf"
+
+const (
+	// Skew beyond this is more likely a photo taken sideways than a
+	// crooked scan
+	deskewMaxAngle = 10.0
+	deskewMinAngle = 0.2
+	// Long side of the copy the skew is measured on
+	deskewSampleSize = 1000
+	// Share of pixels clipped at each end when stretching contrast
+	documentClip = 0.01
+)
+
+// prepareDocument turns a photo or scan of a document into grayscale,
+// straightens small rotations and stretches the contrast so faint print
+// becomes dark. It returns the correction applied in degrees.
+func prepareDocument(img image.Image) (*image.NRGBA, float64) {
+	gray := imaging.Grayscale(flattenAlpha(img))
+
+	// Contrast goes first so the paper is white by the time the corners
+	// uncovered by the rotation are filled with white
+	angle := estimateSkew(gray)
+	gray = stretchContrast(gray)
+	if math.Abs(angle) < deskewMinAngle {
+		return gray, 0
+	}
+	return imaging.Rotate(gray, -angle, color.White), math.Round(angle*100) / 100
+}
+
+// estimateSkew finds the rotation at which the dark pixels line up best
+// in horizontal rows, which is when lines of text are level. Positive
+// angles mean the text rises to the right.
+func estimateSkew(img *image.NRGBA) float64 {
+	small := imaging.Fit(img, deskewSampleSize, deskewSampleSize, imaging.Box)
+	b := small.Bounds()
+
+	var hist [256]int
+	for i := 0; i < len(small.Pix); i += 4 {
+		hist[small.Pix[i]]++
+	}
+	threshold := otsuThreshold(hist)
+
+	var xs, ys []float64
+	for y := 0; y < b.Dy(); y++ {
+		for x := 0; x < b.Dx(); x++ {
+			if small.Pix[y*small.Stride+x*4] < threshold {
+				xs = append(xs, float64(x))
+				ys = append(ys, float64(y))
+			}
+		}
+	}
+	if len(xs) < 100 {
+		return 0
+	}
+
+	// Rows are scored by the sum of squared counts, which peaks when the
+	// dark pixels fall into as few rows as possible
+	offset := b.Dx() + b.Dy()
+	bins := make([]int, 2*offset)
+	score := func(deg float64) float64 {
+		clear(bins)
+		sin, cos := math.Sincos(deg * math.Pi / 180)
+		for i := range xs {
+			bins[int(ys[i]*cos+xs[i]*sin)+offset]++
+		}
+		var total float64
+		for _, n := range bins {
+			total += float64(n) * float64(n)
+		}
+		return total
+	}
+
+	best, bestScore := 0.0, score(0)
+	search := func(from, to, step float64) {
+		for deg := from; deg <= to+step/2; deg += step {
+			if s := score(deg); s > bestScore {
+				best, bestScore = deg, s
+			}
+		}
+	}
+	search(-deskewMaxAngle, deskewMaxAngle, 0.5)
+	search(best-0.5, best+0.5, 0.05)
+	return best
+}
+
+// otsuThreshold picks the gray level that best separates ink from paper.
+func otsuThreshold(hist [256]int) uint8 {
+	total, sum := 0, 0.0
+	for v, n := range hist {
+		total += n
+		sum += float64(v * n)
+	}
+
+	var bestVar, sumBelow float64
+	threshold, below := 0, 0
+	for v, n := range hist {
+		below += n
+		if below == 0 {
+			continue
+		}
+		above := total - below
+		if above == 0 {
+			break
+		}
+		sumBelow += float64(v * n)
+		meanBelow := sumBelow / float64(below)
+		meanAbove := (sum - sumBelow) / float64(above)
+		between := float64(below) * float64(above) * (meanBelow - meanAbove) * (meanBelow - meanAbove)
+		if between > bestVar {
+			bestVar, threshold = between, v
+		}
+	}
+	return uint8(threshold + 1)
+}
+
+// stretchContrast maps the darkest and lightest gray levels, ignoring
+// outliers, to black and white. Unlike auto-levels for photos the gain is
+// not capped, a washed out receipt should end up as black on white.
+func stretchContrast(img *image.NRGBA) *image.NRGBA {
+	var hist [256]int
+	for i := 0; i < len(img.Pix); i += 4 {
+		hist[img.Pix[i]]++
+	}
+	clip := int(float64(len(img.Pix)/4) * documentClip)
+
+	low, high := 0, 255
+	for seen := 0; low < 255; low++ {
+		if seen += hist[low]; seen > clip {
+			break
+		}
+	}
+	for seen := 0; high > 0; high-- {
+		if seen += hist[high]; seen > clip {
+			break
+		}
+	}
+	// A blank page has nothing to stretch
+	if high-low < 16 {
+		return img
+	}
+
+	var lut [256]uint8
+	for v := range lut {
+		lut[v] = clamp8(float64(v-low) * 255 / float64(high-low))
+	}
+	dst := imaging.Clone(img)
+	for i := 0; i < len(dst.Pix); i += 4 {
+		g := lut[dst.Pix[i]]
+		dst.Pix[i], dst.Pix[i+1], dst.Pix[i+2] = g, g, g
+	}
+	return dst
+}
+
+// toGray keeps a single channel so the encoders store one plane instead of
+// three identical ones.
+func toGray(img image.Image) *image.Gray {
+	b := img.Bounds()
+	dst := image.NewGray(b)
+	draw.Draw(dst, b, img, b.Min, draw.Src)
+	return dst
+}
+
+var pdfHeader = regexp.MustCompile(`^%PDF-[12]\.\d`)
+
+// Names that make a PDF do something when opened, rather than just show
+// pages. Streams may be compressed, so this only catches what is visible.
+var pdfActiveContent = regexp.MustCompile(`/(JavaScript|JS|Launch|EmbeddedFiles?|RichMedia|SubmitForm)[\s/<>\[\]()]`)
+
+// validatePDF checks the file is a complete PDF without active content.
+func validatePDF(data []byte) error {
+	invalid := func(format string, args ...any) error {
+		return &uploadError{
+			Status:  http.StatusUnprocessableEntity,
+			Code:    codeInvalidPDF,
+			Message: fmt.Sprintf(format, args...),
+		}
+	}
+
+	if !pdfHeader.Match(data) {
+		return invalid("File does not start with a PDF header")
+	}
+	tail := data[max(0, len(data)-1024):]
+	if !bytes.Contains(tail, []byte("%%EOF")) {
+		return invalid("PDF is truncated, the end of file marker is missing")
+	}
+	if m := pdfActiveContent.Find(data); m != nil {
+		return invalid("PDF contains active content (%s)", bytes.TrimRight(m[1:], " \t\r\n/<>[]()"))
+	}
+	return nil
+}
+
+// storePDF validates a PDF and stores it unchanged as the only variant.
+func (s *mediaService) storePDF(req uploadRequest) (*uploadResult, error) {
+	if err := validatePDF(req.Data); err != nil {
+		fmt.Printf("PDF Validation Error: %v\n", err)
+		return nil, err
+	}
+
+	key := contentKey(req.Preset.Prefix, req.Data, ".pdf")
+	url, reused, err := storeContent(s.store, req.Preset.Bucket, key, req.Data, "application/pdf", req.Filename, req.Preset.Retention == 0)
+	if err != nil {
+		fmt.Printf("Storage Upload Error: %v\n", err)
+		return nil, failedUpload("Failed to store PDF: %v", err)
+	}
+
+	result := &uploadResult{
+		URL:          url,
+		OriginalName: req.Filename,
+		DetectedType: "application/pdf",
+		Purpose:      req.Purpose,
+		Format:       formatPDF,
+		Variants: []variantResult{{
+			Name:         "original",
+			Key:          key,
+			URL:          url,
+			Bytes:        len(req.Data),
+			Format:       string(formatPDF),
+			Deduplicated: reused,
+		}},
+		bucket: req.Preset.Bucket,
+	}
+	if req.Preset.Private {
+		s.signResult(result)
+	}
+	return result, nil
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"image/color"
+	"math"
+	"strings"
+	"testing"
+
+	"github.com/disintegration/imaging"
+)
+
+func TestValidatePDF(t *testing.T) {
+	const body = "%PDF-1.7\n1 0 obj << /Type /Catalog >> endobj\n"
+	tests := []struct {
+		name    string
+		data    string
+		wantErr bool
+	}{
+		{name: "plain", data: body + "%%EOF\n"},
+		{name: "marker followed by padding", data: body + "%%EOF\n" + strings.Repeat(" ", 500)},
+		{name: "names that only start the same", data: body + "/JSONData 1 /Launcher 2\n%%EOF"},
+		{name: "not a pdf", data: "<html>%%EOF", wantErr: true},
+		{name: "unknown version", data: "%PDF-3.0\n%%EOF", wantErr: true},
+		{name: "truncated", data: body, wantErr: true},
+		{name: "marker too far from the end", data: body + "%%EOF" + strings.Repeat(" ", 2000), wantErr: true},
+		{name: "javascript", data: body + "<< /S /JavaScript /JS (app.alert(1)) >>\n%%EOF", wantErr: true},
+		{name: "launch", data: body + "<</S/Launch/F(cmd.exe)>>\n%%EOF", wantErr: true},
+		{name: "embedded file", data: body + "/EmbeddedFile <<>>\n%%EOF", wantErr: true},
+	}
+	for _, tt := range tests {
+		err := validatePDF([]byte(tt.data))
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: validatePDF() error = %v, want error %v", tt.name, err, tt.wantErr)
+		}
+		if err != nil && errorCode(err) != codeInvalidPDF {
+			t.Errorf("%s: code = %q, want %q", tt.name, errorCode(err), codeInvalidPDF)
+		}
+	}
+}
+
+func TestOtsuThreshold(t *testing.T) {
+	var ink, blank, uneven [256]int
+	ink[30], ink[220] = 100, 900
+	blank[255] = 1000
+	uneven[60], uneven[70], uneven[180], uneven[200] = 50, 50, 400, 500
+
+	tests := []struct {
+		name   string
+		hist   [256]int
+		lo, hi uint8
+	}{
+		{name: "ink on paper", hist: ink, lo: 31, hi: 220},
+		{name: "spread out", hist: uneven, lo: 71, hi: 180},
+		{name: "blank page", hist: blank, lo: 1, hi: 1},
+	}
+	for _, tt := range tests {
+		if got := otsuThreshold(tt.hist); got < tt.lo || got > tt.hi {
+			t.Errorf("%s: otsuThreshold() = %d, want %d..%d", tt.name, got, tt.lo, tt.hi)
+		}
+	}
+}
+
+func TestStretchContrast(t *testing.T) {
+	faded := ramp(90, 200)
+	got := stretchContrast(faded)
+	if lo, hi := got.NRGBAAt(4, 0).R, got.NRGBAAt(251, 0).R; lo > 5 || hi < 250 {
+		t.Errorf("stretchContrast() range = %d..%d, want black to white", lo, hi)
+	}
+
+	blank := ramp(240, 250)
+	if stretchContrast(blank) != blank {
+		t.Error("stretchContrast() changed a blank page")
+	}
+}
+
+func TestEstimateSkew(t *testing.T) {
+	// Lines of "text" across a page
+	page := imaging.New(600, 400, color.White)
+	for y := 40; y < 360; y += 24 {
+		for x := 60; x < 540; x++ {
+			for dy := 0; dy < 6; dy++ {
+				page.Set(x, y+dy, color.Black)
+			}
+		}
+	}
+
+	for _, angle := range []float64{0, 3, -4.5} {
+		rotated := imaging.Rotate(page, angle, color.White)
+		if got := estimateSkew(imaging.Grayscale(rotated)); math.Abs(got-angle) > 0.2 {
+			t.Errorf("estimateSkew() of a page turned %v degrees = %v", angle, got)
+		}
+	}
+
+	if got := estimateSkew(imaging.New(100, 100, color.White)); got != 0 {
+		t.Errorf("estimateSkew() of a blank page = %v, want 0", got)
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/disintegration/imaging"
+)
+
+type outputFormat string
+
+const (
+	formatAuto outputFormat = "auto"
+	formatJPEG outputFormat = "jpeg"
+	formatPNG  outputFormat = "png"
+	formatWebP outputFormat = "webp"
+)
+
+func parseOutputFormat(s string) (outputFormat, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "", "auto":
+		return formatAuto, nil
+	case "jpg", "jpeg":
+		return formatJPEG, nil
+	case "png":
+		return formatPNG, nil
+	case "webp":
+		if !webpSupported {
+			return "", fmt.Errorf("webp output is not available, the service was built without cgo")
+		}
+		return formatWebP, nil
+	}
+	return "", fmt.Errorf("unsupported output format %q", s)
+}
+
+// defaultOutputFormat reads the MEDIA_OUTPUT_FORMAT policy used when the
+// request does not ask for a specific format.
+func defaultOutputFormat() (outputFormat, error) {
+	return parseOutputFormat(os.Getenv("MEDIA_OUTPUT_FORMAT"))
+}
+
+// resolveFormat turns "auto" into a concrete format: JPEG for opaque images,
+// PNG when the source has transparency so logos are not flattened.
+func resolveFormat(f outputFormat, img image.Image) outputFormat {
+	if f != formatAuto {
+		return f
+	}
+	if isOpaque(img) {
+		return formatJPEG
+	}
+	return formatPNG
+}
+
+func (f outputFormat) ContentType() string {
+	switch f {
+	case formatPNG:
+		return "image/png"
+	case formatWebP:
+		return "image/webp"
+	}
+	return "image/jpeg"
+}
+
+func (f outputFormat) Ext() string {
+	switch f {
+	case formatPNG:
+		return ".png"
+	case formatWebP:
+		return ".webp"
+	}
+	return ".jpg"
+}
+
+func isOpaque(img image.Image) bool {
+	if o, ok := img.(interface{ Opaque() bool }); ok {
+		return o.Opaque()
+	}
+	return false
+}
+
+func encodeImage(w io.Writer, img image.Image, f outputFormat, quality int) error {
+	switch f {
+	case formatPNG:
+		enc := png.Encoder{CompressionLevel: png.BestCompression}
+		return enc.Encode(w, img)
+	case formatWebP:
+		return encodeWebP(w, img, quality)
+	case formatJPEG:
+		return jpeg.Encode(w, flattenAlpha(img), &jpeg.Options{Quality: quality})
+	}
+	return fmt.Errorf("cannot encode format %q", f)
+}
+
+// flattenAlpha composites transparent images onto white. JPEG has no alpha
+// channel and would otherwise turn transparent areas black.
+func flattenAlpha(img image.Image) image.Image {
+	if isOpaque(img) {
+		return img
+	}
+	bg := imaging.New(img.Bounds().Dx(), img.Bounds().Dy(), color.White)
+	return imaging.Overlay(bg, img, image.Pt(0, 0), 1.0)
+}
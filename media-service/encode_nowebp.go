@@ -0,0 +1,17 @@
+//go:build !cgo
+
+package main
+
+import (
+	"errors"
+	"image"
+	"io"
+)
+
+// Without cgo there is no libwebp to encode with. WebP uploads are still
+// accepted and decoded, only WebP output is unavailable.
+const webpSupported = false
+
+func encodeWebP(w io.Writer, img image.Image, quality int) error {
+	return errors.New("webp output needs a cgo build with libwebp")
+}
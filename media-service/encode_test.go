@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"testing"
+)
+
+func TestParseOutputFormat(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    outputFormat
+		wantErr bool
+	}{
+		{in: "", want: formatAuto},
+		{in: "auto", want: formatAuto},
+		{in: "jpg", want: formatJPEG},
+		{in: " JPEG ", want: formatJPEG},
+		{in: "png", want: formatPNG},
+		{in: "WebP", want: formatWebP, wantErr: !webpSupported},
+		{in: "gif", wantErr: true},
+		{in: "avif", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseOutputFormat(tt.in)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("parseOutputFormat(%q) = %q, want error", tt.in, got)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("parseOutputFormat(%q) = %q, %v, want %q", tt.in, got, err, tt.want)
+		}
+	}
+}
+
+func TestResolveFormat(t *testing.T) {
+	opaque := image.NewYCbCr(image.Rect(0, 0, 4, 4), image.YCbCrSubsampleRatio420)
+	transparent := image.NewNRGBA(image.Rect(0, 0, 4, 4))
+
+	tests := []struct {
+		name string
+		in   outputFormat
+		img  image.Image
+		want outputFormat
+	}{
+		{name: "auto opaque", in: formatAuto, img: opaque, want: formatJPEG},
+		{name: "auto transparent", in: formatAuto, img: transparent, want: formatPNG},
+		{name: "explicit jpeg keeps alpha source", in: formatJPEG, img: transparent, want: formatJPEG},
+		{name: "explicit png", in: formatPNG, img: opaque, want: formatPNG},
+	}
+	for _, tt := range tests {
+		if got := resolveFormat(tt.in, tt.img); got != tt.want {
+			t.Errorf("%s: resolveFormat() = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestEncodeImage(t *testing.T) {
+	img := image.NewNRGBA(image.Rect(0, 0, 8, 8))
+
+	var buf bytes.Buffer
+	if err := encodeImage(&buf, img, formatJPEG, 80); err != nil {
+		t.Fatalf("encode jpeg: %v", err)
+	}
+	decoded, err := jpeg.Decode(&buf)
+	if err != nil {
+		t.Fatalf("decode jpeg: %v", err)
+	}
+	// Transparent pixels are flattened onto white, not black
+	if r, _, _, _ := decoded.At(4, 4).RGBA(); r>>8 < 250 {
+		t.Errorf("transparent pixel encoded as %v, want white", decoded.At(4, 4))
+	}
+
+	buf.Reset()
+	img.Set(1, 1, color.NRGBA{R: 255, A: 128})
+	if err := encodeImage(&buf, img, formatPNG, 0); err != nil {
+		t.Fatalf("encode png: %v", err)
+	}
+	decoded, err = png.Decode(&buf)
+	if err != nil {
+		t.Fatalf("decode png: %v", err)
+	}
+	if _, _, _, a := decoded.At(1, 1).RGBA(); a>>8 != 128 {
+		t.Errorf("png alpha = %d, want 128", a>>8)
+	}
+
+	buf.Reset()
+	err = encodeImage(&buf, img, formatWebP, 80)
+	if webpSupported && err != nil {
+		t.Errorf("encode webp: %v", err)
+	}
+	if !webpSupported && err == nil {
+		t.Error("encode webp without cgo succeeded, want error")
+	}
+
+	if err := encodeImage(&buf, img, formatAuto, 80); err == nil {
+		t.Error("encodeImage(auto) succeeded, want error")
+	}
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"math"
+
+	"github.com/disintegration/imaging"
+)
+
+const (
+	enhanceNone = "none"
+	enhanceAuto = "auto"
+)
+
+const (
+	// Share of pixels clipped at each end of the histogram by auto-levels
+	levelsClip = 0.005
+	// Limits keep the correction mild, a dark moody photo should stay one
+	levelsMaxGain  = 2.0
+	balanceMaxGain = 1.2
+	sharpenSigma   = 1.0
+	sharpenAmount  = 0.5
+)
+
+type enhanceStats struct {
+	LuminanceBefore float64 `json:"luminance_before"`
+	LuminanceAfter  float64 `json:"luminance_after"`
+}
+
+// loadEnhancePurposes reads MEDIA_ENHANCE_PURPOSES, the purposes enhanced
+// when the request does not say. Receipts and shipping labels are
+// documents and are left alone by default.
+func loadEnhancePurposes() (map[string]bool, error) {
+	return envPurposes("MEDIA_ENHANCE_PURPOSES", purposeProduct+","+purposeAvatar)
+}
+
+// autoEnhance applies auto-levels, gray-world white balance and a mild
+// unsharp mask, in that order, and reports the mean luminance before and
+// after.
+func autoEnhance(img image.Image) (*image.NRGBA, enhanceStats) {
+	dst := imaging.Clone(img)
+	stats := enhanceStats{LuminanceBefore: meanLuminance(dst)}
+
+	dst = autoLevels(dst)
+	dst = grayWorld(dst)
+	dst = unsharpMask(dst, sharpenSigma, sharpenAmount)
+
+	stats.LuminanceAfter = meanLuminance(dst)
+	return dst, stats
+}
+
+// autoLevels stretches the luminance histogram so the darkest and
+// brightest pixels, ignoring outliers, reach black and white. The same
+// mapping is applied to every channel so hues are kept.
+func autoLevels(img *image.NRGBA) *image.NRGBA {
+	var hist [256]int
+	total := 0
+	forEachOpaque(img, func(p []uint8) {
+		hist[luma8(p)]++
+		total++
+	})
+	if total == 0 {
+		return img
+	}
+
+	clip := int(float64(total) * levelsClip)
+	low, high := 0, 255
+	for seen := 0; low < 255; low++ {
+		if seen += hist[low]; seen > clip {
+			break
+		}
+	}
+	for seen := 0; high > 0; high-- {
+		if seen += hist[high]; seen > clip {
+			break
+		}
+	}
+	if high <= low {
+		return img
+	}
+
+	gain := math.Min(255/float64(high-low), levelsMaxGain)
+	if gain <= 1 {
+		return img
+	}
+	// When the gain is capped the input window is wider than the content,
+	// the extra room is split in proportion to the slack on either side
+	offset := float64(low)
+	if extra := 255/gain - float64(high-low); extra > 0 {
+		offset -= extra * float64(low) / float64(low+255-high)
+	}
+	return imaging.AdjustFunc(img, func(c color.NRGBA) color.NRGBA {
+		return color.NRGBA{
+			R: clamp8((float64(c.R) - offset) * gain),
+			G: clamp8((float64(c.G) - offset) * gain),
+			B: clamp8((float64(c.B) - offset) * gain),
+			A: c.A,
+		}
+	})
+}
+
+// grayWorld assumes the scene averages to grey and scales each channel
+// towards that, which removes the yellow cast of indoor lighting.
+func grayWorld(img *image.NRGBA) *image.NRGBA {
+	var r, g, b float64
+	n := 0
+	forEachOpaque(img, func(p []uint8) {
+		r += float64(p[0])
+		g += float64(p[1])
+		b += float64(p[2])
+		n++
+	})
+	if n == 0 || r == 0 || g == 0 || b == 0 {
+		return img
+	}
+
+	gray := (r + g + b) / 3
+	gainR := clampGain(gray / r)
+	gainG := clampGain(gray / g)
+	gainB := clampGain(gray / b)
+	return imaging.AdjustFunc(img, func(c color.NRGBA) color.NRGBA {
+		return color.NRGBA{
+			R: clamp8(float64(c.R) * gainR),
+			G: clamp8(float64(c.G) * gainG),
+			B: clamp8(float64(c.B) * gainB),
+			A: c.A,
+		}
+	})
+}
+
+// unsharpMask adds back amount times the difference between the image and
+// a blurred copy of it.
+func unsharpMask(img *image.NRGBA, sigma, amount float64) *image.NRGBA {
+	blurred := imaging.Blur(img, sigma)
+	dst := imaging.Clone(img)
+	for i := 0; i < len(dst.Pix); i += 4 {
+		for c := 0; c < 3; c++ {
+			v := float64(img.Pix[i+c])
+			dst.Pix[i+c] = clamp8(v + amount*(v-float64(blurred.Pix[i+c])))
+		}
+	}
+	return dst
+}
+
+func meanLuminance(img *image.NRGBA) float64 {
+	var sum float64
+	n := 0
+	forEachOpaque(img, func(p []uint8) {
+		sum += 0.299*float64(p[0]) + 0.587*float64(p[1]) + 0.114*float64(p[2])
+		n++
+	})
+	if n == 0 {
+		return 0
+	}
+	return math.Round(sum/float64(n)*100) / 100
+}
+
+// forEachOpaque calls fn with the RGBA bytes of every mostly opaque pixel,
+// transparent areas should not skew the statistics.
+func forEachOpaque(img *image.NRGBA, fn func(p []uint8)) {
+	b := img.Bounds()
+	for y := 0; y < b.Dy(); y++ {
+		row := img.Pix[y*img.Stride : y*img.Stride+b.Dx()*4]
+		for x := 0; x < len(row); x += 4 {
+			if row[x+3] >= 128 {
+				fn(row[x : x+4])
+			}
+		}
+	}
+}
+
+func luma8(p []uint8) uint8 {
+	return uint8((299*int(p[0]) + 587*int(p[1]) + 114*int(p[2])) / 1000)
+}
+
+func clampGain(g float64) float64 {
+	return math.Min(math.Max(g, 1/balanceMaxGain), balanceMaxGain)
+}
+
+func clamp8(v float64) uint8 {
+	return uint8(math.Min(math.Max(math.Round(v), 0), 255))
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"testing"
+
+	"github.com/disintegration/imaging"
+)
+
+// ramp is a horizontal grey ramp from lo to hi.
+func ramp(lo, hi int) *image.NRGBA {
+	img := imaging.New(256, 4, color.Black)
+	for x := 0; x < 256; x++ {
+		v := uint8(lo + (hi-lo)*x/255)
+		for y := 0; y < 4; y++ {
+			img.SetNRGBA(x, y, color.NRGBA{v, v, v, 255})
+		}
+	}
+	return img
+}
+
+func TestAutoLevels(t *testing.T) {
+	tests := []struct {
+		name          string
+		lo, hi        int
+		wantLo        uint8
+		wantHi        uint8
+		wantUnchanged bool
+	}{
+		{name: "flat is left alone", lo: 128, hi: 128, wantUnchanged: true},
+		{name: "mild stretch", lo: 50, hi: 200, wantLo: 0, wantHi: 255},
+		// 100..140 would need a gain of 6. Capped at 2, the spare room is
+		// split by the slack on either side: 100 below, 115 above
+		{name: "gain capped", lo: 100, hi: 140, wantLo: 81, wantHi: 159},
+	}
+	for _, tt := range tests {
+		src := ramp(tt.lo, tt.hi)
+		got := autoLevels(src)
+		if tt.wantUnchanged {
+			if got != src {
+				t.Errorf("%s: autoLevels() changed the image", tt.name)
+			}
+			continue
+		}
+		lo, hi := got.NRGBAAt(1, 0).R, got.NRGBAAt(254, 0).R
+		if absDiff(lo, tt.wantLo) > 3 || absDiff(hi, tt.wantHi) > 3 {
+			t.Errorf("%s: autoLevels() range = %d..%d, want about %d..%d", tt.name, lo, hi, tt.wantLo, tt.wantHi)
+		}
+	}
+}
+
+func TestGrayWorld(t *testing.T) {
+	// A yellow cast: too much red and green, not enough blue
+	warm := imaging.New(8, 8, color.NRGBA{140, 130, 100, 255})
+	got := grayWorld(warm).NRGBAAt(0, 0)
+	if !(got.R < 140 && got.B > 100) {
+		t.Errorf("grayWorld() = %v, want the cast reduced", got)
+	}
+	if absDiff(got.R, got.G) > 10 || absDiff(got.G, got.B) > 10 {
+		t.Errorf("grayWorld() = %v, want close to grey", got)
+	}
+
+	// Gains are capped, a pure colour stays saturated
+	red := imaging.New(8, 8, color.NRGBA{200, 0, 0, 255})
+	if got := grayWorld(red).NRGBAAt(0, 0); got != (color.NRGBA{200, 0, 0, 255}) {
+		t.Errorf("grayWorld(red) = %v, want unchanged", got)
+	}
+}
+
+func TestMeanLuminance(t *testing.T) {
+	img := imaging.New(2, 1, color.NRGBA{255, 255, 255, 255})
+	if got := meanLuminance(img); got != 255 {
+		t.Errorf("meanLuminance(white) = %v, want 255", got)
+	}
+	// Transparent pixels do not count
+	img.SetNRGBA(1, 0, color.NRGBA{0, 0, 0, 0})
+	if got := meanLuminance(img); got != 255 {
+		t.Errorf("meanLuminance() with a transparent pixel = %v, want 255", got)
+	}
+	if got := meanLuminance(imaging.New(2, 2, color.NRGBA{})); got != 0 {
+		t.Errorf("meanLuminance(transparent) = %v, want 0", got)
+	}
+}
+
+func TestAutoEnhance(t *testing.T) {
+	dull := ramp(60, 180)
+	out, stats := autoEnhance(dull)
+	if out.Bounds() != dull.Bounds() {
+		t.Fatalf("autoEnhance() bounds = %v", out.Bounds())
+	}
+	if stats.LuminanceBefore != meanLuminance(dull) || stats.LuminanceAfter != meanLuminance(out) {
+		t.Errorf("autoEnhance() stats = %+v", stats)
+	}
+	if out.NRGBAAt(0, 0).R >= dull.NRGBAAt(0, 0).R || out.NRGBAAt(255, 0).R <= dull.NRGBAAt(255, 0).R {
+		t.Error("autoEnhance() did not stretch the contrast")
+	}
+}
+
+func TestClamp8(t *testing.T) {
+	tests := []struct {
+		in   float64
+		want uint8
+	}{
+		{-5, 0}, {0.4, 0}, {0.5, 1}, {254.6, 255}, {300, 255},
+	}
+	for _, tt := range tests {
+		if got := clamp8(tt.in); got != tt.want {
+			t.Errorf("clamp8(%v) = %d, want %d", tt.in, got, tt.want)
+		}
+	}
+}
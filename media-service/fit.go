@@ -0,0 +1,244 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/disintegration/imaging"
+)
+
+const (
+	fitInside  = "inside"
+	fitContain = "contain"
+	fitCover   = "cover"
+	fitFill    = "fill"
+
+	gravityCenter = "center"
+	gravitySmart  = "smart"
+	gravityFocal  = "focal"
+)
+
+// fitOptions describes how an image is scaled into a Width x Height box.
+// A zero dimension keeps the aspect ratio.
+type fitOptions struct {
+	Width      int
+	Height     int
+	Fit        string
+	Gravity    string
+	FocalX     float64
+	FocalY     float64
+	Background color.NRGBA
+}
+
+func validFit(fit string) bool {
+	switch fit {
+	case fitInside, fitContain, fitCover, fitFill:
+		return true
+	}
+	return false
+}
+
+func validGravity(gravity string) bool {
+	switch gravity {
+	case gravityCenter, gravitySmart, gravityFocal:
+		return true
+	}
+	return false
+}
+
+// parseFocalPoint reads "x,y" with both coordinates relative to the image
+// size, so 0.5,0.5 is the centre.
+func parseFocalPoint(s string) (float64, float64, error) {
+	xs, ys, ok := strings.Cut(s, ",")
+	if !ok {
+		return 0, 0, fmt.Errorf("focal point must be x,y")
+	}
+	x, errX := strconv.ParseFloat(strings.TrimSpace(xs), 64)
+	y, errY := strconv.ParseFloat(strings.TrimSpace(ys), 64)
+	if errX != nil || errY != nil || x < 0 || x > 1 || y < 0 || y > 1 {
+		return 0, 0, fmt.Errorf("focal point coordinates must be between 0 and 1")
+	}
+	return x, y, nil
+}
+
+// parseHexColor accepts rrggbb or rrggbbaa with an optional leading #.
+func parseHexColor(s string) (color.NRGBA, error) {
+	s = strings.TrimPrefix(s, "#")
+	if len(s) != 6 && len(s) != 8 {
+		return color.NRGBA{}, fmt.Errorf("colour must be rrggbb or rrggbbaa")
+	}
+	v, err := strconv.ParseUint(s, 16, 32)
+	if err != nil {
+		return color.NRGBA{}, fmt.Errorf("colour must be rrggbb or rrggbbaa")
+	}
+	if len(s) == 6 {
+		v = v<<8 | 0xff
+	}
+	return color.NRGBA{R: uint8(v >> 24), G: uint8(v >> 16), B: uint8(v >> 8), A: uint8(v)}, nil
+}
+
+// applyFit scales img according to opts:
+//   - inside scales down to fit the box and never upscales
+//   - contain does the same, then pads to the exact box with Background
+//   - cover fills the box and crops the overflow according to Gravity
+//   - fill stretches to the exact size
+func applyFit(img image.Image, opts fitOptions) image.Image {
+	w, h := opts.Width, opts.Height
+	if w == 0 && h == 0 {
+		return img
+	}
+
+	switch opts.Fit {
+	case fitFill:
+		return imaging.Resize(img, w, h, imaging.Lanczos)
+	case fitCover:
+		if w == 0 || h == 0 {
+			return imaging.Resize(img, w, h, imaging.Lanczos)
+		}
+		crop := coverCrop(img, w, h, opts)
+		return imaging.Resize(imaging.Crop(img, crop), w, h, imaging.Lanczos)
+	case fitContain:
+		if w == 0 || h == 0 {
+			return shrinkInside(img, w, h)
+		}
+		scaled := shrinkInside(img, w, h)
+		canvas := imaging.New(w, h, opts.Background)
+		return imaging.PasteCenter(canvas, scaled)
+	}
+	return shrinkInside(img, w, h)
+}
+
+func shrinkInside(img image.Image, w, h int) image.Image {
+	b := img.Bounds()
+	if (w == 0 || b.Dx() <= w) && (h == 0 || b.Dy() <= h) {
+		return img
+	}
+	if w == 0 || h == 0 {
+		return imaging.Resize(img, w, h, imaging.Lanczos)
+	}
+	return imaging.Fit(img, w, h, imaging.Lanczos)
+}
+
+// coverCrop returns the largest rectangle with the w:h aspect ratio that
+// fits in img, positioned according to the gravity.
+func coverCrop(img image.Image, w, h int, opts fitOptions) image.Rectangle {
+	b := img.Bounds()
+	cropW, cropH := b.Dx(), b.Dy()
+	if float64(cropW)/float64(cropH) > float64(w)/float64(h) {
+		cropW = int(math.Round(float64(cropH) * float64(w) / float64(h)))
+	} else {
+		cropH = int(math.Round(float64(cropW) * float64(h) / float64(w)))
+	}
+	cropW, cropH = max(cropW, 1), max(cropH, 1)
+
+	var x, y int
+	switch opts.Gravity {
+	case gravityFocal:
+		x = int(math.Round(opts.FocalX*float64(b.Dx()) - float64(cropW)/2))
+		y = int(math.Round(opts.FocalY*float64(b.Dy()) - float64(cropH)/2))
+	case gravitySmart:
+		x, y = smartCropOffset(img, cropW, cropH)
+	default:
+		x, y = (b.Dx()-cropW)/2, (b.Dy()-cropH)/2
+	}
+
+	x = min(max(x, 0), b.Dx()-cropW)
+	y = min(max(y, 0), b.Dy()-cropH)
+	return image.Rect(b.Min.X+x, b.Min.Y+y, b.Min.X+x+cropW, b.Min.Y+y+cropH)
+}
+
+// smartCropOffset slides the crop window along the axis with spare room
+// and returns the position that keeps the most "interesting" pixels. The
+// interest map is edge strength plus saturation, computed on a downscaled
+// copy, which tends to favour the product over a plain background. A small
+// penalty towards the edges breaks ties in favour of the centre.
+func smartCropOffset(img image.Image, cropW, cropH int) (int, int) {
+	b := img.Bounds()
+	if cropW == b.Dx() && cropH == b.Dy() {
+		return 0, 0
+	}
+
+	const analysisSize = 256
+	scale := 1.0
+	if longest := max(b.Dx(), b.Dy()); longest > analysisSize {
+		scale = float64(analysisSize) / float64(longest)
+	}
+	aw := max(int(math.Round(float64(b.Dx())*scale)), 1)
+	ah := max(int(math.Round(float64(b.Dy())*scale)), 1)
+	small := imaging.Resize(img, aw, ah, imaging.Box)
+
+	energy := interestMap(small)
+
+	horizontal := cropW < b.Dx()
+	length, window := ah, int(math.Round(float64(cropH)*scale))
+	if horizontal {
+		length, window = aw, int(math.Round(float64(cropW)*scale))
+	}
+	window = min(max(window, 1), length)
+
+	// Sum energy per column (or row) then slide the window with prefix sums
+	profile := make([]float64, length+1)
+	for y := 0; y < ah; y++ {
+		for x := 0; x < aw; x++ {
+			i := y
+			if horizontal {
+				i = x
+			}
+			profile[i+1] += energy[y*aw+x]
+		}
+	}
+	for i := 1; i <= length; i++ {
+		profile[i] += profile[i-1]
+	}
+
+	best, bestScore := 0, math.Inf(-1)
+	centre := float64(length-window) / 2
+	for start := 0; start+window <= length; start++ {
+		score := profile[start+window] - profile[start]
+		if centre > 0 {
+			score *= 1 - 0.1*math.Abs(float64(start)-centre)/centre
+		}
+		if score > bestScore {
+			best, bestScore = start, score
+		}
+	}
+
+	offset := int(math.Round(float64(best) / scale))
+	if horizontal {
+		return offset, 0
+	}
+	return 0, offset
+}
+
+func interestMap(img *image.NRGBA) []float64 {
+	w, h := img.Bounds().Dx(), img.Bounds().Dy()
+	luma := make([]float64, w*h)
+	energy := make([]float64, w*h)
+
+	for y := 0; y < h; y++ {
+		row := img.Pix[y*img.Stride:]
+		for x := 0; x < w; x++ {
+			r, g, b := float64(row[x*4]), float64(row[x*4+1]), float64(row[x*4+2])
+			luma[y*w+x] = 0.299*r + 0.587*g + 0.114*b
+			maxC := math.Max(r, math.Max(g, b))
+			minC := math.Min(r, math.Min(g, b))
+			if maxC > 0 {
+				energy[y*w+x] = 64 * (maxC - minC) / maxC
+			}
+		}
+	}
+
+	for y := 1; y < h-1; y++ {
+		for x := 1; x < w-1; x++ {
+			i := y*w + x
+			gx := luma[i+1] - luma[i-1]
+			gy := luma[i+w] - luma[i-w]
+			energy[i] += math.Sqrt(gx*gx + gy*gy)
+		}
+	}
+	return energy
+}
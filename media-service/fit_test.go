@@ -0,0 +1,148 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"testing"
+
+	"github.com/disintegration/imaging"
+)
+
+func TestParseFocalPoint(t *testing.T) {
+	tests := []struct {
+		in      string
+		x, y    float64
+		wantErr bool
+	}{
+		{in: "0.5,0.5", x: 0.5, y: 0.5},
+		{in: "0, 1", x: 0, y: 1},
+		{in: " 0.25 ,0.75", x: 0.25, y: 0.75},
+		{in: "0.5", wantErr: true},
+		{in: "0.5;0.5", wantErr: true},
+		{in: "-0.1,0.5", wantErr: true},
+		{in: "0.5,1.01", wantErr: true},
+		{in: "left,top", wantErr: true},
+		{in: "0.5,0.5,0.5", wantErr: true},
+	}
+	for _, tt := range tests {
+		x, y, err := parseFocalPoint(tt.in)
+		if (err != nil) != tt.wantErr || x != tt.x || y != tt.y {
+			t.Errorf("parseFocalPoint(%q) = %v, %v, %v, want %v, %v (error %v)", tt.in, x, y, err, tt.x, tt.y, tt.wantErr)
+		}
+	}
+}
+
+func TestParseHexColor(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    color.NRGBA
+		wantErr bool
+	}{
+		{in: "ffffff", want: color.NRGBA{255, 255, 255, 255}},
+		{in: "#102030", want: color.NRGBA{0x10, 0x20, 0x30, 255}},
+		{in: "10203040", want: color.NRGBA{0x10, 0x20, 0x30, 0x40}},
+		{in: "#AbCdEf", want: color.NRGBA{0xab, 0xcd, 0xef, 255}},
+		{in: "fff", wantErr: true},
+		{in: "##ffffff", wantErr: true},
+		{in: "gggggg", wantErr: true},
+		{in: "+fffff", wantErr: true},
+		{in: "", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseHexColor(tt.in)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("parseHexColor(%q) = %v, %v, want %v (error %v)", tt.in, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestCoverCrop(t *testing.T) {
+	plain := imaging.New(400, 200, color.NRGBA{255, 255, 255, 255})
+	offset := image.NewNRGBA(image.Rect(10, 20, 410, 220))
+
+	// Detail near the right edge for smart gravity to find
+	detailed := imaging.New(400, 200, color.NRGBA{255, 255, 255, 255})
+	for x := 300; x < 380; x++ {
+		for y := 50; y < 150; y++ {
+			if (x+y)%2 == 0 {
+				detailed.Set(x, y, color.NRGBA{200, 0, 0, 255})
+			}
+		}
+	}
+
+	tests := []struct {
+		name string
+		img  image.Image
+		w, h int
+		opts fitOptions
+		want image.Rectangle
+	}{
+		{name: "wide to square centred", img: plain, w: 100, h: 100, opts: fitOptions{Gravity: gravityCenter}, want: image.Rect(100, 0, 300, 200)},
+		{name: "wide to wider", img: plain, w: 400, h: 100, opts: fitOptions{Gravity: gravityCenter}, want: image.Rect(0, 50, 400, 150)},
+		{name: "same ratio", img: plain, w: 40, h: 20, opts: fitOptions{Gravity: gravitySmart}, want: image.Rect(0, 0, 400, 200)},
+		{name: "focal point", img: plain, w: 1, h: 1, opts: fitOptions{Gravity: gravityFocal, FocalX: 0.4, FocalY: 0.5}, want: image.Rect(60, 0, 260, 200)},
+		{name: "focal clamped left", img: plain, w: 1, h: 1, opts: fitOptions{Gravity: gravityFocal, FocalX: 0}, want: image.Rect(0, 0, 200, 200)},
+		{name: "focal clamped right", img: plain, w: 1, h: 1, opts: fitOptions{Gravity: gravityFocal, FocalX: 1}, want: image.Rect(200, 0, 400, 200)},
+		{name: "keeps bounds offset", img: offset, w: 1, h: 1, opts: fitOptions{Gravity: gravityCenter}, want: image.Rect(110, 20, 310, 220)},
+	}
+	for _, tt := range tests {
+		if got := coverCrop(tt.img, tt.w, tt.h, tt.opts); got != tt.want {
+			t.Errorf("%s: coverCrop() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+
+	detail := image.Rect(300, 50, 380, 150)
+	if got := coverCrop(detailed, 1, 1, fitOptions{Gravity: gravitySmart}); !detail.In(got) || got.Dx() != 200 {
+		t.Errorf("smart coverCrop() = %v, want a 200px square around %v", got, detail)
+	}
+}
+
+func TestApplyFit(t *testing.T) {
+	src := imaging.New(400, 200, color.NRGBA{0, 0, 255, 255})
+	red := color.NRGBA{255, 0, 0, 255}
+
+	tests := []struct {
+		name string
+		opts fitOptions
+		want image.Point
+	}{
+		{name: "no box", opts: fitOptions{Fit: fitCover}, want: image.Pt(400, 200)},
+		{name: "inside width only", opts: fitOptions{Width: 100, Fit: fitInside}, want: image.Pt(100, 50)},
+		{name: "inside never upscales", opts: fitOptions{Width: 800, Height: 800, Fit: fitInside}, want: image.Pt(400, 200)},
+		{name: "inside box", opts: fitOptions{Width: 100, Height: 100, Fit: fitInside}, want: image.Pt(100, 50)},
+		{name: "contain pads", opts: fitOptions{Width: 100, Height: 100, Fit: fitContain, Background: red}, want: image.Pt(100, 100)},
+		{name: "contain height only", opts: fitOptions{Height: 50, Fit: fitContain}, want: image.Pt(100, 50)},
+		{name: "cover", opts: fitOptions{Width: 100, Height: 100, Fit: fitCover, Gravity: gravityCenter}, want: image.Pt(100, 100)},
+		{name: "cover one side", opts: fitOptions{Width: 800, Fit: fitCover}, want: image.Pt(800, 400)},
+		{name: "fill stretches", opts: fitOptions{Width: 50, Height: 300, Fit: fitFill}, want: image.Pt(50, 300)},
+	}
+	for _, tt := range tests {
+		got := applyFit(src, tt.opts)
+		if size := got.Bounds().Size(); size != tt.want {
+			t.Errorf("%s: applyFit() size = %v, want %v", tt.name, size, tt.want)
+		}
+	}
+
+	padded := applyFit(src, fitOptions{Width: 100, Height: 100, Fit: fitContain, Background: red})
+	if got := color.NRGBAModel.Convert(padded.At(50, 2)); got != red {
+		t.Errorf("contain padding = %v, want %v", got, red)
+	}
+}
+
+func TestValidFitAndGravity(t *testing.T) {
+	for _, fit := range []string{fitInside, fitContain, fitCover, fitFill} {
+		if !validFit(fit) {
+			t.Errorf("validFit(%q) = false", fit)
+		}
+	}
+	for _, gravity := range []string{gravityCenter, gravitySmart, gravityFocal} {
+		if !validGravity(gravity) {
+			t.Errorf("validGravity(%q) = false", gravity)
+		}
+	}
+	for _, bad := range []string{"", "Cover", "stretch", "north"} {
+		if validFit(bad) || validGravity(bad) {
+			t.Errorf("%q accepted as a fit or gravity", bad)
+		}
+	}
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"math"
+	"math/bits"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/disintegration/imaging"
+)
+
+const (
+	codeImageTooSmall      = "IMAGE_TOO_SMALL"
+	codeImageBlurry        = "IMAGE_BLURRY"
+	codeImageUnderexposed  = "IMAGE_UNDEREXPOSED"
+	codeImageOverexposed   = "IMAGE_OVEREXPOSED"
+	codeImageDuplicateShot = "IMAGE_DUPLICATE_FRAME"
+
+	gateModeReject = "reject"
+	gateModeWarn   = "warn"
+)
+
+// Listing photos are checked by default, the other purposes are not. The
+// default only warns: clean shots on white can trip the exposure check, so
+// rejecting is up to the operator.
+const defaultProductGate = "min_side=320,blur=15,exposure=0.95,duplicate=4,mode=warn"
+
+const (
+	// The blur score is measured at a fixed size so it does not depend on
+	// the upload resolution
+	blurAnalysisSize = 512
+	darkLevel        = 16
+	brightLevel      = 240
+)
+
+// qualityGate holds the checks for one purpose. Zero values disable a
+// check.
+type qualityGate struct {
+	MinSide int
+	// MinBlur is the lowest accepted variance of the Laplacian
+	MinBlur float64
+	// MaxExposure is the largest share of pixels that may be crushed to
+	// black, or blown out to white
+	MaxExposure float64
+	// Duplicate is the dHash distance at or below which two photos in the
+	// same batch count as the same shot
+	Duplicate int
+	Mode      string
+}
+
+type qualityIssue struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+type qualityScores struct {
+	ShortSide   int     `json:"short_side"`
+	Blur        float64 `json:"blur"`
+	DarkRatio   float64 `json:"dark_ratio"`
+	BrightRatio float64 `json:"bright_ratio"`
+}
+
+type qualityReport struct {
+	Passed bool           `json:"passed"`
+	Issues []qualityIssue `json:"issues,omitempty"`
+	Scores qualityScores  `json:"scores"`
+}
+
+// loadQualityGates reads MEDIA_QUALITY_GATE_<PURPOSE> for every purpose as
+// key=value pairs, e.g. "min_side=600,blur=40,exposure=0.9,duplicate=4,mode=warn",
+// or "off".
+func loadQualityGates() (map[string]*qualityGate, error) {
+	gates := make(map[string]*qualityGate)
+	for _, purpose := range builtinPurposes {
+		name := "MEDIA_QUALITY_GATE_" + strings.ToUpper(purpose)
+		spec := os.Getenv(name)
+		if spec == "" && purpose == purposeProduct {
+			spec = defaultProductGate
+		}
+		if spec == "" || spec == "off" {
+			continue
+		}
+		gate, err := parseQualityGate(spec)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		gates[purpose] = gate
+	}
+	return gates, nil
+}
+
+func parseQualityGate(spec string) (*qualityGate, error) {
+	gate := &qualityGate{Mode: gateModeReject}
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		key, value, ok := strings.Cut(entry, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid entry %q, expected key=value", entry)
+		}
+
+		var err error
+		switch key {
+		case "min_side":
+			gate.MinSide, err = strconv.Atoi(value)
+			if err == nil && gate.MinSide < 0 {
+				err = fmt.Errorf("must not be negative")
+			}
+		case "blur":
+			gate.MinBlur, err = strconv.ParseFloat(value, 64)
+			if err == nil && !(gate.MinBlur >= 0) {
+				err = fmt.Errorf("must not be negative")
+			}
+		case "exposure":
+			gate.MaxExposure, err = strconv.ParseFloat(value, 64)
+			if err == nil && (gate.MaxExposure <= 0 || gate.MaxExposure > 1) {
+				err = fmt.Errorf("must be between 0 and 1")
+			}
+		case "duplicate":
+			gate.Duplicate, err = strconv.Atoi(value)
+			if err == nil && (gate.Duplicate < 0 || gate.Duplicate > 64) {
+				err = fmt.Errorf("must be between 0 and 64")
+			}
+		case "mode":
+			if value != gateModeReject && value != gateModeWarn {
+				err = fmt.Errorf("must be %s or %s", gateModeReject, gateModeWarn)
+			}
+			gate.Mode = value
+		default:
+			return nil, fmt.Errorf("unknown check %q", key)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %v", key, err)
+		}
+	}
+	return gate, nil
+}
+
+// evaluate scores img and lists every check it fails.
+func (g *qualityGate) evaluate(img image.Image) *qualityReport {
+	b := img.Bounds()
+	report := &qualityReport{Scores: qualityScores{ShortSide: min(b.Dx(), b.Dy())}}
+
+	small := imaging.Grayscale(imaging.Fit(img, blurAnalysisSize, blurAnalysisSize, imaging.Box))
+	report.Scores.Blur = laplacianVariance(small)
+	report.Scores.DarkRatio, report.Scores.BrightRatio = exposureRatios(small)
+
+	if g.MinSide > 0 && report.Scores.ShortSide < g.MinSide {
+		report.Issues = append(report.Issues, qualityIssue{
+			Code:    codeImageTooSmall,
+			Message: fmt.Sprintf("The shorter side is %d pixels, at least %d are needed", report.Scores.ShortSide, g.MinSide),
+		})
+	}
+	beforeExposure := len(report.Issues)
+	if g.MaxExposure > 0 {
+		if report.Scores.DarkRatio > g.MaxExposure {
+			report.Issues = append(report.Issues, qualityIssue{
+				Code:    codeImageUnderexposed,
+				Message: "The photo is almost completely dark",
+			})
+		}
+		if report.Scores.BrightRatio > g.MaxExposure {
+			report.Issues = append(report.Issues, qualityIssue{
+				Code:    codeImageOverexposed,
+				Message: "The photo is almost completely white",
+			})
+		}
+	}
+	// A black or white frame has no detail to be sharp, so it is only
+	// reported for its exposure
+	if g.MinBlur > 0 && len(report.Issues) == beforeExposure && report.Scores.Blur < g.MinBlur {
+		report.Issues = append(report.Issues, qualityIssue{
+			Code:    codeImageBlurry,
+			Message: "The photo looks out of focus",
+		})
+	}
+	report.Passed = len(report.Issues) == 0
+	return report
+}
+
+// rejects reports whether the issues found should fail the upload rather
+// than be returned as warnings.
+func (g *qualityGate) rejects(report *qualityReport) bool {
+	return g.Mode == gateModeReject && !report.Passed
+}
+
+// sameShot reports whether two frame hashes are close enough to be the
+// same photo taken twice.
+func (g *qualityGate) sameShot(a, b uint64) bool {
+	return bits.OnesCount64(a^b) <= g.Duplicate
+}
+
+func qualityRejection(issues []qualityIssue) error {
+	messages := make([]string, len(issues))
+	for i, issue := range issues {
+		messages[i] = issue.Message
+	}
+	return &uploadError{
+		Status:  http.StatusUnprocessableEntity,
+		Code:    issues[0].Code,
+		Message: strings.Join(messages, "; "),
+	}
+}
+
+// laplacianVariance is the variance of the 4-neighbour Laplacian of a
+// grayscale image. Sharp photos have strong local contrast and score high.
+func laplacianVariance(img *image.NRGBA) float64 {
+	w, h := img.Bounds().Dx(), img.Bounds().Dy()
+	if w < 3 || h < 3 {
+		return 0
+	}
+	at := func(x, y int) float64 { return float64(img.Pix[y*img.Stride+x*4]) }
+
+	var sum, sumSq float64
+	n := 0
+	for y := 1; y < h-1; y++ {
+		for x := 1; x < w-1; x++ {
+			l := at(x-1, y) + at(x+1, y) + at(x, y-1) + at(x, y+1) - 4*at(x, y)
+			sum += l
+			sumSq += l * l
+			n++
+		}
+	}
+	mean := sum / float64(n)
+	return math.Round((sumSq/float64(n)-mean*mean)*100) / 100
+}
+
+func exposureRatios(gray *image.NRGBA) (dark, bright float64) {
+	var nDark, nBright, n int
+	forEachOpaque(gray, func(p []uint8) {
+		switch {
+		case p[0] <= darkLevel:
+			nDark++
+		case p[0] >= brightLevel:
+			nBright++
+		}
+		n++
+	})
+	if n == 0 {
+		return 0, 0
+	}
+	round := func(v float64) float64 { return math.Round(v*1000) / 1000 }
+	return round(float64(nDark) / float64(n)), round(float64(nBright) / float64(n))
+}
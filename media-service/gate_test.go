@@ -0,0 +1,141 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"strings"
+	"testing"
+
+	"github.com/disintegration/imaging"
+)
+
+func TestParseQualityGate(t *testing.T) {
+	tests := []struct {
+		spec    string
+		want    qualityGate
+		wantErr bool
+	}{
+		{spec: defaultProductGate, want: qualityGate{MinSide: 320, MinBlur: 15, MaxExposure: 0.95, Duplicate: 4, Mode: gateModeWarn}},
+		{spec: "mode=warn", want: qualityGate{Mode: gateModeWarn}},
+		{spec: " min_side=600 ,, blur=40.5", want: qualityGate{MinSide: 600, MinBlur: 40.5, Mode: gateModeReject}},
+		{spec: "duplicate=0,exposure=1", want: qualityGate{MaxExposure: 1, Mode: gateModeReject}},
+		{spec: "", want: qualityGate{Mode: gateModeReject}},
+		{spec: "min_side", wantErr: true},
+		{spec: "min_side=big", wantErr: true},
+		{spec: "min_side=-1", wantErr: true},
+		{spec: "blur=-2", wantErr: true},
+		{spec: "blur=NaN", wantErr: true},
+		{spec: "exposure=0", wantErr: true},
+		{spec: "exposure=1.5", wantErr: true},
+		{spec: "duplicate=-1", wantErr: true},
+		{spec: "duplicate=65", wantErr: true},
+		{spec: "mode=strict", wantErr: true},
+		{spec: "sharpness=10", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseQualityGate(tt.spec)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("parseQualityGate(%q) = %+v, want error", tt.spec, got)
+			}
+			continue
+		}
+		if err != nil || *got != tt.want {
+			t.Errorf("parseQualityGate(%q) = %+v, %v, want %+v", tt.spec, got, err, tt.want)
+		}
+	}
+}
+
+func TestLoadQualityGates(t *testing.T) {
+	for _, purpose := range builtinPurposes {
+		t.Setenv("MEDIA_QUALITY_GATE_"+strings.ToUpper(purpose), "")
+	}
+	gates, err := loadQualityGates()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(gates) != 1 || gates[purposeProduct] == nil || gates[purposeProduct].Mode != gateModeWarn {
+		t.Errorf("default gates = %v, want only product, in warn mode", gates)
+	}
+
+	t.Setenv("MEDIA_QUALITY_GATE_PRODUCT", "off")
+	t.Setenv("MEDIA_QUALITY_GATE_RECEIPT", "blur=5,mode=warn")
+	gates, err = loadQualityGates()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gates[purposeProduct] != nil || gates[purposeReceipt] == nil || gates[purposeReceipt].Mode != gateModeWarn {
+		t.Errorf("configured gates = %v", gates)
+	}
+
+	t.Setenv("MEDIA_QUALITY_GATE_AVATAR", "min_side=x")
+	if _, err := loadQualityGates(); err == nil {
+		t.Error("loadQualityGates() accepted an invalid gate")
+	}
+}
+
+func TestQualityGateEvaluate(t *testing.T) {
+	// A checkerboard is as sharp as it gets
+	sharp := imaging.New(400, 400, color.White)
+	for x := 0; x < 400; x++ {
+		for y := 0; y < 400; y++ {
+			if (x/4+y/4)%2 == 0 {
+				sharp.Set(x, y, color.NRGBA{60, 60, 60, 255})
+			}
+		}
+	}
+	gate := &qualityGate{MinSide: 320, MinBlur: 15, MaxExposure: 0.95, Mode: gateModeReject}
+
+	tests := []struct {
+		name  string
+		img   image.Image
+		codes []string
+	}{
+		{name: "good", img: sharp},
+		{name: "small", img: imaging.Resize(sharp, 200, 0, imaging.Box), codes: []string{codeImageTooSmall}},
+		{name: "blurry", img: imaging.Blur(sharp, 8), codes: []string{codeImageBlurry}},
+		{name: "dark", img: imaging.New(400, 400, color.Black), codes: []string{codeImageUnderexposed}},
+		{name: "white and small", img: imaging.New(100, 400, color.White), codes: []string{codeImageTooSmall, codeImageOverexposed}},
+	}
+	for _, tt := range tests {
+		report := gate.evaluate(tt.img)
+		var codes []string
+		for _, issue := range report.Issues {
+			codes = append(codes, issue.Code)
+		}
+		if len(codes) != len(tt.codes) || report.Passed != (len(tt.codes) == 0) {
+			t.Errorf("%s: evaluate() issues = %v, passed %v, want %v", tt.name, codes, report.Passed, tt.codes)
+			continue
+		}
+		for i := range codes {
+			if codes[i] != tt.codes[i] {
+				t.Errorf("%s: evaluate() issues = %v, want %v", tt.name, codes, tt.codes)
+			}
+		}
+		if report.Passed == gate.rejects(report) {
+			t.Errorf("%s: rejects() = %v for passed = %v", tt.name, gate.rejects(report), report.Passed)
+		}
+	}
+
+	warn := &qualityGate{MinSide: 320, Mode: gateModeWarn}
+	if report := warn.evaluate(imaging.New(10, 10, color.White)); report.Passed || warn.rejects(report) {
+		t.Errorf("warn mode: passed %v, rejects %v", report.Passed, warn.rejects(report))
+	}
+}
+
+func TestSameShot(t *testing.T) {
+	gate := &qualityGate{Duplicate: 2}
+	tests := []struct {
+		a, b uint64
+		want bool
+	}{
+		{a: 0xff00, b: 0xff00, want: true},
+		{a: 0xff00, b: 0xff03, want: true},
+		{a: 0xff00, b: 0xff07, want: false},
+	}
+	for _, tt := range tests {
+		if got := gate.sameShot(tt.a, tt.b); got != tt.want {
+			t.Errorf("sameShot(%x, %x) = %v, want %v", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// The purposes whose files app-service keeps references to. Files of other
+// purposes are never referenced from the database, so collecting them
+// would delete everything.
+var gcPurposes = []string{purposeProduct, purposeReceipt, purposeShipping}
+
+type gcConfig struct {
+	// Files younger than grace are kept, their listing or order may not
+	// be saved yet
+	grace time.Duration
+	// interval is zero when only the admin endpoint runs collections
+	interval time.Duration
+	dryRun   bool
+}
+
+func loadGCConfig() (gcConfig, error) {
+	graceHours, err := envInt("MEDIA_GC_GRACE_HOURS", 24)
+	if err != nil {
+		return gcConfig{}, err
+	}
+	intervalHours, err := envInt("MEDIA_GC_INTERVAL_HOURS", 0)
+	if err != nil {
+		return gcConfig{}, err
+	}
+	dryRun := false
+	if v := os.Getenv("MEDIA_GC_DRY_RUN"); v != "" {
+		if dryRun, err = strconv.ParseBool(v); err != nil {
+			return gcConfig{}, fmt.Errorf("MEDIA_GC_DRY_RUN must be true or false")
+		}
+	}
+	return gcConfig{
+		grace:    time.Duration(graceHours) * time.Hour,
+		interval: time.Duration(intervalHours) * time.Hour,
+		dryRun:   dryRun,
+	}, nil
+}
+
+type gcOrphan struct {
+	objectRef
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+type gcReport struct {
+	DryRun     bool `json:"dry_run"`
+	GraceHours int  `json:"grace_hours"`
+	References int  `json:"references"`
+	// BrokenReferences point at files that no longer exist
+	BrokenReferences []mediaReference `json:"broken_references"`
+	Scanned          int              `json:"scanned"`
+	Orphans          []gcOrphan       `json:"orphans"`
+	// Untracked files were stored before uploads were recorded. Which
+	// upload they belong to is unknown, they are collected when no row
+	// refers to them directly
+	Untracked int `json:"untracked"`
+	Deleted   int `json:"deleted"`
+}
+
+var errGCRunning = errors.New("garbage collection is already running")
+
+// startGarbageCollector runs collectGarbage every MEDIA_GC_INTERVAL_HOURS.
+func (s *mediaService) startGarbageCollector() {
+	if s.db == nil || s.gc.interval == 0 {
+		return
+	}
+	ctx := context.Background()
+	for {
+		report, err := s.collectGarbage(ctx, s.gc.dryRun)
+		if err != nil {
+			fmt.Printf("Garbage Collection Error: %v\n", err)
+		} else {
+			fmt.Printf("Garbage collection: %d broken references, %d orphans, %d deleted (dry run: %t)\n",
+				len(report.BrokenReferences), len(report.Orphans), report.Deleted, report.DryRun)
+		}
+		time.Sleep(s.gc.interval)
+	}
+}
+
+// gcLocations returns where the collected purposes store files. A place
+// another purpose also stores into is left out.
+func (s *mediaService) gcLocations() []objectRef {
+	collected := make(map[string]bool)
+	for _, name := range gcPurposes {
+		collected[name] = true
+	}
+	shared := make(map[objectRef]bool)
+	for _, p := range s.presets {
+		if !collected[p.Name] {
+			shared[objectRef{p.Bucket, p.Prefix}] = true
+		}
+	}
+
+	var locations []objectRef
+	seen := make(map[objectRef]bool)
+	add := func(loc objectRef) {
+		if !seen[loc] && !shared[loc] {
+			seen[loc] = true
+			locations = append(locations, loc)
+		}
+	}
+	// Uploads from before purposes had prefixes sit at the root of the
+	// public bucket, and were all products, receipts or shipping documents
+	add(objectRef{s.publicBucket, ""})
+	for _, name := range gcPurposes {
+		p := s.presets[name]
+		if p == nil || p.UserKey {
+			continue
+		}
+		add(objectRef{p.Bucket, p.Prefix})
+		if p.Watermark {
+			add(objectRef{s.privateBucket, "originals/" + p.Prefix})
+		}
+	}
+	return locations
+}
+
+// collectGarbage compares the database references with what is stored.
+// It reports references to missing files and deletes files that no row
+// refers to, directly or through the upload they belong to, once they are
+// older than the grace period.
+func (s *mediaService) collectGarbage(ctx context.Context, dryRun bool) (*gcReport, error) {
+	if !s.gcMu.TryLock() {
+		return nil, errGCRunning
+	}
+	defer s.gcMu.Unlock()
+
+	report := &gcReport{
+		DryRun:           dryRun,
+		GraceHours:       int(s.gc.grace / time.Hour),
+		BrokenReferences: []mediaReference{},
+		Orphans:          []gcOrphan{},
+	}
+
+	refs, err := s.allReferences(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("read references: %w", err)
+	}
+	referenced := make(map[objectRef]bool)
+	for _, ref := range refs {
+		obj, ok := s.objectFromURL(ref.URL)
+		if !ok {
+			continue
+		}
+		report.References++
+		if _, err := s.store.Stat(obj.Bucket, obj.Key); errors.Is(err, errObjectNotFound) {
+			report.BrokenReferences = append(report.BrokenReferences, ref)
+		} else if err != nil {
+			return nil, fmt.Errorf("stat %s: %w", obj, err)
+		}
+		referenced[obj] = true
+	}
+
+	cutoff := time.Now().Add(-s.gc.grace)
+	var candidates []gcOrphan
+	for _, loc := range s.gcLocations() {
+		old, scanned, err := s.listOlderThan(loc, cutoff)
+		if err != nil {
+			return nil, fmt.Errorf("list %s: %w", loc, err)
+		}
+		report.Scanned += scanned
+		candidates = append(candidates, old...)
+	}
+
+	objs := make([]objectRef, len(candidates))
+	for i, c := range candidates {
+		objs[i] = c.objectRef
+	}
+	usedBy, err := s.registry.UsedBy(ctx, objs)
+	if err != nil {
+		return nil, err
+	}
+	lastStored, err := s.registry.LastStored(ctx, objs)
+	if err != nil {
+		return nil, err
+	}
+
+	report.Orphans, report.Untracked = gcOrphans(candidates, usedBy, lastStored, referenced, cutoff)
+	orphans := make([]objectRef, len(report.Orphans))
+	for i, o := range report.Orphans {
+		orphans[i] = o.objectRef
+	}
+
+	if dryRun {
+		return report, nil
+	}
+	for start := 0; start < len(orphans); start += retentionPageSize {
+		batch := orphans[start:min(start+retentionPageSize, len(orphans))]
+		if err := s.deleteObjects(ctx, batch); err != nil {
+			return report, err
+		}
+		report.Deleted += len(batch)
+	}
+	return report, nil
+}
+
+// gcOrphans picks the candidates nothing uses: not referenced by a row,
+// not part of an upload that is and not uploaded again since cutoff. It
+// also counts the candidates the registry has no record of.
+func gcOrphans(candidates []gcOrphan, usedBy map[objectRef][]objectRef, lastStored map[objectRef]time.Time, referenced map[objectRef]bool, cutoff time.Time) ([]gcOrphan, int) {
+	orphans := []gcOrphan{}
+	untracked := 0
+	for _, c := range candidates {
+		uploads, tracked := usedBy[c.objectRef]
+		if !tracked {
+			untracked++
+		}
+		// Identical content uploaded again is not rewritten
+		if lastStored[c.objectRef].After(cutoff) || referenced[c.objectRef] {
+			continue
+		}
+		live := false
+		for _, primary := range uploads {
+			live = live || referenced[primary]
+		}
+		if !live {
+			orphans = append(orphans, c)
+		}
+	}
+	return orphans, untracked
+}
+
+// listOlderThan returns the files directly under loc last written before
+// cutoff, and how many files it looked at.
+func (s *mediaService) listOlderThan(loc objectRef, cutoff time.Time) ([]gcOrphan, int, error) {
+	var old []gcOrphan
+	scanned := 0
+	for offset := 0; ; offset += retentionPageSize {
+		objects, err := s.store.List(loc.Bucket, loc.Key, retentionPageSize, offset)
+		if err != nil {
+			return nil, scanned, err
+		}
+		for _, obj := range objects {
+			scanned++
+			// Least recently written first, the rest are newer
+			if !obj.UpdatedAt.Before(cutoff) {
+				return old, scanned, nil
+			}
+			old = append(old, gcOrphan{objectRef{loc.Bucket, loc.Key + obj.Name}, obj.UpdatedAt})
+		}
+		if len(objects) < retentionPageSize {
+			return old, scanned, nil
+		}
+	}
+}
+
+// handleGC runs a collection on demand. It only reports what it would
+// delete unless dry_run=false.
+func (s *mediaService) handleGC(c *gin.Context) {
+	if s.db == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "DATABASE_URL is not set, references cannot be checked"})
+		return
+	}
+	dryRun := c.DefaultQuery("dry_run", "true") != "false"
+
+	report, err := s.collectGarbage(c.Request.Context(), dryRun)
+	if errors.Is(err, errGCRunning) {
+		c.JSON(http.StatusConflict, gin.H{"error": "Garbage collection is already running"})
+		return
+	}
+	if err != nil {
+		fmt.Printf("Garbage Collection Error: %v\n", err)
+		if report == nil {
+			c.JSON(http.StatusBadGateway, gin.H{"error": "Garbage collection failed"})
+			return
+		}
+		c.JSON(http.StatusBadGateway, gin.H{"error": "Garbage collection stopped part way", "report": report})
+		return
+	}
+	c.JSON(http.StatusOK, report)
+}
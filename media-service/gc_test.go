@@ -0,0 +1,118 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLoadGCConfig(t *testing.T) {
+	tests := []struct {
+		grace, interval, dryRun string
+		want                    gcConfig
+		wantErr                 bool
+	}{
+		{want: gcConfig{grace: 24 * time.Hour}},
+		{grace: "48", interval: "6", dryRun: "true", want: gcConfig{grace: 48 * time.Hour, interval: 6 * time.Hour, dryRun: true}},
+		{grace: "-1", wantErr: true},
+		{dryRun: "maybe", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Setenv("MEDIA_GC_GRACE_HOURS", tt.grace)
+		t.Setenv("MEDIA_GC_INTERVAL_HOURS", tt.interval)
+		t.Setenv("MEDIA_GC_DRY_RUN", tt.dryRun)
+		got, err := loadGCConfig()
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("loadGCConfig(%q, %q, %q) = %+v, %v, want %+v (error %v)", tt.grace, tt.interval, tt.dryRun, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestGCLocations(t *testing.T) {
+	s := &mediaService{
+		publicBucket:  "public",
+		privateBucket: "private",
+		presets: map[string]*purposePreset{
+			purposeProduct:  {Name: purposeProduct, Bucket: "public", Prefix: "products/", Watermark: true},
+			purposeAvatar:   {Name: purposeAvatar, Bucket: "public", Prefix: "avatars/", UserKey: true},
+			purposeReceipt:  {Name: purposeReceipt, Bucket: "private", Prefix: "receipts/"},
+			purposeShipping: {Name: purposeShipping, Bucket: "private", Prefix: "receipts/"},
+			"banner":        {Name: "banner", Bucket: "public", Prefix: "banner/"},
+		},
+	}
+	want := []objectRef{
+		{"public", ""},
+		{"public", "products/"},
+		{"private", "originals/products/"},
+		{"private", "receipts/"},
+	}
+	assertLocations := func(name string, want []objectRef) {
+		t.Helper()
+		got := s.gcLocations()
+		if len(got) != len(want) {
+			t.Fatalf("%s: gcLocations() = %v, want %v", name, got, want)
+		}
+		for i := range want {
+			if got[i] != want[i] {
+				t.Errorf("%s: gcLocations() = %v, want %v", name, got, want)
+				break
+			}
+		}
+	}
+	assertLocations("built-in", want)
+
+	// A purpose nothing refers to that stores at the root keeps it out
+	s.presets["banner"].Prefix = ""
+	assertLocations("root shared", want[1:])
+	s.presets["banner"].Prefix = "products/"
+	assertLocations("prefix shared", []objectRef{{"public", ""}, {"private", "originals/products/"}, {"private", "receipts/"}})
+}
+
+func TestGCOrphans(t *testing.T) {
+	cutoff := time.Now().Add(-24 * time.Hour)
+	ref := func(key string) objectRef { return objectRef{"public", key} }
+	candidate := func(key string) gcOrphan { return gcOrphan{ref(key), cutoff.Add(-time.Hour)} }
+
+	candidates := []gcOrphan{
+		candidate("products/live.jpg"),
+		candidate("products/live_thumb.jpg"),
+		candidate("products/dead.jpg"),
+		candidate("products/dead_thumb.jpg"),
+		candidate("products/shared_thumb.jpg"),
+		candidate("products/reuploaded.jpg"),
+		candidate("1700000000_legacy.jpg"),
+		candidate("1700000000_legacy_used.jpg"),
+	}
+	usedBy := map[objectRef][]objectRef{
+		ref("products/live.jpg"):         {ref("products/live.jpg")},
+		ref("products/live_thumb.jpg"):   {ref("products/live.jpg")},
+		ref("products/dead.jpg"):         {ref("products/dead.jpg")},
+		ref("products/dead_thumb.jpg"):   {ref("products/dead.jpg")},
+		ref("products/shared_thumb.jpg"): {ref("products/dead.jpg"), ref("products/live.jpg")},
+		ref("products/reuploaded.jpg"):   {ref("products/reuploaded.jpg")},
+	}
+	lastStored := map[objectRef]time.Time{
+		ref("products/reuploaded.jpg"): time.Now(),
+	}
+	referenced := map[objectRef]bool{
+		ref("products/live.jpg"):          true,
+		ref("1700000000_legacy_used.jpg"): true,
+	}
+
+	orphans, untracked := gcOrphans(candidates, usedBy, lastStored, referenced, cutoff)
+	want := []string{"products/dead.jpg", "products/dead_thumb.jpg", "1700000000_legacy.jpg"}
+	if len(orphans) != len(want) {
+		t.Fatalf("gcOrphans() = %v, want %v", orphans, want)
+	}
+	for i, key := range want {
+		if orphans[i].objectRef != ref(key) {
+			t.Errorf("gcOrphans()[%d] = %v, want %s", i, orphans[i], key)
+		}
+	}
+	if untracked != 2 {
+		t.Errorf("gcOrphans() untracked = %d, want 2", untracked)
+	}
+
+	if orphans, _ := gcOrphans(nil, nil, nil, nil, cutoff); orphans == nil {
+		t.Error("gcOrphans() = nil, want an empty list for the report")
+	}
+}
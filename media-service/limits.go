@@ -0,0 +1,237 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/gif"
+	"net/http"
+
+	"golang.org/x/sync/semaphore"
+)
+
+const (
+	codeImageInvalid       = "IMAGE_INVALID"
+	codeImageTooWide       = "IMAGE_DIMENSIONS_EXCEEDED"
+	codeImageTooManyPixels = "IMAGE_PIXELS_EXCEEDED"
+	codeImageTooManyFrames = "IMAGE_FRAMES_EXCEEDED"
+)
+
+// Decoded images take 4 bytes per pixel, resizing and encoding roughly
+// doubles that while variants are produced.
+const decodeBytesPerPixel = 8
+
+// decodeLimits guards against decompression bombs: headers are checked
+// before any pixel data is decoded, and a shared memory budget makes
+// large concurrent decodes wait their turn instead of exhausting memory.
+type decodeLimits struct {
+	maxPixels    int
+	maxDimension int
+	maxFrames    int
+	budgetBytes  int64
+	budget       *semaphore.Weighted
+}
+
+func loadDecodeLimits() (*decodeLimits, error) {
+	maxPixels, err := envInt("MEDIA_MAX_PIXELS", 40_000_000)
+	if err != nil {
+		return nil, err
+	}
+	maxDimension, err := envInt("MEDIA_MAX_DIMENSION", 12000)
+	if err != nil {
+		return nil, err
+	}
+	maxFrames, err := envInt("MEDIA_MAX_FRAMES", 200)
+	if err != nil {
+		return nil, err
+	}
+	budgetMB, err := envInt("MEDIA_DECODE_MEMORY_MB", 1024)
+	if err != nil {
+		return nil, err
+	}
+
+	budgetBytes := int64(budgetMB) << 20
+	return &decodeLimits{
+		maxPixels:    maxPixels,
+		maxDimension: maxDimension,
+		maxFrames:    maxFrames,
+		budgetBytes:  budgetBytes,
+		budget:       semaphore.NewWeighted(budgetBytes),
+	}, nil
+}
+
+// check validates the header of data without decoding the pixels.
+func (l *decodeLimits) check(data []byte) (image.Config, error) {
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return cfg, &uploadError{Status: http.StatusBadRequest, Code: codeImageInvalid, Message: fmt.Sprintf("Failed to read image header: %v", err)}
+	}
+
+	if cfg.Width <= 0 || cfg.Height <= 0 {
+		return cfg, &uploadError{Status: http.StatusBadRequest, Code: codeImageInvalid, Message: "Image has no pixels"}
+	}
+	if cfg.Width > l.maxDimension || cfg.Height > l.maxDimension {
+		return cfg, &uploadError{
+			Status:  http.StatusRequestEntityTooLarge,
+			Code:    codeImageTooWide,
+			Message: fmt.Sprintf("Image is %dx%d, the maximum side is %d pixels", cfg.Width, cfg.Height, l.maxDimension),
+		}
+	}
+	if int64(cfg.Width)*int64(cfg.Height) > int64(l.maxPixels) {
+		return cfg, &uploadError{
+			Status:  http.StatusRequestEntityTooLarge,
+			Code:    codeImageTooManyPixels,
+			Message: fmt.Sprintf("Image has %d pixels, the maximum is %d", cfg.Width*cfg.Height, l.maxPixels),
+		}
+	}
+	if frames := countFrames(data, l.maxFrames+1); frames > l.maxFrames {
+		return cfg, &uploadError{
+			Status:  http.StatusRequestEntityTooLarge,
+			Code:    codeImageTooManyFrames,
+			Message: fmt.Sprintf("Image has more than %d frames", l.maxFrames),
+		}
+	}
+	return cfg, nil
+}
+
+// acquire reserves memory for decoding frames images of the given size and
+// blocks while the budget is used by other requests. An image bigger than
+// the whole budget runs alone.
+func (l *decodeLimits) acquire(ctx context.Context, cfg image.Config, frames int) (func(), error) {
+	need := min(int64(cfg.Width)*int64(cfg.Height)*int64(frames)*decodeBytesPerPixel, l.budgetBytes)
+	if err := l.budget.Acquire(ctx, need); err != nil {
+		return nil, &uploadError{Status: http.StatusServiceUnavailable, Message: "Request cancelled while waiting for decode capacity"}
+	}
+	return func() { l.budget.Release(need) }, nil
+}
+
+// decode checks the header, waits for memory budget and decodes. The
+// returned release func must be called once the image is no longer used.
+func (l *decodeLimits) decode(ctx context.Context, data []byte) (image.Image, func(), error) {
+	cfg, err := l.check(data)
+	if err != nil {
+		return nil, nil, err
+	}
+	release, err := l.acquire(ctx, cfg, 1)
+	if err != nil {
+		return nil, nil, err
+	}
+	img, err := decodeImage(data)
+	if err != nil {
+		release()
+		return nil, nil, &uploadError{Status: http.StatusBadRequest, Code: codeImageInvalid, Message: fmt.Sprintf("Failed to decode image: %v", err)}
+	}
+	return img, release, nil
+}
+
+// decodeGIF is decode for animations, keeping every frame. The memory
+// reserved covers all frames once they are composited.
+func (l *decodeLimits) decodeGIF(ctx context.Context, data []byte) (*gif.GIF, func(), error) {
+	cfg, err := l.check(data)
+	if err != nil {
+		return nil, nil, err
+	}
+	release, err := l.acquire(ctx, cfg, countFrames(data, l.maxFrames))
+	if err != nil {
+		return nil, nil, err
+	}
+	g, err := gif.DecodeAll(bytes.NewReader(data))
+	if err != nil {
+		release()
+		return nil, nil, &uploadError{Status: http.StatusBadRequest, Code: codeImageInvalid, Message: fmt.Sprintf("Failed to decode GIF: %v", err)}
+	}
+	return g, release, nil
+}
+
+// countFrames returns the number of animation frames in GIF, APNG and
+// animated WebP files, stopping once limit is reached. Still images count
+// as one frame.
+func countFrames(data []byte, limit int) int {
+	switch {
+	case bytes.HasPrefix(data, []byte("GIF8")):
+		return countGIFFrames(data, limit)
+	case bytes.HasPrefix(data, []byte("\x89PNG\r\n\x1a\n")):
+		return countAPNGFrames(data)
+	case len(data) >= 12 && string(data[0:4]) == "RIFF" && string(data[8:12]) == "WEBP":
+		return countWebPFrames(data, limit)
+	}
+	return 1
+}
+
+func countGIFFrames(data []byte, limit int) int {
+	if len(data) < 13 {
+		return 0
+	}
+	pos := 13
+	// Global colour table
+	if flags := data[10]; flags&0x80 != 0 {
+		pos += 3 << ((flags & 0x07) + 1)
+	}
+
+	frames := 0
+	for pos < len(data) && frames < limit {
+		switch data[pos] {
+		case 0x21: // extension: label then data sub-blocks
+			pos = skipGIFSubBlocks(data, pos+2)
+		case 0x2C: // image descriptor
+			frames++
+			if pos+10 > len(data) {
+				return frames
+			}
+			flags := data[pos+9]
+			pos += 10
+			if flags&0x80 != 0 {
+				pos += 3 << ((flags & 0x07) + 1)
+			}
+			// LZW minimum code size then image data sub-blocks
+			pos = skipGIFSubBlocks(data, pos+1)
+		default: // trailer or garbage
+			return frames
+		}
+	}
+	return frames
+}
+
+func skipGIFSubBlocks(data []byte, pos int) int {
+	for pos < len(data) {
+		size := int(data[pos])
+		pos++
+		if size == 0 {
+			break
+		}
+		pos += size
+	}
+	return pos
+}
+
+func countAPNGFrames(data []byte) int {
+	pos := 8
+	for pos+8 <= len(data) {
+		length := int(binary.BigEndian.Uint32(data[pos:]))
+		chunkType := string(data[pos+4 : pos+8])
+		if chunkType == "acTL" && length >= 8 && pos+16 <= len(data) {
+			return int(binary.BigEndian.Uint32(data[pos+8:]))
+		}
+		if chunkType == "IDAT" || chunkType == "IEND" {
+			break
+		}
+		pos += 12 + length
+	}
+	return 1
+}
+
+func countWebPFrames(data []byte, limit int) int {
+	frames := 0
+	pos := 12
+	for pos+8 <= len(data) && frames < limit {
+		chunkType := string(data[pos : pos+4])
+		length := int(binary.LittleEndian.Uint32(data[pos+4:]))
+		if chunkType == "ANMF" {
+			frames++
+		}
+		pos += 8 + length + length%2
+	}
+	return max(frames, 1)
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/color/palette"
+	"image/gif"
+	"image/png"
+	"net/http"
+	"testing"
+	"time"
+
+	"golang.org/x/sync/semaphore"
+)
+
+func encodeGIF(t *testing.T, frames int) []byte {
+	t.Helper()
+	g := &gif.GIF{}
+	for i := 0; i < frames; i++ {
+		frame := image.NewPaletted(image.Rect(0, 0, 4, 4), palette.Plan9)
+		frame.SetColorIndex(i%4, 0, uint8(i))
+		g.Image = append(g.Image, frame)
+		g.Delay = append(g.Delay, 10)
+	}
+	var buf bytes.Buffer
+	if err := gif.EncodeAll(&buf, g); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func encodePNG(t *testing.T, w, h int) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewGray(image.Rect(0, 0, w, h))); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func acTL(frames uint32) []byte {
+	payload := make([]byte, 8)
+	binary.BigEndian.PutUint32(payload, frames)
+	return pngChunk("acTL", string(payload))
+}
+
+func TestCountFrames(t *testing.T) {
+	pngStart := []byte("\x89PNG\r\n\x1a\n")
+	webpStart := []byte("RIFF\x00\x00\x00\x00WEBP")
+	ihdr := pngChunk("IHDR", "0123456789abc")
+
+	tests := []struct {
+		name  string
+		data  []byte
+		limit int
+		want  int
+	}{
+		{name: "jpeg", data: []byte{0xFF, 0xD8, 0xFF}, limit: 10, want: 1},
+		{name: "still gif", data: encodeGIF(t, 1), limit: 10, want: 1},
+		{name: "animated gif", data: encodeGIF(t, 7), limit: 10, want: 7},
+		{name: "gif stops at limit", data: encodeGIF(t, 30), limit: 5, want: 5},
+		{name: "truncated gif header", data: []byte("GIF89a"), limit: 10, want: 0},
+		{name: "still png", data: encodePNG(t, 2, 2), limit: 10, want: 1},
+		{name: "apng", data: joinBytes(pngStart, ihdr, acTL(12), pngChunk("IDAT", "x")), limit: 10, want: 12},
+		{name: "acTL after image data is ignored", data: joinBytes(pngStart, ihdr, pngChunk("IDAT", "x"), acTL(12)), limit: 10, want: 1},
+		{name: "truncated acTL", data: joinBytes(pngStart, ihdr, []byte("\x00\x00\x00\x08acTL\x00\x00")), limit: 10, want: 1},
+		{name: "still webp", data: joinBytes(webpStart, webpChunk("VP8 ", "data")), limit: 10, want: 1},
+		{
+			name:  "animated webp",
+			data:  joinBytes(webpStart, webpChunk("VP8X", "0123456789"), webpChunk("ANIM", "012345"), webpChunk("ANMF", "a"), webpChunk("ANMF", "b"), webpChunk("ANMF", "c")),
+			limit: 10,
+			want:  3,
+		},
+		{
+			name:  "webp stops at limit",
+			data:  joinBytes(webpStart, webpChunk("ANMF", "a"), webpChunk("ANMF", "b"), webpChunk("ANMF", "c")),
+			limit: 2,
+			want:  2,
+		},
+	}
+	for _, tt := range tests {
+		if got := countFrames(tt.data, tt.limit); got != tt.want {
+			t.Errorf("%s: countFrames() = %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestDecodeLimitsCheck(t *testing.T) {
+	limits := &decodeLimits{maxPixels: 5000, maxDimension: 100, maxFrames: 3}
+
+	tests := []struct {
+		name     string
+		data     []byte
+		wantCode string
+	}{
+		{name: "within limits", data: encodePNG(t, 100, 50)},
+		{name: "not an image", data: []byte("hello"), wantCode: codeImageInvalid},
+		{name: "too wide", data: encodePNG(t, 101, 1), wantCode: codeImageTooWide},
+		{name: "too tall", data: encodePNG(t, 1, 101), wantCode: codeImageTooWide},
+		{name: "too many pixels", data: encodePNG(t, 100, 51), wantCode: codeImageTooManyPixels},
+		{name: "frames at limit", data: encodeGIF(t, 3)},
+		{name: "too many frames", data: encodeGIF(t, 4), wantCode: codeImageTooManyFrames},
+	}
+	for _, tt := range tests {
+		_, err := limits.check(tt.data)
+		if got := errorCode(err); (err != nil) != (tt.wantCode != "") || got != tt.wantCode {
+			t.Errorf("%s: check() error = %v (code %q), want code %q", tt.name, err, got, tt.wantCode)
+		}
+	}
+}
+
+func TestDecodeLimitsBudget(t *testing.T) {
+	budget := int64(100 * 100 * decodeBytesPerPixel)
+	limits := &decodeLimits{
+		maxPixels:    1 << 20,
+		maxDimension: 1000,
+		maxFrames:    1,
+		budgetBytes:  budget,
+		budget:       semaphore.NewWeighted(budget),
+	}
+
+	// Bigger than the whole budget still runs, alone
+	big := image.Config{Width: 1000, Height: 1000}
+	release, err := limits.acquire(context.Background(), big, 1)
+	if err != nil {
+		t.Fatalf("acquire() error = %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := limits.acquire(ctx, image.Config{Width: 1, Height: 1}, 1); errorStatus(err) != http.StatusServiceUnavailable {
+		t.Errorf("acquire() while the budget is used = %v, want 503", err)
+	}
+
+	release()
+	img, release, err := limits.decode(context.Background(), encodePNG(t, 10, 10))
+	if err != nil {
+		t.Fatalf("decode() error = %v", err)
+	}
+	release()
+	if img.Bounds().Dx() != 10 || color.GrayModel.Convert(img.At(0, 0)) != (color.Gray{}) {
+		t.Errorf("decode() = %v", img.Bounds())
+	}
+}
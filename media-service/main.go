@@ -1,23 +1,15 @@
 package main
 
 import (
-	"bytes"
 	"context"
 	"encoding/json"
 	"fmt"
-	"image"
-	"image/jpeg"
 	_ "image/png"
-	"io"
-	"net/http"
 	"net/smtp"
 	"os"
-	"path/filepath"
 	"strconv"
-	"strings"
 	"time"
 
-	"github.com/disintegration/imaging"
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
 	"github.com/joho/godotenv"
@@ -38,76 +30,62 @@ func main() {
 	_ = godotenv.Load()
 
 	r := gin.Default()
+	if err := r.SetTrustedProxies(trustedProxies()); err != nil {
+		fmt.Printf("Media service config error: MEDIA_TRUSTED_PROXIES: %v\n", err)
+		os.Exit(1)
+	}
 
 	r.Use(cors.New(cors.Config{
 		AllowOrigins:     []string{"http://localhost:5173"}, // Port của frontend
-		AllowMethods:     []string{"POST", "GET", "OPTIONS", "PUT", "DELETE"},
-		AllowHeaders:     []string{"Origin", "Content-Type", "Authorization"},
-		ExposeHeaders:    []string{"Content-Length"},
+		AllowMethods:     []string{"POST", "GET", "OPTIONS", "PUT", "DELETE", "PATCH", "HEAD"},
+		AllowHeaders:     []string{"Origin", "Content-Type", "Authorization", "Tus-Resumable", "Upload-Length", "Upload-Offset", "Upload-Metadata"},
+		ExposeHeaders:    []string{"Content-Length", "Location", "Tus-Resumable", "Tus-Version", "Tus-Extension", "Tus-Max-Size", "Upload-Offset", "Upload-Length", "Upload-Metadata", "Upload-Expires"},
 		AllowCredentials: true,
 		MaxAge:           12 * time.Hour,
 	}))
 
 	r.MaxMultipartMemory = 8 << 20 // 8MB
 
-	r.POST("api/v1/media/upload", func(c *gin.Context) {
-		file, header, err := c.Request.FormFile("file")
-		if err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "File is required"})
-			return
-		}
-		defer file.Close()
-
-		ext := strings.ToLower(filepath.Ext(header.Filename))
-		fmt.Printf("File extension: %s\n", ext)
-		if ext != ".jpg" && ext != ".jpeg" && ext != ".png" {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "Only JPG/PNG images are allowed"})
-			return
-		}
+	rdb := redis.NewClient(&redis.Options{Addr: redisAddr()})
 
-		// Processing Image
-		if _, err := file.Seek(0, 0); err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to reset file pointer"})
-			return
-		}
-
-		srcImage, err := imaging.Decode(file)
-		if err != nil {
-			fmt.Printf("Image Decode Error: %v\n", err)
-			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Failed to decode image: %v", err)})
-			return
-		}
-
-		var dstImage image.Image = srcImage
-		if srcImage.Bounds().Dx() > 1024 {
-			dstImage = imaging.Resize(srcImage, 1024, 0, imaging.Lanczos)
-		}
-
-		buf := new(bytes.Buffer)
-		err = jpeg.Encode(buf, dstImage, &jpeg.Options{Quality: 80})
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to compress image"})
-			return
-		}
-
-		cleanFileName := strings.ReplaceAll(header.Filename, " ", "-")
-		finalFileName := fmt.Sprintf("%d_%s.jpg", time.Now().Unix(), strings.TrimSuffix(cleanFileName, ext))
+	media, err := newMediaService(rdb)
+	if err != nil {
+		fmt.Printf("Media service config error: %v\n", err)
+		os.Exit(1)
+	}
 
-		url, err := uploadBufferToSupabase(buf, finalFileName, "image/jpeg")
-		if err != nil {
-			fmt.Printf("Supabase Upload Error: %v\n", err)
-			c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to upload image to Supabase: %v", err)})
-			return
-		}
+	r.POST("api/v1/media/upload", media.handleUpload)
+	r.POST("api/v1/media/upload/batch", media.handleBatchUpload)
+	r.POST("api/v1/media/upload/ticket", media.handleUploadTicket)
+	r.POST("api/v1/media/upload/ticket/:id/complete", media.handleCompleteTicket)
+	admin := r.Group("api/v1/media/admin", requireAuth(), requireRole(roleAdmin))
+	admin.POST("phash/search", media.handlePhashSearch)
+	admin.POST("gc", media.handleGC)
+	r.DELETE("api/v1/media/*key", requireAuth(), media.handleDelete)
+
+	tus := r.Group("api/v1/media/tus", tusProtocol())
+	tus.OPTIONS("", media.handleTusOptions)
+	tus.POST("", media.handleTusCreate)
+	tus.HEAD(":id", media.handleTusHead)
+	tus.PATCH(":id", media.handleTusPatch)
+	r.GET("api/v1/media/tus/:id", media.handleTusResult)
+
+	if local, ok := media.store.(*localStore); ok {
+		r.GET("api/v1/media/files/:bucket/*key", local.handleFile)
+		r.PUT("api/v1/media/files/:bucket/*key", local.handleSignedPut(media.maxUploadBytes()))
+	}
 
-		c.JSON(http.StatusOK, gin.H{
-			"url":           url,
-			"original_name": header.Filename,
-			"processed":     true,
-		})
-	})
+	r.GET("api/v1/media/img/*key", media.handleTransform)
+	r.GET("api/v1/media/sign/*key", requireAuth(), media.handleSignTransform)
+	r.GET("api/v1/media/private/*key", media.handlePrivateDownload)
+	r.GET("api/v1/media/orders/:id/:document", requireAuth(), media.handleOrderDocument)
+	r.POST("api/v1/media/orders/documents", requireAuth(), media.handleOrderDocuments)
 
 	go startEmailWorker()
+	go media.startRetentionSweeper()
+	go media.startGarbageCollector()
+	go media.startTusSweeper()
+	go media.startStagingSweeper()
 
 	port := os.Getenv("PORT")
 	if port == "" {
@@ -118,41 +96,9 @@ func main() {
 	r.Run(":" + port)
 }
 
-func uploadBufferToSupabase(body io.Reader, filename string, contentType string) (string, error) {
-	supabaseUrl := os.Getenv("SUPABASE_URL")
-	supabaseKey := os.Getenv("SUPABASE_SERVICE_KEY")
-	bucketName := os.Getenv("SUPABASE_BUCKET")
-
-	uploadUrl := fmt.Sprintf("%s/storage/v1/object/%s/%s", supabaseUrl, bucketName, filename)
-	fmt.Printf("Uploading %s to %s\n", filename, uploadUrl)
-
-	req, err := http.NewRequest("PUT", uploadUrl, body)
-	if err != nil {
-		return "", err
-	}
-
-	req.Header.Set("Authorization", "Bearer "+supabaseKey)
-	req.Header.Set("Content-Type", contentType)
-
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		return "", err
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != 200 {
-		bodyBytes, _ := io.ReadAll(resp.Body)
-		return "", fmt.Errorf("status %d: %s", resp.StatusCode, string(bodyBytes))
-	}
-
-	publicUrl := fmt.Sprintf("%s/storage/v1/object/%s/%s", supabaseUrl, bucketName, filename)
-	return publicUrl, nil
-}
-
 func startEmailWorker() {
 	ctx := context.Background()
-	rdb := redis.NewClient(&redis.Options{Addr: "localhost:6379"})
+	rdb := redis.NewClient(&redis.Options{Addr: redisAddr()})
 
 	rdb.XGroupCreateMkStream(ctx, "notification_stream", "email_workers", "$")
 
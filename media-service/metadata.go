@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+// detectMetadata reports which metadata blocks (EXIF, XMP, IPTC, text)
+// are present in the original file. None of them survive processing since
+// the encoders in encode.go never write metadata, so a non-empty result
+// means something was stripped.
+func detectMetadata(data []byte) []string {
+	switch {
+	case bytes.HasPrefix(data, []byte{0xFF, 0xD8}):
+		return jpegMetadata(data)
+	case bytes.HasPrefix(data, []byte("\x89PNG\r\n\x1a\n")):
+		return pngMetadata(data)
+	case len(data) >= 12 && string(data[0:4]) == "RIFF" && string(data[8:12]) == "WEBP":
+		return webpMetadata(data)
+	}
+	return nil
+}
+
+func jpegMetadata(data []byte) []string {
+	found := newKindSet()
+	pos := 2
+	for pos+4 <= len(data) {
+		if data[pos] != 0xFF {
+			break
+		}
+		marker := data[pos+1]
+		if marker == 0xD9 || marker == 0xDA {
+			// End of image or start of scan, no more headers after this
+			break
+		}
+		if marker == 0x01 || (marker >= 0xD0 && marker <= 0xD7) {
+			pos += 2
+			continue
+		}
+		length := int(binary.BigEndian.Uint16(data[pos+2:]))
+		end := pos + 2 + length
+		if length < 2 || end > len(data) {
+			break
+		}
+		payload := data[pos+4 : end]
+		switch {
+		case marker == 0xE1 && bytes.HasPrefix(payload, []byte("Exif\x00")):
+			found.add("exif")
+		case marker == 0xE1 && bytes.HasPrefix(payload, []byte("http://ns.adobe.com/xap/1.0/")):
+			found.add("xmp")
+		case marker == 0xED:
+			found.add("iptc")
+		case marker == 0xFE:
+			found.add("comment")
+		}
+		pos = end
+	}
+	return found.list()
+}
+
+func pngMetadata(data []byte) []string {
+	found := newKindSet()
+	pos := 8
+	for pos+8 <= len(data) {
+		length := int(binary.BigEndian.Uint32(data[pos:]))
+		chunkType := string(data[pos+4 : pos+8])
+		end := pos + 12 + length
+		if length < 0 || end > len(data) {
+			break
+		}
+		payload := data[pos+8 : pos+8+length]
+		switch chunkType {
+		case "eXIf":
+			found.add("exif")
+		case "iTXt":
+			if bytes.HasPrefix(payload, []byte("XML:com.adobe.xmp\x00")) {
+				found.add("xmp")
+			} else {
+				found.add("text")
+			}
+		case "tEXt", "zTXt":
+			found.add("text")
+		case "IEND":
+			return found.list()
+		}
+		pos = end
+	}
+	return found.list()
+}
+
+func webpMetadata(data []byte) []string {
+	found := newKindSet()
+	pos := 12
+	for pos+8 <= len(data) {
+		chunkType := string(data[pos : pos+4])
+		length := int(binary.LittleEndian.Uint32(data[pos+4:]))
+		switch chunkType {
+		case "EXIF":
+			found.add("exif")
+		case "XMP ":
+			found.add("xmp")
+		}
+		// Chunks are padded to an even size
+		pos += 8 + length + length%2
+	}
+	return found.list()
+}
+
+type kindSet struct {
+	order []string
+	seen  map[string]bool
+}
+
+func newKindSet() *kindSet {
+	return &kindSet{seen: make(map[string]bool)}
+}
+
+func (s *kindSet) add(kind string) {
+	if !s.seen[kind] {
+		s.seen[kind] = true
+		s.order = append(s.order, kind)
+	}
+}
+
+func (s *kindSet) list() []string {
+	return s.order
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"reflect"
+	"testing"
+)
+
+func jpegSegment(marker byte, payload string) []byte {
+	seg := []byte{0xFF, marker, 0, 0}
+	binary.BigEndian.PutUint16(seg[2:], uint16(len(payload)+2))
+	return append(seg, payload...)
+}
+
+func pngChunk(chunkType, payload string) []byte {
+	chunk := make([]byte, 8, 12+len(payload))
+	binary.BigEndian.PutUint32(chunk, uint32(len(payload)))
+	copy(chunk[4:], chunkType)
+	chunk = append(chunk, payload...)
+	return append(chunk, 0, 0, 0, 0)
+}
+
+func webpChunk(chunkType, payload string) []byte {
+	chunk := make([]byte, 8, 9+len(payload))
+	copy(chunk, chunkType)
+	binary.LittleEndian.PutUint32(chunk[4:], uint32(len(payload)))
+	chunk = append(chunk, payload...)
+	if len(payload)%2 == 1 {
+		chunk = append(chunk, 0)
+	}
+	return chunk
+}
+
+func joinBytes(parts ...[]byte) []byte {
+	return bytes.Join(parts, nil)
+}
+
+func TestDetectMetadata(t *testing.T) {
+	jpegStart := []byte{0xFF, 0xD8}
+	pngStart := []byte("\x89PNG\r\n\x1a\n")
+	webpStart := []byte("RIFF\x00\x00\x00\x00WEBP")
+
+	tests := []struct {
+		name string
+		data []byte
+		want []string
+	}{
+		{name: "empty", data: nil, want: nil},
+		{name: "unknown format", data: []byte("GIF89a"), want: nil},
+		{
+			name: "jpeg without metadata",
+			data: joinBytes(jpegStart, jpegSegment(0xE0, "JFIF\x00"), []byte{0xFF, 0xDA}),
+			want: nil,
+		},
+		{
+			name: "jpeg exif xmp iptc comment",
+			data: joinBytes(jpegStart,
+				jpegSegment(0xE1, "Exif\x00\x00MM"),
+				jpegSegment(0xE1, "http://ns.adobe.com/xap/1.0/\x00<x/>"),
+				jpegSegment(0xED, "Photoshop 3.0"),
+				jpegSegment(0xFE, "hello"),
+				jpegSegment(0xE1, "Exif\x00\x00II"),
+			),
+			want: []string{"exif", "xmp", "iptc", "comment"},
+		},
+		{
+			name: "jpeg stops at start of scan",
+			data: joinBytes(jpegStart, []byte{0xFF, 0xDA}, jpegSegment(0xE1, "Exif\x00")),
+			want: nil,
+		},
+		{
+			name: "jpeg truncated segment",
+			data: joinBytes(jpegStart, jpegSegment(0xFE, "note"), []byte{0xFF, 0xE1, 0xFF, 0xFF, 'E'}),
+			want: []string{"comment"},
+		},
+		{
+			name: "png chunks",
+			data: joinBytes(pngStart,
+				pngChunk("IHDR", "0123456789abc"),
+				pngChunk("tEXt", "Author\x00me"),
+				pngChunk("iTXt", "XML:com.adobe.xmp\x00<x/>"),
+				pngChunk("eXIf", "MM"),
+				pngChunk("IEND", ""),
+				pngChunk("zTXt", "late"),
+			),
+			want: []string{"text", "xmp", "exif"},
+		},
+		{
+			name: "png truncated chunk",
+			data: joinBytes(pngStart, pngChunk("eXIf", "MM")[:10]),
+			want: nil,
+		},
+		{
+			name: "webp chunks with padding",
+			data: joinBytes(webpStart,
+				webpChunk("VP8X", "0123456789"),
+				webpChunk("EXIF", "odd"),
+				webpChunk("XMP ", "<x/>"),
+			),
+			want: []string{"exif", "xmp"},
+		},
+		{
+			name: "webp oversized length",
+			data: joinBytes(webpStart, []byte("EXIF\xff\xff\xff\xff")),
+			want: []string{"exif"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := detectMetadata(tt.data); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("detectMetadata() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
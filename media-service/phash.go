@@ -0,0 +1,220 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"io"
+	"math/bits"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"github.com/disintegration/imaging"
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+)
+
+// The 64-bit hash is split into 8 one-byte bands for lookup. Two hashes
+// within Hamming distance 7 always share at least one identical band, so
+// searching the band sets finds every candidate up to that distance.
+const (
+	phashBands       = 8
+	phashMaxDistance = phashBands - 1
+	phashHashKey     = "media:phash"
+)
+
+type phashMatch struct {
+	Key      string `json:"key"`
+	Distance int    `json:"distance"`
+}
+
+type phashIndex struct {
+	rdb         *redis.Client
+	maxDistance int
+}
+
+func newPhashIndex(rdb *redis.Client) (*phashIndex, error) {
+	maxDistance, err := envInt("MEDIA_PHASH_MAX_DISTANCE", 5)
+	if err != nil {
+		return nil, err
+	}
+	if maxDistance > phashMaxDistance {
+		return nil, fmt.Errorf("MEDIA_PHASH_MAX_DISTANCE cannot exceed %d", phashMaxDistance)
+	}
+	return &phashIndex{rdb: rdb, maxDistance: maxDistance}, nil
+}
+
+// dHash computes a 64-bit difference hash: the image is shrunk to 9x8
+// grayscale and each bit records whether a pixel is brighter than its
+// right neighbour.
+func dHash(img image.Image) uint64 {
+	small := imaging.Grayscale(imaging.Resize(img, 9, 8, imaging.Lanczos))
+
+	var hash uint64
+	for y := 0; y < 8; y++ {
+		row := small.Pix[y*small.Stride:]
+		for x := 0; x < 8; x++ {
+			hash <<= 1
+			if row[x*4] > row[(x+1)*4] {
+				hash |= 1
+			}
+		}
+	}
+	return hash
+}
+
+func formatPhash(hash uint64) string {
+	return fmt.Sprintf("%016x", hash)
+}
+
+func bandKey(band int, hash uint64) string {
+	value := byte(hash >> (8 * band))
+	return fmt.Sprintf("media:phash:band:%d:%02x", band, value)
+}
+
+func (ix *phashIndex) Add(ctx context.Context, key string, hash uint64) error {
+	pipe := ix.rdb.TxPipeline()
+	pipe.HSet(ctx, phashHashKey, key, formatPhash(hash))
+	for band := 0; band < phashBands; band++ {
+		pipe.SAdd(ctx, bandKey(band, hash), key)
+	}
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+// Remove drops key from the index.
+func (ix *phashIndex) Remove(ctx context.Context, key string) error {
+	stored, err := ix.rdb.HGet(ctx, phashHashKey, key).Result()
+	if err == redis.Nil {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	hash, err := strconv.ParseUint(stored, 16, 64)
+	if err != nil {
+		return err
+	}
+
+	pipe := ix.rdb.TxPipeline()
+	pipe.HDel(ctx, phashHashKey, key)
+	for band := 0; band < phashBands; band++ {
+		pipe.SRem(ctx, bandKey(band, hash), key)
+	}
+	_, err = pipe.Exec(ctx)
+	return err
+}
+
+// Find returns indexed media within maxDistance of hash, closest first.
+func (ix *phashIndex) Find(ctx context.Context, hash uint64, maxDistance int) ([]phashMatch, error) {
+	pipe := ix.rdb.Pipeline()
+	cmds := make([]*redis.StringSliceCmd, phashBands)
+	for band := 0; band < phashBands; band++ {
+		cmds[band] = pipe.SMembers(ctx, bandKey(band, hash))
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return nil, err
+	}
+
+	seen := make(map[string]bool)
+	var candidates []string
+	for _, cmd := range cmds {
+		for _, key := range cmd.Val() {
+			if !seen[key] {
+				seen[key] = true
+				candidates = append(candidates, key)
+			}
+		}
+	}
+	if len(candidates) == 0 {
+		return nil, nil
+	}
+
+	values, err := ix.rdb.HMGet(ctx, phashHashKey, candidates...).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	var matches []phashMatch
+	for i, v := range values {
+		stored, ok := v.(string)
+		if !ok {
+			continue
+		}
+		other, err := strconv.ParseUint(stored, 16, 64)
+		if err != nil {
+			continue
+		}
+		distance := bits.OnesCount64(hash ^ other)
+		if distance <= maxDistance {
+			matches = append(matches, phashMatch{Key: candidates[i], Distance: distance})
+		}
+	}
+
+	sort.Slice(matches, func(i, j int) bool {
+		if matches[i].Distance != matches[j].Distance {
+			return matches[i].Distance < matches[j].Distance
+		}
+		return matches[i].Key < matches[j].Key
+	})
+	return matches, nil
+}
+
+// otherMatches drops key from matches. Identical bytes are stored under
+// the same key, so a re-upload would otherwise match itself.
+func otherMatches(matches []phashMatch, key string) []phashMatch {
+	var others []phashMatch
+	for _, m := range matches {
+		if m.Key != key {
+			others = append(others, m)
+		}
+	}
+	return others
+}
+
+func (s *mediaService) handlePhashSearch(c *gin.Context) {
+	file, _, err := c.Request.FormFile("file")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "File is required"})
+		return
+	}
+	defer file.Close()
+
+	maxDistance := s.phash.maxDistance
+	if v := c.PostForm("max_distance"); v != "" {
+		maxDistance, err = strconv.Atoi(v)
+		if err != nil || maxDistance < 0 || maxDistance > phashMaxDistance {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("max_distance must be between 0 and %d", phashMaxDistance)})
+			return
+		}
+	}
+
+	data, err := io.ReadAll(file)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read file"})
+		return
+	}
+	img, release, err := s.limits.decode(c.Request.Context(), data)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	hash := dHash(img)
+	release()
+	matches, err := s.phash.Find(c.Request.Context(), hash, maxDistance)
+	if err != nil {
+		fmt.Printf("Phash Lookup Error: %v\n", err)
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Duplicate index unavailable"})
+		return
+	}
+	if matches == nil {
+		matches = []phashMatch{}
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"phash":        formatPhash(hash),
+		"max_distance": maxDistance,
+		"matches":      matches,
+	})
+}
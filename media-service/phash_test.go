@@ -0,0 +1,82 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"math/bits"
+	"testing"
+
+	"github.com/disintegration/imaging"
+)
+
+// gradient is a horizontal ramp, getting darker to the right when falling.
+func gradient(w, h int, falling bool) *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, w, h))
+	for x := 0; x < w; x++ {
+		v := uint8(x * 255 / (w - 1))
+		if falling {
+			v = 255 - v
+		}
+		for y := 0; y < h; y++ {
+			img.Set(x, y, color.NRGBA{v, v, v, 255})
+		}
+	}
+	return img
+}
+
+func TestDHash(t *testing.T) {
+	tests := []struct {
+		name string
+		img  image.Image
+		want uint64
+	}{
+		{name: "falling ramp", img: gradient(90, 80, true), want: ^uint64(0)},
+		{name: "rising ramp", img: gradient(90, 80, false), want: 0},
+		{name: "flat", img: imaging.New(50, 50, color.NRGBA{128, 128, 128, 255}), want: 0},
+	}
+	for _, tt := range tests {
+		if got := dHash(tt.img); got != tt.want {
+			t.Errorf("%s: dHash() = %016x, want %016x", tt.name, got, tt.want)
+		}
+	}
+
+	// A resized copy is the same picture and should hash within the
+	// default duplicate distance
+	photo := gradient(400, 300, true)
+	for x := 150; x < 250; x++ {
+		for y := 100; y < 200; y++ {
+			photo.Set(x, y, color.NRGBA{0, 0, 0, 255})
+		}
+	}
+	small := imaging.Resize(photo, 120, 0, imaging.Lanczos)
+	if d := bits.OnesCount64(dHash(photo) ^ dHash(small)); d > 5 {
+		t.Errorf("resized copy is %d bits away", d)
+	}
+}
+
+func TestPhashBands(t *testing.T) {
+	hash := uint64(0x0123456789abcdef)
+	if got := formatPhash(hash); got != "0123456789abcdef" {
+		t.Errorf("formatPhash() = %q", got)
+	}
+	if got := formatPhash(0xff); got != "00000000000000ff" {
+		t.Errorf("formatPhash() = %q, want zero padded", got)
+	}
+	if got := bandKey(0, hash); got != "media:phash:band:0:ef" {
+		t.Errorf("bandKey(0) = %q", got)
+	}
+	if got := bandKey(7, hash); got != "media:phash:band:7:01" {
+		t.Errorf("bandKey(7) = %q", got)
+	}
+}
+
+func TestOtherMatches(t *testing.T) {
+	matches := []phashMatch{{Key: "products/a_full.jpg"}, {Key: "products/b_full.jpg", Distance: 3}}
+	got := otherMatches(matches, "products/a_full.jpg")
+	if len(got) != 1 || got[0].Key != "products/b_full.jpg" {
+		t.Errorf("otherMatches() = %v, want only the other upload", got)
+	}
+	if got := otherMatches(matches[:1], "products/a_full.jpg"); got != nil {
+		t.Errorf("otherMatches() of only the upload itself = %v, want nil", got)
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"math"
+
+	"github.com/buckket/go-blurhash"
+	"github.com/disintegration/imaging"
+)
+
+const lqipWidth = 16
+
+type placeholder struct {
+	BlurHash      string
+	LQIP          string
+	DominantColor string
+}
+
+// computePlaceholder derives the data the frontend renders while the real
+// image loads: a BlurHash, a tiny base64 JPEG and the dominant colour.
+func computePlaceholder(img image.Image) (placeholder, error) {
+	// BlurHash only needs a few pixels, hashing the full image is wasteful
+	small := imaging.Resize(img, 64, 0, imaging.Box)
+	if small.Bounds().Dy() > 64 {
+		small = imaging.Resize(img, 0, 64, imaging.Box)
+	}
+
+	xComp, yComp := 4, 3
+	if small.Bounds().Dy() > small.Bounds().Dx() {
+		xComp, yComp = 3, 4
+	}
+	hash, err := blurhash.Encode(xComp, yComp, small)
+	if err != nil {
+		return placeholder{}, fmt.Errorf("blurhash: %w", err)
+	}
+
+	tiny := imaging.Resize(img, lqipWidth, 0, imaging.Lanczos)
+	buf := new(bytes.Buffer)
+	if err := jpeg.Encode(buf, flattenAlpha(tiny), &jpeg.Options{Quality: 60}); err != nil {
+		return placeholder{}, fmt.Errorf("lqip: %w", err)
+	}
+
+	return placeholder{
+		BlurHash:      hash,
+		LQIP:          "data:image/jpeg;base64," + base64.StdEncoding.EncodeToString(buf.Bytes()),
+		DominantColor: dominantColor(small),
+	}, nil
+}
+
+// dominantColor buckets pixels into a 4-bit-per-channel histogram and
+// returns the average colour of the most populated bucket as #rrggbb.
+// Mostly transparent pixels are ignored.
+func dominantColor(img *image.NRGBA) string {
+	type bucket struct {
+		count   int
+		r, g, b int
+	}
+	buckets := make(map[uint16]*bucket)
+	var best *bucket
+
+	for y := 0; y < img.Bounds().Dy(); y++ {
+		row := img.Pix[y*img.Stride:]
+		for x := 0; x < img.Bounds().Dx(); x++ {
+			r, g, b, a := row[x*4], row[x*4+1], row[x*4+2], row[x*4+3]
+			if a < 128 {
+				continue
+			}
+			id := uint16(r>>4)<<8 | uint16(g>>4)<<4 | uint16(b>>4)
+			bk := buckets[id]
+			if bk == nil {
+				bk = &bucket{}
+				buckets[id] = bk
+			}
+			bk.count++
+			bk.r += int(r)
+			bk.g += int(g)
+			bk.b += int(b)
+			if best == nil || bk.count > best.count {
+				best = bk
+			}
+		}
+	}
+
+	if best == nil {
+		return "#ffffff"
+	}
+	return fmt.Sprintf("#%02x%02x%02x", best.r/best.count, best.g/best.count, best.b/best.count)
+}
+
+func aspectRatio(width, height int) float64 {
+	if height == 0 {
+		return 0
+	}
+	return math.Round(float64(width)/float64(height)*10000) / 10000
+}
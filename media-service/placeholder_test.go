@@ -0,0 +1,67 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"strings"
+	"testing"
+
+	"github.com/disintegration/imaging"
+)
+
+func TestDominantColor(t *testing.T) {
+	mostlyRed := imaging.New(10, 10, color.NRGBA{200, 10, 10, 255})
+	for x := 0; x < 3; x++ {
+		mostlyRed.Set(x, 0, color.NRGBA{0, 0, 255, 255})
+	}
+	transparentBlue := imaging.New(10, 10, color.NRGBA{0, 0, 255, 0})
+	transparentBlue.Set(5, 5, color.NRGBA{0, 255, 0, 255})
+
+	tests := []struct {
+		name string
+		img  *image.NRGBA
+		want string
+	}{
+		{name: "majority wins", img: mostlyRed, want: "#c80a0a"},
+		{name: "transparent pixels ignored", img: transparentBlue, want: "#00ff00"},
+		{name: "fully transparent", img: imaging.New(4, 4, color.NRGBA{}), want: "#ffffff"},
+	}
+	for _, tt := range tests {
+		if got := dominantColor(tt.img); got != tt.want {
+			t.Errorf("%s: dominantColor() = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestComputePlaceholder(t *testing.T) {
+	for _, size := range []image.Point{{800, 200}, {200, 800}, {1, 1}} {
+		img := imaging.New(size.X, size.Y, color.NRGBA{30, 60, 90, 255})
+		ph, err := computePlaceholder(img)
+		if err != nil {
+			t.Fatalf("%v: computePlaceholder() error = %v", size, err)
+		}
+		if ph.BlurHash == "" || !strings.HasPrefix(ph.LQIP, "data:image/jpeg;base64,") {
+			t.Errorf("%v: computePlaceholder() = %+v", size, ph)
+		}
+		if ph.DominantColor != "#1e3c5a" {
+			t.Errorf("%v: dominant colour = %q, want #1e3c5a", size, ph.DominantColor)
+		}
+	}
+}
+
+func TestAspectRatio(t *testing.T) {
+	tests := []struct {
+		width, height int
+		want          float64
+	}{
+		{1920, 1080, 1.7778},
+		{1080, 1920, 0.5625},
+		{500, 500, 1},
+		{3, 0, 0},
+	}
+	for _, tt := range tests {
+		if got := aspectRatio(tt.width, tt.height); got != tt.want {
+			t.Errorf("aspectRatio(%d, %d) = %v, want %v", tt.width, tt.height, got, tt.want)
+		}
+	}
+}
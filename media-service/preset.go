@@ -0,0 +1,406 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"time"
+)
+
+const (
+	codeUnknownPurpose = "UNKNOWN_PURPOSE"
+	codeFileTooLarge   = "FILE_TOO_LARGE"
+)
+
+// purposePreset is the upload policy for one purpose: what may be
+// uploaded, how it is processed and where the results are stored.
+type purposePreset struct {
+	Name         string
+	AllowedTypes map[string]bool
+	MaxBytes     int64
+	// Formats are the output formats a request may ask for, the first one
+	// is used when it does not
+	Formats   []outputFormat
+	Variants  []variantSpec
+	Quality   qualityPolicy
+	Watermark bool
+	// Retention deletes stored files this long after upload, zero keeps
+	// them forever
+	Retention time.Duration
+	Bucket    string
+	Prefix    string
+	Animated  bool
+	Enhance   bool
+	Gate      *qualityGate
+	// SquareCrop cuts the client's crop rectangle, or the centre square,
+	// before the variants are rendered
+	SquareCrop bool
+	// UserKey stores the files under <prefix><user id>/ so a new upload
+	// replaces the previous one, uploads then need an access token
+	UserKey bool
+	// Document converts images to deskewed, contrast normalised grayscale
+	Document bool
+	// Private files live in the private bucket and are only handed out as
+	// expiring signed links
+	Private bool
+}
+
+// presetFile is the JSON layout of MEDIA_PRESETS_FILE, keyed by purpose.
+type presetFile map[string]presetFileEntry
+
+// presetFileEntry fields left out keep the built-in value for that
+// purpose, or the plain preset's for new purposes.
+type presetFileEntry struct {
+	AllowedTypes  []string           `json:"allowed_types"`
+	MaxSizeMB     *int               `json:"max_size_mb"`
+	Formats       []string           `json:"formats"`
+	Variants      []string           `json:"variants"`
+	Quality       *presetFileQuality `json:"quality"`
+	Watermark     *bool              `json:"watermark"`
+	RetentionDays *int               `json:"retention_days"`
+	Bucket        *string            `json:"bucket"`
+	Prefix        *string            `json:"prefix"`
+	Animated      *bool              `json:"animated"`
+	Enhance       *bool              `json:"enhance"`
+	QualityGate   *string            `json:"quality_gate"`
+	SquareCrop    *bool              `json:"square_crop"`
+	PerUserKey    *bool              `json:"per_user_key"`
+	Document      *bool              `json:"document"`
+	Private       *bool              `json:"private"`
+}
+
+type presetFileQuality struct {
+	Default   *int           `json:"default"`
+	Min       *int           `json:"min"`
+	Max       *int           `json:"max"`
+	BudgetsKB map[string]int `json:"budgets_kb"`
+}
+
+// loadPresets builds the built-in presets from the environment and, when
+// MEDIA_PRESETS_FILE is set, applies the file on top. Only purposes in the
+// result are accepted by the upload endpoints.
+func loadPresets(wm *watermark) (map[string]*purposePreset, error) {
+	presets, plain, err := builtinPresets(wm)
+	if err != nil {
+		return nil, err
+	}
+
+	path := os.Getenv("MEDIA_PRESETS_FILE")
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("MEDIA_PRESETS_FILE: %w", err)
+		}
+		// Unknown fields are most likely typos that would silently fall
+		// back to a default
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.DisallowUnknownFields()
+		var file presetFile
+		if err := dec.Decode(&file); err != nil {
+			return nil, fmt.Errorf("MEDIA_PRESETS_FILE: %w", err)
+		}
+		for name, entry := range file {
+			base, ok := presets[name]
+			if !ok {
+				base = plain
+			}
+			p := *base
+			p.Name = name
+			if err := p.apply(entry); err != nil {
+				return nil, fmt.Errorf("preset %q: %w", name, err)
+			}
+			if p.Private && entry.Bucket == nil {
+				p.Bucket = os.Getenv("SUPABASE_PRIVATE_BUCKET")
+			}
+			// New purposes get their own prefix unless the file says
+			// otherwise, an empty one stores at the bucket root
+			if !ok && entry.Prefix == nil {
+				p.Prefix = name + "/"
+			}
+			presets[name] = &p
+		}
+	}
+
+	for name, p := range presets {
+		if err := p.validate(wm, os.Getenv("SUPABASE_PRIVATE_BUCKET")); err != nil {
+			return nil, fmt.Errorf("preset %q: %w", name, err)
+		}
+	}
+	return presets, nil
+}
+
+// builtinPresets reproduces the environment driven behaviour for the four
+// built-in purposes. It also returns the plain preset, shaped only by the
+// environment, that new purposes in the presets file start from.
+func builtinPresets(wm *watermark) (map[string]*purposePreset, *purposePreset, error) {
+	variants, err := loadVariantSpecs()
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid MEDIA_VARIANTS: %w", err)
+	}
+	defaultFormat, err := defaultOutputFormat()
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid MEDIA_OUTPUT_FORMAT: %w", err)
+	}
+	quality, err := loadQualityPolicy(variants)
+	if err != nil {
+		return nil, nil, err
+	}
+	maxSizeMB, err := envInt("MEDIA_MAX_UPLOAD_MB", 20)
+	if err != nil {
+		return nil, nil, err
+	}
+	allowedTypes, err := loadAllowedTypes()
+	if err != nil {
+		return nil, nil, err
+	}
+	animated, err := loadAnimatedPurposes()
+	if err != nil {
+		return nil, nil, err
+	}
+	enhance, err := loadEnhancePurposes()
+	if err != nil {
+		return nil, nil, err
+	}
+	gates, err := loadQualityGates()
+	if err != nil {
+		return nil, nil, err
+	}
+	avatarVariants, err := parseVariantList(strings.Split(defaultAvatarVariants, ","))
+	if err != nil {
+		return nil, nil, err
+	}
+	documentVariants, err := parseVariantList(strings.Split(defaultDocumentVariants, ","))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Every format is allowed, the configured default goes first
+	formats := []outputFormat{defaultFormat}
+	for _, f := range []outputFormat{formatAuto, formatJPEG, formatPNG, formatWebP} {
+		if f == formatWebP && !webpSupported {
+			continue
+		}
+		if f != defaultFormat {
+			formats = append(formats, f)
+		}
+	}
+
+	privateBucket := os.Getenv("SUPABASE_PRIVATE_BUCKET")
+	if privateBucket == "" {
+		return nil, nil, fmt.Errorf("SUPABASE_PRIVATE_BUCKET is required to keep receipts and shipping documents private")
+	}
+	plainTypes, err := parseAllowedTypes(strings.Split(defaultAllowedTypes, ","))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	plain := &purposePreset{
+		AllowedTypes: plainTypes,
+		MaxBytes:     int64(maxSizeMB) << 20,
+		Formats:      formats,
+		Variants:     variants,
+		Quality:      quality,
+		Bucket:       os.Getenv("SUPABASE_BUCKET"),
+	}
+
+	presets := make(map[string]*purposePreset)
+	for _, purpose := range builtinPurposes {
+		p := *plain
+		p.Name = purpose
+		p.AllowedTypes = allowedTypes[purpose]
+		p.Animated = animated[purpose]
+		p.Enhance = enhance[purpose]
+		p.Gate = gates[purpose]
+		presets[purpose] = &p
+	}
+
+	// Product files used to be stored at the bucket root, those keys still
+	// resolve since lookups do not depend on the prefix
+	product := presets[purposeProduct]
+	product.Prefix = "products/"
+	product.Watermark = wm != nil
+
+	// Avatars are square per-user files in their own sizes, budgets set for
+	// the listing variants do not apply to them
+	avatar := presets[purposeAvatar]
+	avatar.Variants = avatarVariants
+	avatar.Quality.Budgets = nil
+	avatar.Prefix = "avatars/"
+	avatar.SquareCrop = true
+	avatar.UserKey = true
+
+	// Receipts and shipping photos are read for reference numbers, so they
+	// keep more pixels. Bank details and addresses on them stay private.
+	for purpose, prefix := range map[string]string{purposeReceipt: "receipts/", purposeShipping: "shipping/"} {
+		doc := presets[purpose]
+		doc.Variants = documentVariants
+		doc.Quality.Budgets = nil
+		doc.Bucket = privateBucket
+		doc.Prefix = prefix
+		doc.Document = true
+		doc.Private = true
+	}
+	return presets, plain, nil
+}
+
+func (p *purposePreset) apply(entry presetFileEntry) error {
+	var err error
+	if entry.AllowedTypes != nil {
+		if p.AllowedTypes, err = parseAllowedTypes(entry.AllowedTypes); err != nil {
+			return fmt.Errorf("allowed_types: %w", err)
+		}
+	}
+	if entry.MaxSizeMB != nil {
+		p.MaxBytes = int64(*entry.MaxSizeMB) << 20
+	}
+	if entry.Formats != nil {
+		p.Formats = nil
+		for _, f := range entry.Formats {
+			format, err := parseOutputFormat(f)
+			if err != nil {
+				return fmt.Errorf("formats: %w", err)
+			}
+			p.Formats = append(p.Formats, format)
+		}
+	}
+	if entry.Variants != nil {
+		if p.Variants, err = parseVariantList(entry.Variants); err != nil {
+			return fmt.Errorf("variants: %w", err)
+		}
+		// Budgets belong to the variants they were set for
+		p.Quality.Budgets = nil
+	}
+	if q := entry.Quality; q != nil {
+		if q.Default != nil {
+			p.Quality.Default = *q.Default
+		}
+		if q.Min != nil {
+			p.Quality.Min = *q.Min
+		}
+		if q.Max != nil {
+			p.Quality.Max = *q.Max
+		}
+		if q.BudgetsKB != nil {
+			p.Quality.Budgets = make(map[string]int)
+			for name, kb := range q.BudgetsKB {
+				p.Quality.Budgets[name] = kb * 1024
+			}
+		}
+	}
+	if entry.Watermark != nil {
+		p.Watermark = *entry.Watermark
+	}
+	if entry.RetentionDays != nil {
+		p.Retention = time.Duration(*entry.RetentionDays) * 24 * time.Hour
+	}
+	if entry.Bucket != nil {
+		p.Bucket = *entry.Bucket
+	}
+	if entry.Prefix != nil {
+		p.Prefix = strings.Trim(*entry.Prefix, "/")
+		if p.Prefix != "" {
+			p.Prefix += "/"
+		}
+	}
+	if entry.Animated != nil {
+		p.Animated = *entry.Animated
+	}
+	if entry.Enhance != nil {
+		p.Enhance = *entry.Enhance
+	}
+	if entry.SquareCrop != nil {
+		p.SquareCrop = *entry.SquareCrop
+	}
+	if entry.PerUserKey != nil {
+		p.UserKey = *entry.PerUserKey
+	}
+	if entry.Document != nil {
+		p.Document = *entry.Document
+	}
+	if entry.Private != nil {
+		p.Private = *entry.Private
+	}
+	if entry.QualityGate != nil {
+		p.Gate = nil
+		if spec := *entry.QualityGate; spec != "" && spec != "off" {
+			if p.Gate, err = parseQualityGate(spec); err != nil {
+				return fmt.Errorf("quality_gate: %w", err)
+			}
+		}
+	}
+	return nil
+}
+
+// validate checks the preset is usable so mistakes in the presets file
+// stop the service at startup rather than failing uploads.
+func (p *purposePreset) validate(wm *watermark, privateBucket string) error {
+	if p.MaxBytes <= 0 {
+		return fmt.Errorf("max_size_mb must be positive")
+	}
+	if len(p.Formats) == 0 {
+		return fmt.Errorf("at least one output format is required")
+	}
+	if len(p.Variants) == 0 {
+		return fmt.Errorf("at least one variant is required")
+	}
+	if err := p.Quality.validate(p.Variants); err != nil {
+		return fmt.Errorf("quality: %w", err)
+	}
+	if p.Watermark && wm == nil {
+		return fmt.Errorf("watermark needs MEDIA_WATERMARK_IMAGE or MEDIA_WATERMARK_TEXT")
+	}
+	if p.Retention < 0 {
+		return fmt.Errorf("retention_days must not be negative")
+	}
+	if p.Retention > 0 && p.Prefix == "" {
+		return fmt.Errorf("retention needs a prefix so other files in the bucket are never swept")
+	}
+	if p.UserKey && p.Prefix == "" {
+		return fmt.Errorf("per_user_key needs a prefix so user ids do not clash with other files")
+	}
+	if p.SquareCrop && p.Animated {
+		return fmt.Errorf("square_crop cannot be combined with animated")
+	}
+	if p.Document && p.Animated {
+		return fmt.Errorf("document cannot be combined with animated")
+	}
+	if p.Bucket == "" {
+		return fmt.Errorf("bucket is required")
+	}
+	// Files in the private bucket can only be reached through signed links
+	if p.Private != (p.Bucket == privateBucket) {
+		return fmt.Errorf("private purposes, and only those, must use the private bucket")
+	}
+	if p.Private && p.UserKey {
+		return fmt.Errorf("private cannot be combined with per_user_key")
+	}
+	if slices.Contains(strings.Split(p.Prefix, "/"), "..") {
+		return fmt.Errorf("prefix must not contain ..")
+	}
+	return nil
+}
+
+// allowsFormat reports whether a request may ask for f.
+func (p *purposePreset) allowsFormat(f outputFormat) bool {
+	return slices.Contains(p.Formats, f)
+}
+
+func unknownPurpose(purpose string) error {
+	return &uploadError{
+		Status:  http.StatusBadRequest,
+		Code:    codeUnknownPurpose,
+		Message: fmt.Sprintf("Unknown upload purpose %q", purpose),
+	}
+}
+
+func fileTooLarge(size, maxBytes int64) error {
+	return &uploadError{
+		Status:  http.StatusRequestEntityTooLarge,
+		Code:    codeFileTooLarge,
+		Message: fmt.Sprintf("File is %d bytes, the maximum is %d", size, maxBytes),
+	}
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// presetEnv clears the environment the built-in presets are read from and
+// sets the buckets they need.
+func presetEnv(t *testing.T) {
+	for _, name := range []string{
+		"MEDIA_VARIANTS", "MEDIA_OUTPUT_FORMAT", "MEDIA_QUALITY_MIN", "MEDIA_QUALITY_MAX",
+		"MEDIA_VARIANT_BUDGETS", "MEDIA_MAX_UPLOAD_MB", "MEDIA_ANIMATED_PURPOSES",
+		"MEDIA_ENHANCE_PURPOSES", "MEDIA_PRESETS_FILE",
+	} {
+		t.Setenv(name, "")
+	}
+	for _, purpose := range builtinPurposes {
+		t.Setenv("MEDIA_ALLOWED_TYPES_"+strings.ToUpper(purpose), "")
+		t.Setenv("MEDIA_QUALITY_GATE_"+strings.ToUpper(purpose), "")
+	}
+	t.Setenv("SUPABASE_BUCKET", "public")
+	t.Setenv("SUPABASE_PRIVATE_BUCKET", "private")
+}
+
+// presetsFile writes content to a presets file and points
+// MEDIA_PRESETS_FILE at it.
+func presetsFile(t *testing.T, content string) {
+	path := filepath.Join(t.TempDir(), "presets.json")
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("MEDIA_PRESETS_FILE", path)
+}
+
+func TestBuiltinPresets(t *testing.T) {
+	presetEnv(t)
+	presets, err := loadPresets(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(presets) != len(builtinPurposes) {
+		t.Fatalf("loadPresets() = %d presets, want %d", len(presets), len(builtinPurposes))
+	}
+
+	tests := []struct {
+		purpose string
+		bucket  string
+		prefix  string
+		private bool
+	}{
+		{purpose: purposeProduct, bucket: "public", prefix: "products/"},
+		{purpose: purposeAvatar, bucket: "public", prefix: "avatars/"},
+		{purpose: purposeReceipt, bucket: "private", prefix: "receipts/", private: true},
+		{purpose: purposeShipping, bucket: "private", prefix: "shipping/", private: true},
+	}
+	for _, tt := range tests {
+		p := presets[tt.purpose]
+		if p.Name != tt.purpose || p.Bucket != tt.bucket || p.Prefix != tt.prefix || p.Private != tt.private {
+			t.Errorf("%s preset = %s in %s/%s, private %v", tt.purpose, p.Name, p.Bucket, p.Prefix, p.Private)
+		}
+	}
+	if !presets[purposeReceipt].AllowedTypes["application/pdf"] || presets[purposeProduct].AllowedTypes["application/pdf"] {
+		t.Error("only receipts should take PDFs by default")
+	}
+	if presets[purposeProduct].Watermark || presets[purposeProduct].Gate == nil {
+		t.Errorf("product preset: watermark %v, gate %v", presets[purposeProduct].Watermark, presets[purposeProduct].Gate)
+	}
+
+	t.Setenv("SUPABASE_PRIVATE_BUCKET", "")
+	if _, err := loadPresets(nil); err == nil {
+		t.Error("loadPresets() accepted a missing private bucket")
+	}
+}
+
+func TestLoadPresetsFile(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string
+		wantErr bool
+		check   func(t *testing.T, presets map[string]*purposePreset)
+	}{
+		{
+			name: "new purpose starts from the plain preset",
+			file: `{"banner": {"variants": ["wide:1600x400:cover"], "prefix": "/banners/", "retention_days": 30}}`,
+			check: func(t *testing.T, presets map[string]*purposePreset) {
+				p := presets["banner"]
+				if p == nil || p.Name != "banner" || p.Prefix != "banners/" || p.Retention != 30*24*time.Hour {
+					t.Fatalf("banner preset = %+v", p)
+				}
+				if len(p.Variants) != 1 || p.Variants[0].Height != 400 || p.Bucket != "public" {
+					t.Errorf("banner variants = %+v in %s", p.Variants, p.Bucket)
+				}
+				if len(presets) != len(builtinPurposes)+1 {
+					t.Errorf("loadPresets() = %d presets", len(presets))
+				}
+			},
+		},
+		{
+			name: "new purpose is stored under its name",
+			file: `{"banner": {}, "legacy": {"prefix": ""}}`,
+			check: func(t *testing.T, presets map[string]*purposePreset) {
+				if presets["banner"].Prefix != "banner/" || presets["legacy"].Prefix != "" {
+					t.Errorf("prefixes = %q and %q", presets["banner"].Prefix, presets["legacy"].Prefix)
+				}
+			},
+		},
+		{
+			name: "built-in purpose keeps fields left out",
+			file: `{"avatar": {"max_size_mb": 2, "quality_gate": "off"}}`,
+			check: func(t *testing.T, presets map[string]*purposePreset) {
+				p := presets[purposeAvatar]
+				if p.MaxBytes != 2<<20 || p.Prefix != "avatars/" || !p.UserKey || !p.SquareCrop {
+					t.Errorf("avatar preset = %+v", p)
+				}
+			},
+		},
+		{
+			name: "private purpose defaults to the private bucket",
+			file: `{"invoice": {"private": true, "prefix": "invoices"}}`,
+			check: func(t *testing.T, presets map[string]*purposePreset) {
+				if p := presets["invoice"]; p.Bucket != "private" || p.Prefix != "invoices/" {
+					t.Errorf("invoice preset in %s/%s", p.Bucket, p.Prefix)
+				}
+			},
+		},
+		{name: "unknown field", file: `{"banner": {"max_size": 2}}`, wantErr: true},
+		{name: "not json", file: `banner: {}`, wantErr: true},
+		{name: "bad variant", file: `{"banner": {"variants": ["wide"]}}`, wantErr: true},
+		{name: "bad type", file: `{"banner": {"allowed_types": ["text/html"]}}`, wantErr: true},
+		{name: "bad format", file: `{"banner": {"formats": ["bmp"]}}`, wantErr: true},
+		{name: "bad gate", file: `{"banner": {"quality_gate": "blur=-1"}}`, wantErr: true},
+		{name: "invalid preset", file: `{"banner": {"retention_days": 7, "prefix": "/"}}`, wantErr: true},
+		{name: "watermark without one configured", file: `{"product": {"watermark": true}}`, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			presetEnv(t)
+			presetsFile(t, tt.file)
+			presets, err := loadPresets(nil)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("loadPresets() accepted the file")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("loadPresets() error = %v", err)
+			}
+			tt.check(t, presets)
+		})
+	}
+
+	presetEnv(t)
+	t.Setenv("MEDIA_PRESETS_FILE", filepath.Join(t.TempDir(), "missing.json"))
+	if _, err := loadPresets(nil); err == nil {
+		t.Error("loadPresets() accepted a missing file")
+	}
+}
+
+func TestPresetApplyVariantsDropBudgets(t *testing.T) {
+	p := purposePreset{Quality: qualityPolicy{Budgets: map[string]int{"thumb": 1024}}}
+	if err := p.apply(presetFileEntry{Variants: []string{"small:100"}}); err != nil {
+		t.Fatal(err)
+	}
+	if p.Quality.Budgets != nil {
+		t.Errorf("apply() kept budgets %v for replaced variants", p.Quality.Budgets)
+	}
+
+	kb := map[string]int{"small": 10}
+	if err := p.apply(presetFileEntry{Quality: &presetFileQuality{BudgetsKB: kb}}); err != nil {
+		t.Fatal(err)
+	}
+	if p.Quality.Budgets["small"] != 10<<10 {
+		t.Errorf("apply() budgets = %v, want 10 KB for small", p.Quality.Budgets)
+	}
+}
+
+func TestPresetValidate(t *testing.T) {
+	valid := func() purposePreset {
+		return purposePreset{
+			MaxBytes: 1 << 20,
+			Formats:  []outputFormat{formatJPEG},
+			Variants: []variantSpec{{Name: "thumb", Width: 200}},
+			Quality:  qualityPolicy{Default: 80, Min: 40, Max: 90},
+			Bucket:   "public",
+			Prefix:   "files/",
+		}
+	}
+	tests := []struct {
+		name    string
+		change  func(p *purposePreset)
+		wantErr bool
+	}{
+		{name: "valid", change: func(p *purposePreset) {}},
+		{name: "private", change: func(p *purposePreset) { p.Private, p.Bucket = true, "private" }},
+		{name: "no size", change: func(p *purposePreset) { p.MaxBytes = 0 }, wantErr: true},
+		{name: "no formats", change: func(p *purposePreset) { p.Formats = nil }, wantErr: true},
+		{name: "no variants", change: func(p *purposePreset) { p.Variants = nil }, wantErr: true},
+		{name: "bad quality", change: func(p *purposePreset) { p.Quality.Min = 95 }, wantErr: true},
+		{name: "watermark", change: func(p *purposePreset) { p.Watermark = true }, wantErr: true},
+		{name: "negative retention", change: func(p *purposePreset) { p.Retention = -time.Hour }, wantErr: true},
+		{name: "retention at the root", change: func(p *purposePreset) { p.Retention, p.Prefix = time.Hour, "" }, wantErr: true},
+		{name: "user key at the root", change: func(p *purposePreset) { p.UserKey, p.Prefix = true, "" }, wantErr: true},
+		{name: "animated square", change: func(p *purposePreset) { p.Animated, p.SquareCrop = true, true }, wantErr: true},
+		{name: "animated document", change: func(p *purposePreset) { p.Animated, p.Document = true, true }, wantErr: true},
+		{name: "no bucket", change: func(p *purposePreset) { p.Bucket = "" }, wantErr: true},
+		{name: "public in private bucket", change: func(p *purposePreset) { p.Bucket = "private" }, wantErr: true},
+		{name: "private in public bucket", change: func(p *purposePreset) { p.Private = true }, wantErr: true},
+		{name: "private user key", change: func(p *purposePreset) { p.Private, p.Bucket, p.UserKey = true, "private", true }, wantErr: true},
+		{name: "prefix escapes", change: func(p *purposePreset) { p.Prefix = "files/../" }, wantErr: true},
+	}
+	for _, tt := range tests {
+		p := valid()
+		tt.change(&p)
+		if err := p.validate(nil, "private"); (err != nil) != tt.wantErr {
+			t.Errorf("%s: validate() error = %v, want error %v", tt.name, err, tt.wantErr)
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const defaultQuality = 80
+
+// qualityPolicy controls lossy encoding of variants. Variants with a byte
+// budget get the highest quality in [Min, Max] that fits the budget, the
+// others are encoded at Default.
+type qualityPolicy struct {
+	Default int
+	Min     int
+	Max     int
+	Budgets map[string]int
+}
+
+// validate checks the ranges and that every budget names one of variants.
+func (p qualityPolicy) validate(variants []variantSpec) error {
+	if p.Default < 1 || p.Default > 100 {
+		return fmt.Errorf("default quality must be between 1 and 100")
+	}
+	if p.Min < 1 || p.Max > 100 || p.Min > p.Max {
+		return fmt.Errorf("quality range must satisfy 1 <= min <= max <= 100")
+	}
+	known := make(map[string]bool)
+	for _, v := range variants {
+		known[v.Name] = true
+	}
+	for name, budget := range p.Budgets {
+		if !known[name] {
+			return fmt.Errorf("budget for unknown variant %q", name)
+		}
+		if budget <= 0 {
+			return fmt.Errorf("budget for variant %q must be positive", name)
+		}
+	}
+	return nil
+}
+
+// loadQualityPolicy reads MEDIA_VARIANT_BUDGETS as a comma separated list
+// of name:kilobytes, e.g. "thumb:20,medium:150", and the search range from
+// MEDIA_QUALITY_MIN / MEDIA_QUALITY_MAX.
+func loadQualityPolicy(variants []variantSpec) (qualityPolicy, error) {
+	minQ, err := envInt("MEDIA_QUALITY_MIN", 40)
+	if err != nil {
+		return qualityPolicy{}, err
+	}
+	maxQ, err := envInt("MEDIA_QUALITY_MAX", 90)
+	if err != nil {
+		return qualityPolicy{}, err
+	}
+
+	budgets := make(map[string]int)
+	for _, entry := range strings.Split(os.Getenv("MEDIA_VARIANT_BUDGETS"), ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		name, kb, ok := strings.Cut(entry, ":")
+		n, err := strconv.Atoi(kb)
+		if !ok || err != nil || n <= 0 {
+			return qualityPolicy{}, fmt.Errorf("invalid MEDIA_VARIANT_BUDGETS entry %q, expected name:kilobytes", entry)
+		}
+		budgets[name] = n * 1024
+	}
+
+	policy := qualityPolicy{Default: defaultQuality, Min: minQ, Max: maxQ, Budgets: budgets}
+	if err := policy.validate(variants); err != nil {
+		return qualityPolicy{}, fmt.Errorf("MEDIA_QUALITY_MIN/MAX or MEDIA_VARIANT_BUDGETS: %w", err)
+	}
+	return policy, nil
+}
+
+// encodeWithinBudget binary searches the quality for the largest output
+// that is at most maxBytes. When even the minimum quality is too big the
+// minimum is used anyway, a slightly oversized image beats a failed upload.
+// PNG is lossless and is encoded once without a quality.
+func encodeWithinBudget(img image.Image, f outputFormat, maxBytes int, p qualityPolicy) (*bytes.Buffer, int, error) {
+	if f == formatPNG {
+		buf := new(bytes.Buffer)
+		return buf, 0, encodeImage(buf, img, f, 0)
+	}
+
+	var best *bytes.Buffer
+	bestQuality := p.Min
+	lo, hi := p.Min, p.Max
+	for lo <= hi {
+		q := (lo + hi) / 2
+		buf := new(bytes.Buffer)
+		if err := encodeImage(buf, img, f, q); err != nil {
+			return nil, 0, err
+		}
+		if buf.Len() <= maxBytes {
+			best, bestQuality = buf, q
+			lo = q + 1
+		} else {
+			hi = q - 1
+		}
+	}
+
+	if best == nil {
+		best = new(bytes.Buffer)
+		if err := encodeImage(best, img, f, p.Min); err != nil {
+			return nil, 0, err
+		}
+	}
+	return best, bestQuality, nil
+}
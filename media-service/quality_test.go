@@ -0,0 +1,117 @@
+package main
+
+import (
+	"image"
+	"reflect"
+	"testing"
+)
+
+func TestLoadQualityPolicy(t *testing.T) {
+	variants := []variantSpec{{Name: "thumb", Width: 200}, {Name: "large", Width: 1024}}
+
+	tests := []struct {
+		name     string
+		min, max string
+		budgets  string
+		want     qualityPolicy
+		wantErr  bool
+	}{
+		{
+			name: "defaults",
+			want: qualityPolicy{Default: defaultQuality, Min: 40, Max: 90, Budgets: map[string]int{}},
+		},
+		{
+			name:    "budgets in kilobytes",
+			min:     "30",
+			max:     "95",
+			budgets: " thumb:20 ,large:150,",
+			want:    qualityPolicy{Default: defaultQuality, Min: 30, Max: 95, Budgets: map[string]int{"thumb": 20 << 10, "large": 150 << 10}},
+		},
+		{name: "min above max", min: "90", max: "40", wantErr: true},
+		{name: "max above 100", max: "101", wantErr: true},
+		{name: "min zero", min: "0", wantErr: true},
+		{name: "unknown variant", budgets: "huge:100", wantErr: true},
+		{name: "missing size", budgets: "thumb", wantErr: true},
+		{name: "zero size", budgets: "thumb:0", wantErr: true},
+		{name: "size not a number", budgets: "thumb:20kb", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("MEDIA_QUALITY_MIN", tt.min)
+			t.Setenv("MEDIA_QUALITY_MAX", tt.max)
+			t.Setenv("MEDIA_VARIANT_BUDGETS", tt.budgets)
+			got, err := loadQualityPolicy(variants)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("loadQualityPolicy() = %+v, want error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("loadQualityPolicy() error = %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("loadQualityPolicy() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestQualityPolicyValidate(t *testing.T) {
+	variants := []variantSpec{{Name: "thumb"}}
+	tests := []struct {
+		name    string
+		policy  qualityPolicy
+		wantErr bool
+	}{
+		{name: "valid", policy: qualityPolicy{Default: 80, Min: 40, Max: 90, Budgets: map[string]int{"thumb": 1}}},
+		{name: "single quality", policy: qualityPolicy{Default: 1, Min: 100, Max: 100}},
+		{name: "default too high", policy: qualityPolicy{Default: 101, Min: 40, Max: 90}, wantErr: true},
+		{name: "default zero", policy: qualityPolicy{Default: 0, Min: 40, Max: 90}, wantErr: true},
+		{name: "negative budget", policy: qualityPolicy{Default: 80, Min: 40, Max: 90, Budgets: map[string]int{"thumb": -1}}, wantErr: true},
+	}
+	for _, tt := range tests {
+		if err := tt.policy.validate(variants); (err != nil) != tt.wantErr {
+			t.Errorf("%s: validate() error = %v, want error %v", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+func TestEncodeWithinBudget(t *testing.T) {
+	// Noise compresses badly, so the size depends a lot on the quality
+	img := image.NewNRGBA(image.Rect(0, 0, 64, 64))
+	seed := uint32(1)
+	for i := range img.Pix {
+		seed = seed*1664525 + 1013904223
+		img.Pix[i] = uint8(seed >> 24)
+	}
+	for i := 3; i < len(img.Pix); i += 4 {
+		img.Pix[i] = 255
+	}
+	policy := qualityPolicy{Default: 80, Min: 10, Max: 95}
+
+	huge, quality, err := encodeWithinBudget(img, formatJPEG, 1<<20, policy)
+	if err != nil || quality != policy.Max {
+		t.Errorf("roomy budget: quality = %d, %v, want %d", quality, err, policy.Max)
+	}
+
+	budget := huge.Len() / 2
+	buf, quality, err := encodeWithinBudget(img, formatJPEG, budget, policy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if buf.Len() > budget || quality <= policy.Min || quality >= policy.Max {
+		t.Errorf("half budget: %d bytes at quality %d, budget %d", buf.Len(), quality, budget)
+	}
+
+	// Too small for any quality, the minimum is used anyway
+	buf, quality, err = encodeWithinBudget(img, formatJPEG, 10, policy)
+	if err != nil || quality != policy.Min || buf.Len() == 0 {
+		t.Errorf("tiny budget: %d bytes at quality %d, %v, want quality %d", buf.Len(), quality, err, policy.Min)
+	}
+
+	buf, quality, err = encodeWithinBudget(image.NewRGBA(image.Rect(0, 0, 8, 8)), formatPNG, 10, policy)
+	if err != nil || quality != 0 || buf.Len() == 0 {
+		t.Errorf("png: %d bytes at quality %d, %v, want quality 0", buf.Len(), quality, err)
+	}
+}
@@ -0,0 +1,345 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// fakeRedis speaks enough of the Redis protocol for the commands this
+// service sends: strings with expiry, hashes, sets, sorted set scores and
+// MULTI/EXEC. It keeps tests that go through Redis self-contained.
+type fakeRedis struct {
+	mu      sync.Mutex
+	strs    map[string]string
+	expires map[string]time.Time
+	hashes  map[string]map[string]string
+	sets    map[string]map[string]bool
+	zsets   map[string]map[string]float64
+}
+
+// Replies are written by type: simple strings, errors, integers, bulk
+// strings (nil for a missing value) and arrays.
+type (
+	respSimple string
+	respError  string
+	respBulk   *string
+)
+
+// testRedis starts a fake Redis server for the test and returns a client
+// connected to it.
+func testRedis(t *testing.T) (*redis.Client, *fakeRedis) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeRedis{
+		strs:    make(map[string]string),
+		expires: make(map[string]time.Time),
+		hashes:  make(map[string]map[string]string),
+		sets:    make(map[string]map[string]bool),
+		zsets:   make(map[string]map[string]float64),
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go f.serve(conn)
+		}
+	}()
+
+	rdb := redis.NewClient(&redis.Options{Addr: ln.Addr().String(), Protocol: 2, DisableIdentity: true})
+	t.Cleanup(func() {
+		rdb.Close()
+		ln.Close()
+	})
+	return rdb, f
+}
+
+func (f *fakeRedis) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	w := bufio.NewWriter(conn)
+	var queued [][]string
+	inMulti := false
+	for {
+		args, err := readCommand(r)
+		if err != nil {
+			return
+		}
+		var reply any
+		switch name := strings.ToUpper(args[0]); {
+		case name == "MULTI":
+			inMulti, queued = true, nil
+			reply = respSimple("OK")
+		case name == "EXEC":
+			replies := make([]any, len(queued))
+			f.mu.Lock()
+			for i, cmd := range queued {
+				replies[i] = f.exec(cmd)
+			}
+			f.mu.Unlock()
+			inMulti, queued = false, nil
+			reply = replies
+		case name == "DISCARD":
+			inMulti, queued = false, nil
+			reply = respSimple("OK")
+		case inMulti:
+			queued = append(queued, args)
+			reply = respSimple("QUEUED")
+		default:
+			f.mu.Lock()
+			reply = f.exec(args)
+			f.mu.Unlock()
+		}
+		writeReply(w, reply)
+		if err := w.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+func readCommand(r *bufio.Reader) ([]string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(line, "*")))
+	if err != nil || n < 1 {
+		return nil, fmt.Errorf("bad command header %q", line)
+	}
+	args := make([]string, n)
+	for i := range args {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		size, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(line, "$")))
+		if err != nil {
+			return nil, fmt.Errorf("bad argument header %q", line)
+		}
+		buf := make([]byte, size+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		args[i] = string(buf[:size])
+	}
+	return args, nil
+}
+
+func writeReply(w *bufio.Writer, reply any) {
+	switch v := reply.(type) {
+	case respSimple:
+		fmt.Fprintf(w, "+%s\r\n", v)
+	case respError:
+		fmt.Fprintf(w, "-%s\r\n", v)
+	case int:
+		fmt.Fprintf(w, ":%d\r\n", v)
+	case respBulk:
+		if v == nil {
+			w.WriteString("$-1\r\n")
+		} else {
+			fmt.Fprintf(w, "$%d\r\n%s\r\n", len(*v), *v)
+		}
+	case []any:
+		fmt.Fprintf(w, "*%d\r\n", len(v))
+		for _, item := range v {
+			writeReply(w, item)
+		}
+	}
+}
+
+func bulk(s string) respBulk {
+	return &s
+}
+
+// expire drops key once its TTL has passed.
+func (f *fakeRedis) expire(key string) {
+	if at, ok := f.expires[key]; ok && !time.Now().Before(at) {
+		f.del(key)
+	}
+}
+
+func (f *fakeRedis) del(key string) bool {
+	_, s := f.strs[key]
+	_, h := f.hashes[key]
+	_, st := f.sets[key]
+	_, z := f.zsets[key]
+	delete(f.strs, key)
+	delete(f.expires, key)
+	delete(f.hashes, key)
+	delete(f.sets, key)
+	delete(f.zsets, key)
+	return s || h || st || z
+}
+
+// SetHas reports whether a set holds member, for assertions.
+func (f *fakeRedis) SetHas(key, member string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.sets[key][member]
+}
+
+func (f *fakeRedis) exec(args []string) any {
+	name := strings.ToUpper(args[0])
+	if len(args) > 1 {
+		f.expire(args[1])
+	}
+	switch name {
+	case "PING":
+		return respSimple("PONG")
+	case "SET":
+		key := args[1]
+		f.del(key)
+		f.strs[key] = args[2]
+		for i := 3; i+1 < len(args); i += 2 {
+			n, _ := strconv.ParseInt(args[i+1], 10, 64)
+			switch strings.ToUpper(args[i]) {
+			case "EX":
+				f.expires[key] = time.Now().Add(time.Duration(n) * time.Second)
+			case "PX":
+				f.expires[key] = time.Now().Add(time.Duration(n) * time.Millisecond)
+			}
+		}
+		return respSimple("OK")
+	case "GET", "GETDEL":
+		v, ok := f.strs[args[1]]
+		if !ok {
+			return respBulk(nil)
+		}
+		if name == "GETDEL" {
+			f.del(args[1])
+		}
+		return bulk(v)
+	case "PTTL":
+		if _, ok := f.strs[args[1]]; !ok {
+			return -2
+		}
+		at, ok := f.expires[args[1]]
+		if !ok {
+			return -1
+		}
+		return int(time.Until(at).Milliseconds())
+	case "DEL":
+		n := 0
+		for _, key := range args[1:] {
+			f.expire(key)
+			if f.del(key) {
+				n++
+			}
+		}
+		return n
+	case "HSET":
+		h := f.hashes[args[1]]
+		if h == nil {
+			h = make(map[string]string)
+			f.hashes[args[1]] = h
+		}
+		n := 0
+		for i := 2; i+1 < len(args); i += 2 {
+			if _, ok := h[args[i]]; !ok {
+				n++
+			}
+			h[args[i]] = args[i+1]
+		}
+		return n
+	case "HGET":
+		v, ok := f.hashes[args[1]][args[2]]
+		if !ok {
+			return respBulk(nil)
+		}
+		return bulk(v)
+	case "HMGET":
+		values := make([]any, 0, len(args)-2)
+		for _, field := range args[2:] {
+			if v, ok := f.hashes[args[1]][field]; ok {
+				values = append(values, bulk(v))
+			} else {
+				values = append(values, respBulk(nil))
+			}
+		}
+		return values
+	case "HDEL":
+		n := 0
+		for _, field := range args[2:] {
+			if _, ok := f.hashes[args[1]][field]; ok {
+				delete(f.hashes[args[1]], field)
+				n++
+			}
+		}
+		return n
+	case "SADD":
+		s := f.sets[args[1]]
+		if s == nil {
+			s = make(map[string]bool)
+			f.sets[args[1]] = s
+		}
+		n := 0
+		for _, m := range args[2:] {
+			if !s[m] {
+				s[m] = true
+				n++
+			}
+		}
+		return n
+	case "SREM":
+		n := 0
+		for _, m := range args[2:] {
+			if f.sets[args[1]][m] {
+				delete(f.sets[args[1]], m)
+				n++
+			}
+		}
+		return n
+	case "SMEMBERS":
+		members := []any{}
+		for m := range f.sets[args[1]] {
+			members = append(members, bulk(m))
+		}
+		return members
+	case "ZADD":
+		z := f.zsets[args[1]]
+		if z == nil {
+			z = make(map[string]float64)
+			f.zsets[args[1]] = z
+		}
+		n := 0
+		for i := 2; i+1 < len(args); i += 2 {
+			score, err := strconv.ParseFloat(args[i], 64)
+			if err != nil {
+				return respError("ERR value is not a valid float")
+			}
+			if _, ok := z[args[i+1]]; !ok {
+				n++
+			}
+			z[args[i+1]] = score
+		}
+		return n
+	case "ZREM":
+		n := 0
+		for _, m := range args[2:] {
+			if _, ok := f.zsets[args[1]][m]; ok {
+				delete(f.zsets[args[1]], m)
+				n++
+			}
+		}
+		return n
+	case "ZSCORE":
+		score, ok := f.zsets[args[1]][args[2]]
+		if !ok {
+			return respBulk(nil)
+		}
+		return bulk(strconv.FormatFloat(score, 'f', -1, 64))
+	}
+	return respError(fmt.Sprintf("ERR unknown command '%s'", args[0]))
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// mediaReference is a column in app-service's database holding the URL of
+// a stored file.
+type mediaReference struct {
+	Table  string `json:"table"`
+	ID     int    `json:"id"`
+	Column string `json:"column"`
+	URL    string `json:"url"`
+}
+
+// Every column app-service keeps media URLs in
+const mediaReferenceQuery = `
+	SELECT 'product_images' AS tbl, id, 'url' AS col, url FROM product_images WHERE url IS NOT NULL
+	UNION ALL
+	SELECT 'orders', id, 'payment_receipt_url', payment_receipt_url FROM orders WHERE payment_receipt_url IS NOT NULL
+	UNION ALL
+	SELECT 'orders', id, 'shipping_tracking_url', shipping_tracking_url FROM orders WHERE shipping_tracking_url IS NOT NULL`
+
+// newReferenceDB connects to app-service's database, read only as far as
+// media-service is concerned. Without DATABASE_URL nothing is checked
+// against it and garbage collection is unavailable.
+func newReferenceDB() (*pgxpool.Pool, error) {
+	dsn := os.Getenv("DATABASE_URL")
+	if dsn == "" {
+		return nil, nil
+	}
+	pool, err := pgxpool.New(context.Background(), dsn)
+	if err != nil {
+		return nil, fmt.Errorf("DATABASE_URL: %w", err)
+	}
+	return pool, nil
+}
+
+func (s *mediaService) queryReferences(ctx context.Context, query string, args ...any) ([]mediaReference, error) {
+	rows, err := s.db.Query(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var refs []mediaReference
+	for rows.Next() {
+		var ref mediaReference
+		if err := rows.Scan(&ref.Table, &ref.ID, &ref.Column, &ref.URL); err != nil {
+			return nil, err
+		}
+		refs = append(refs, ref)
+	}
+	return refs, rows.Err()
+}
+
+// allReferences returns every media URL stored in the database.
+func (s *mediaService) allReferences(ctx context.Context) ([]mediaReference, error) {
+	return s.queryReferences(ctx, mediaReferenceQuery)
+}
+
+// referencesTo returns the database rows that point at obj.
+func (s *mediaService) referencesTo(ctx context.Context, obj objectRef) ([]mediaReference, error) {
+	candidates, err := s.queryReferences(ctx, "SELECT * FROM ("+mediaReferenceQuery+") refs WHERE strpos(url, $1) > 0", obj.Key)
+	if err != nil {
+		return nil, err
+	}
+	var refs []mediaReference
+	for _, ref := range candidates {
+		if target, ok := s.objectFromURL(ref.URL); ok && target == obj {
+			refs = append(refs, ref)
+		}
+	}
+	return refs, nil
+}
+
+// buckets lists every bucket media-service stores in.
+func (s *mediaService) buckets() []string {
+	seen := map[string]bool{s.publicBucket: true, s.privateBucket: true}
+	list := []string{s.publicBucket, s.privateBucket}
+	for _, p := range s.presets {
+		if !seen[p.Bucket] {
+			seen[p.Bucket] = true
+			list = append(list, p.Bucket)
+		}
+	}
+	return list
+}
+
+// objectFromURL finds the stored object a URL handed out by this service
+// points at, either directly or through the transform endpoint. Version
+// and transform queries are ignored.
+func (s *mediaService) objectFromURL(raw string) (objectRef, bool) {
+	raw, _, _ = strings.Cut(raw, "#")
+	raw, _, _ = strings.Cut(raw, "?")
+
+	if _, key, ok := strings.Cut(raw, "/api/v1/media/img/"); ok {
+		return unescapedRef(s.publicBucket, key)
+	}
+	// Signed links to private files stay resolvable after they expire
+	if _, key, ok := strings.Cut(raw, privateDownloadPath); ok {
+		return unescapedRef(s.privateBucket, key)
+	}
+	for _, bucket := range s.buckets() {
+		if key, ok := strings.CutPrefix(raw, s.store.URL(bucket, "")); ok {
+			return unescapedRef(bucket, key)
+		}
+	}
+	return objectRef{}, false
+}
+
+func unescapedRef(bucket, key string) (objectRef, bool) {
+	key, err := url.PathUnescape(key)
+	if err != nil || !validObjectKey(key) {
+		return objectRef{}, false
+	}
+	return objectRef{Bucket: bucket, Key: key}, true
+}
@@ -0,0 +1,39 @@
+package main
+
+import "testing"
+
+func TestObjectFromURL(t *testing.T) {
+	store := testLocalStore(t)
+	s := &mediaService{
+		store:         store,
+		publicBucket:  "public",
+		privateBucket: "private",
+		presets: map[string]*purposePreset{
+			"banner": {Bucket: "banners"},
+		},
+	}
+
+	tests := []struct {
+		url    string
+		want   objectRef
+		wantOK bool
+	}{
+		{url: "http://media.test/files/public/products/a.jpg", want: objectRef{"public", "products/a.jpg"}, wantOK: true},
+		{url: "http://media.test/files/public/1700000000_a.jpg", want: objectRef{"public", "1700000000_a.jpg"}, wantOK: true},
+		{url: "http://media.test/files/public/avatars/7_64.jpg?v=1700000000000", want: objectRef{"public", "avatars/7_64.jpg"}, wantOK: true},
+		{url: "http://media.test/files/banners/a%20b.jpg#top", want: objectRef{"banners", "a b.jpg"}, wantOK: true},
+		{url: "https://api.example.com/api/v1/media/img/products/a.jpg?w=200&s=abc", want: objectRef{"public", "products/a.jpg"}, wantOK: true},
+		{url: "https://api.example.com/api/v1/media/private/receipts/a.pdf?expires=1&s=abc", want: objectRef{"private", "receipts/a.pdf"}, wantOK: true},
+		{url: "http://media.test/files/public/products/../../etc/passwd"},
+		{url: "http://media.test/files/public/%zz"},
+		{url: "http://media.test/files/other/a.jpg"},
+		{url: "https://elsewhere.example.com/a.jpg"},
+		{url: ""},
+	}
+	for _, tt := range tests {
+		got, ok := s.objectFromURL(tt.url)
+		if ok != tt.wantOK || got != tt.want {
+			t.Errorf("objectFromURL(%q) = %v, %v, want %v, %v", tt.url, got, ok, tt.want, tt.wantOK)
+		}
+	}
+}
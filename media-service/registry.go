@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// objectRef names a stored object across buckets.
+type objectRef struct {
+	Bucket string `json:"bucket"`
+	Key    string `json:"key"`
+}
+
+func (r objectRef) String() string {
+	return r.Bucket + "/" + r.Key
+}
+
+// parseObjectRef reverses String, bucket names never contain a slash.
+func parseObjectRef(s string) (objectRef, bool) {
+	bucket, key, ok := strings.Cut(s, "/")
+	return objectRef{Bucket: bucket, Key: key}, ok && bucket != "" && key != ""
+}
+
+type storedObject struct {
+	objectRef
+	// Reused objects were already stored before the upload
+	Reused bool
+}
+
+// objects lists everything stored for an upload, variants first.
+func (r *uploadResult) objects(privateBucket string) []storedObject {
+	var objs []storedObject
+	for _, v := range r.Variants {
+		objs = append(objs, storedObject{objectRef{r.bucket, v.Key}, v.Deduplicated})
+	}
+	if r.Animation != nil {
+		objs = append(objs, storedObject{objectRef{r.bucket, r.Animation.Key}, r.Animation.Deduplicated})
+	}
+	if r.OriginalKey != "" {
+		objs = append(objs, storedObject{objectRef{privateBucket, r.OriginalKey}, r.originalReused})
+	}
+	return objs
+}
+
+// primaryRef is the object clients get as url, which is also what
+// app-service stores and what deletes are asked for.
+func (r *uploadResult) primaryRef() objectRef {
+	return objectRef{r.bucket, primaryVariant(r.Variants).Key}
+}
+
+const mediaStoredKey = "media:stored"
+
+// anonymousOwner is the owner recorded for uploads without an access
+// token. Nobody can remove that claim, so content that was ever uploaded
+// anonymously stays shared and only an admin deletes it.
+const anonymousOwner = 0
+
+// mediaRegistry remembers what each upload stored and who uploaded it, so
+// an upload can be deleted as a whole and objects shared through content
+// deduplication are only deleted once nothing uses them. Uploads are
+// identified by their primary object.
+//
+//	media:upload:<primary>   set of the upload's objects
+//	media:owners:<primary>   set of user IDs that uploaded it
+//	media:used_by:<object>   set of uploads an object belongs to
+//	media:stored             object -> unix time it was last uploaded
+type mediaRegistry struct {
+	rdb *redis.Client
+}
+
+func uploadSetKey(primary objectRef) string {
+	return "media:upload:" + primary.String()
+}
+
+func ownersKey(primary objectRef) string {
+	return "media:owners:" + primary.String()
+}
+
+func usedByKey(obj objectRef) string {
+	return "media:used_by:" + obj.String()
+}
+
+// Record adds an upload. owner is anonymousOwner for anonymous uploads.
+// Identical uploads share the same primary and simply add their owner.
+func (reg *mediaRegistry) Record(ctx context.Context, result *uploadResult, privateBucket string, owner int) error {
+	primary := result.primaryRef()
+	now := float64(time.Now().Unix())
+
+	pipe := reg.rdb.TxPipeline()
+	for _, obj := range result.objects(privateBucket) {
+		pipe.SAdd(ctx, uploadSetKey(primary), obj.String())
+		pipe.SAdd(ctx, usedByKey(obj.objectRef), primary.String())
+		pipe.ZAdd(ctx, mediaStoredKey, redis.Z{Score: now, Member: obj.String()})
+	}
+	pipe.SAdd(ctx, ownersKey(primary), owner)
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+// Upload returns the objects and owners recorded for an upload. Both are
+// empty for files stored before uploads were recorded.
+func (reg *mediaRegistry) Upload(ctx context.Context, primary objectRef) ([]objectRef, []int, error) {
+	pipe := reg.rdb.Pipeline()
+	objCmd := pipe.SMembers(ctx, uploadSetKey(primary))
+	ownerCmd := pipe.SMembers(ctx, ownersKey(primary))
+	if _, err := pipe.Exec(ctx); err != nil {
+		return nil, nil, err
+	}
+
+	var objs []objectRef
+	for _, s := range objCmd.Val() {
+		if obj, ok := parseObjectRef(s); ok {
+			objs = append(objs, obj)
+		}
+	}
+	var owners []int
+	for _, s := range ownerCmd.Val() {
+		if id, err := strconv.Atoi(s); err == nil {
+			owners = append(owners, id)
+		}
+	}
+	return objs, owners, nil
+}
+
+// RemoveOwner takes a user off an upload that others uploaded too.
+func (reg *mediaRegistry) RemoveOwner(ctx context.Context, primary objectRef, owner int) error {
+	return reg.rdb.SRem(ctx, ownersKey(primary), owner).Err()
+}
+
+// Forget drops an upload. Its objects stay recorded for any other
+// upload that uses them.
+func (reg *mediaRegistry) Forget(ctx context.Context, primary objectRef) error {
+	objs, _, err := reg.Upload(ctx, primary)
+	if err != nil {
+		return err
+	}
+
+	pipe := reg.rdb.TxPipeline()
+	for _, obj := range objs {
+		pipe.SRem(ctx, usedByKey(obj), primary.String())
+	}
+	pipe.Del(ctx, uploadSetKey(primary), ownersKey(primary))
+	_, err = pipe.Exec(ctx)
+	return err
+}
+
+// UsedBy returns the uploads each object belongs to. Objects missing from
+// the result were never recorded.
+func (reg *mediaRegistry) UsedBy(ctx context.Context, objs []objectRef) (map[objectRef][]objectRef, error) {
+	pipe := reg.rdb.Pipeline()
+	cmds := make([]*redis.StringSliceCmd, len(objs))
+	for i, obj := range objs {
+		cmds[i] = pipe.SMembers(ctx, usedByKey(obj))
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return nil, err
+	}
+
+	used := make(map[objectRef][]objectRef)
+	for i, cmd := range cmds {
+		for _, s := range cmd.Val() {
+			if primary, ok := parseObjectRef(s); ok {
+				used[objs[i]] = append(used[objs[i]], primary)
+			}
+		}
+	}
+	return used, nil
+}
+
+// LastStored returns when each object was last uploaded. Deduplicated
+// uploads are not written again, so this can be newer than the object.
+func (reg *mediaRegistry) LastStored(ctx context.Context, objs []objectRef) (map[objectRef]time.Time, error) {
+	pipe := reg.rdb.Pipeline()
+	cmds := make([]*redis.FloatCmd, len(objs))
+	for i, obj := range objs {
+		cmds[i] = pipe.ZScore(ctx, mediaStoredKey, obj.String())
+	}
+	// Missing members answer redis.Nil
+	if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+		return nil, err
+	}
+
+	stored := make(map[objectRef]time.Time)
+	for i, cmd := range cmds {
+		if cmd.Err() == nil {
+			stored[objs[i]] = time.Unix(int64(cmd.Val()), 0)
+		}
+	}
+	return stored, nil
+}
+
+// ForgetObjects drops the bookkeeping of deleted objects, including the
+// uploads they were the primary of.
+func (reg *mediaRegistry) ForgetObjects(ctx context.Context, objs []objectRef) error {
+	pipe := reg.rdb.Pipeline()
+	members := make([]*redis.StringSliceCmd, len(objs))
+	for i, obj := range objs {
+		members[i] = pipe.SMembers(ctx, uploadSetKey(obj))
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return err
+	}
+
+	tx := reg.rdb.TxPipeline()
+	for i, obj := range objs {
+		for _, m := range members[i].Val() {
+			tx.SRem(ctx, "media:used_by:"+m, obj.String())
+		}
+		tx.Del(ctx, usedByKey(obj), uploadSetKey(obj), ownersKey(obj))
+		tx.ZRem(ctx, mediaStoredKey, obj.String())
+	}
+	_, err := tx.Exec(ctx)
+	return err
+}
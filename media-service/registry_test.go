@@ -0,0 +1,54 @@
+package main
+
+import "testing"
+
+func TestParseObjectRef(t *testing.T) {
+	tests := []struct {
+		in     string
+		want   objectRef
+		wantOK bool
+	}{
+		{in: "public/products/a.jpg", want: objectRef{"public", "products/a.jpg"}, wantOK: true},
+		{in: "private/a.pdf", want: objectRef{"private", "a.pdf"}, wantOK: true},
+		{in: "public", want: objectRef{"public", ""}},
+		{in: "public/", want: objectRef{"public", ""}},
+		{in: "/a.jpg", want: objectRef{"", "a.jpg"}},
+		{in: ""},
+	}
+	for _, tt := range tests {
+		got, ok := parseObjectRef(tt.in)
+		if ok != tt.wantOK || (ok && got != tt.want) {
+			t.Errorf("parseObjectRef(%q) = %v, %v, want %v, %v", tt.in, got, ok, tt.want, tt.wantOK)
+		}
+	}
+
+	ref := objectRef{"public", "products/a b.jpg"}
+	if got, ok := parseObjectRef(ref.String()); !ok || got != ref {
+		t.Errorf("parseObjectRef(%q) = %v, %v, want it back", ref.String(), got, ok)
+	}
+}
+
+func TestUploadResultObjects(t *testing.T) {
+	result := &uploadResult{
+		bucket:         "public",
+		Variants:       []variantResult{{Name: "thumb", Key: "products/t.jpg"}, {Name: "large", Key: "products/l.jpg", Deduplicated: true}},
+		Animation:      &animationResult{Key: "products/a.gif"},
+		OriginalKey:    "originals/products/o.jpg",
+		originalReused: true,
+	}
+	want := []storedObject{
+		{objectRef{"public", "products/t.jpg"}, false},
+		{objectRef{"public", "products/l.jpg"}, true},
+		{objectRef{"public", "products/a.gif"}, false},
+		{objectRef{"private", "originals/products/o.jpg"}, true},
+	}
+	got := result.objects("private")
+	if len(got) != len(want) {
+		t.Fatalf("objects() = %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("objects()[%d] = %v, want %v", i, got[i], want[i])
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+const (
+	retentionSweepInterval = time.Hour
+	retentionPageSize      = 1000
+)
+
+// startRetentionSweeper deletes files once they are older than their
+// preset's retention. Presets without a retention are never swept.
+func (s *mediaService) startRetentionSweeper() {
+	var expiring []*purposePreset
+	for _, p := range s.presets {
+		if p.Retention > 0 {
+			expiring = append(expiring, p)
+		}
+	}
+	if len(expiring) == 0 {
+		return
+	}
+
+	ctx := context.Background()
+	for {
+		for _, p := range expiring {
+			deleted, err := s.sweepExpired(ctx, p)
+			if err != nil {
+				fmt.Printf("Retention Sweep Error (%s): %v\n", p.Name, err)
+			}
+			if deleted > 0 {
+				fmt.Printf("Retention sweep deleted %d %s files\n", deleted, p.Name)
+			}
+		}
+		time.Sleep(retentionSweepInterval)
+	}
+}
+
+// sweepExpired deletes the files under the preset's prefix that were last
+// written before the retention cutoff and returns how many were removed.
+// Uploads of identical content rewrite the file, which restarts its age.
+func (s *mediaService) sweepExpired(ctx context.Context, p *purposePreset) (int, error) {
+	cutoff := time.Now().Add(-p.Retention)
+
+	// Listing is least recently written first, so the first file inside
+	// the retention window ends the scan. Keys are collected before
+	// deleting so the pagination offsets stay valid.
+	var expired []objectRef
+	for offset := 0; ; offset += retentionPageSize {
+		objects, err := s.store.List(p.Bucket, p.Prefix, retentionPageSize, offset)
+		if err != nil {
+			return 0, err
+		}
+		done := len(objects) < retentionPageSize
+		for _, obj := range objects {
+			if !obj.UpdatedAt.Before(cutoff) {
+				done = true
+				break
+			}
+			expired = append(expired, objectRef{p.Bucket, p.Prefix + obj.Name})
+		}
+		if done {
+			break
+		}
+	}
+
+	for start := 0; start < len(expired); start += retentionPageSize {
+		batch := expired[start:min(start+retentionPageSize, len(expired))]
+		if err := s.deleteObjects(ctx, batch); err != nil {
+			return start, err
+		}
+	}
+	return len(expired), nil
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5"
+)
+
+const (
+	privateDownloadPath = "/api/v1/media/private/"
+
+	codeLinkExpired   = "LINK_EXPIRED"
+	codeNotOrderParty = "NOT_ORDER_PARTY"
+
+	// The most orders one request for document links may name
+	maxOrderDocumentBatch = 100
+)
+
+// The order columns documents are kept in, by the name clients ask for
+var orderDocuments = map[string]string{
+	"receipt":  "payment_receipt_url",
+	"shipping": "shipping_tracking_url",
+}
+
+func loadSignedURLTTL() (time.Duration, error) {
+	minutes, err := envInt("MEDIA_SIGNED_URL_TTL_MINUTES", 15)
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(minutes) * time.Minute, nil
+}
+
+// signDownload signs a private download link. The prefix keeps these
+// signatures apart from transform signatures over the same key.
+func signDownload(secret []byte, key string, expires int64) string {
+	query := url.Values{"expires": {strconv.FormatInt(expires, 10)}}
+	return signTransform(secret, "private:"+key, query)
+}
+
+// signedURL returns a link to a private object that stops working after
+// the configured TTL.
+func (s *mediaService) signedURL(key string) (string, time.Time) {
+	expiresAt := time.Now().Add(s.signedURLTTL).Truncate(time.Second)
+	expires := expiresAt.Unix()
+	query := url.Values{
+		"expires": {strconv.FormatInt(expires, 10)},
+		"s":       {signDownload(s.signingKey, key, expires)},
+	}
+	return s.serviceURL + privateDownloadPath + (&url.URL{Path: key}).EscapedPath() + "?" + query.Encode(), expiresAt
+}
+
+// signResult replaces the URLs of a private upload with signed links.
+func (s *mediaService) signResult(result *uploadResult) {
+	var expiresAt time.Time
+	for i, v := range result.Variants {
+		result.Variants[i].URL, expiresAt = s.signedURL(v.Key)
+	}
+	if result.Animation != nil {
+		result.Animation.URL, _ = s.signedURL(result.Animation.Key)
+	}
+	result.URL, _ = s.signedURL(primaryVariant(result.Variants).Key)
+	result.ExpiresAt = &expiresAt
+}
+
+// handlePrivateDownload serves a private object to whoever holds a valid,
+// unexpired signed link.
+func (s *mediaService) handlePrivateDownload(c *gin.Context) {
+	key := strings.TrimPrefix(c.Param("key"), "/")
+	expires, err := strconv.ParseInt(c.Query("expires"), 10, 64)
+	if !validObjectKey(key) || err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid download link"})
+		return
+	}
+	expected := signDownload(s.signingKey, key, expires)
+	if !hmac.Equal([]byte(c.Query("s")), []byte(expected)) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Invalid signature"})
+		return
+	}
+	remaining := time.Until(time.Unix(expires, 0))
+	if remaining <= 0 {
+		c.JSON(http.StatusGone, gin.H{"error": "Download link has expired, request a new one", "code": codeLinkExpired})
+		return
+	}
+
+	obj, err := s.store.Stat(s.privateBucket, key)
+	if errors.Is(err, errObjectNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "File not found"})
+		return
+	}
+	if err != nil {
+		fmt.Printf("Storage Stat Error: %v\n", err)
+		c.JSON(http.StatusBadGateway, gin.H{"error": "Failed to load file"})
+		return
+	}
+	data, err := s.store.Get(s.privateBucket, key)
+	if err != nil {
+		fmt.Printf("Storage Download Error: %v\n", err)
+		c.JSON(http.StatusBadGateway, gin.H{"error": "Failed to load file"})
+		return
+	}
+
+	contentType := obj.ContentType
+	if contentType == "" {
+		contentType = http.DetectContentType(data)
+	}
+	c.Header("Content-Type", contentType)
+	c.Header("Cache-Control", fmt.Sprintf("private, max-age=%d", int(remaining.Seconds())))
+	c.Header("X-Content-Type-Options", "nosniff")
+	c.Header("Referrer-Policy", "no-referrer")
+	http.ServeContent(c.Writer, c.Request, "", obj.UpdatedAt, bytes.NewReader(data))
+}
+
+// handleOrderDocument mints a fresh signed link to an order's payment
+// receipt or shipping document, for the order's buyer and seller and for
+// admins.
+func (s *mediaService) handleOrderDocument(c *gin.Context) {
+	user := currentUser(c)
+	column, ok := orderDocuments[c.Param("document")]
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Unknown order document"})
+		return
+	}
+	orderID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid order ID"})
+		return
+	}
+	if s.db == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "DATABASE_URL is not set, orders cannot be checked"})
+		return
+	}
+
+	var buyerID, sellerID int
+	var stored *string
+	err = s.db.QueryRow(c.Request.Context(),
+		"SELECT buyer_id, seller_id, "+column+" FROM orders WHERE id = $1", orderID,
+	).Scan(&buyerID, &sellerID, &stored)
+	if errors.Is(err, pgx.ErrNoRows) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Order not found"})
+		return
+	}
+	if err != nil {
+		fmt.Printf("Order Lookup Error: %v\n", err)
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Failed to look up order"})
+		return
+	}
+
+	if user.Role != roleAdmin && user.ID != buyerID && user.ID != sellerID {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Only the buyer and seller can view order documents", "code": codeNotOrderParty})
+		return
+	}
+	if stored == nil || *stored == "" {
+		c.JSON(http.StatusNotFound, gin.H{"error": "No document has been uploaded for this order"})
+		return
+	}
+
+	link, expiresAt := s.orderDocumentLink(*stored)
+	if expiresAt == nil {
+		c.JSON(http.StatusOK, gin.H{"url": link})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"url": link, "expires_at": expiresAt})
+}
+
+// handleOrderDocuments mints the links of several orders at once, for
+// order lists. Orders the user is not a party to and documents that were
+// never uploaded are left out of the answer.
+func (s *mediaService) handleOrderDocuments(c *gin.Context) {
+	user := currentUser(c)
+	var body struct {
+		Orders []int `json:"orders"`
+	}
+	if err := c.ShouldBindJSON(&body); err != nil || len(body.Orders) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "orders must be a list of order IDs"})
+		return
+	}
+	if len(body.Orders) > maxOrderDocumentBatch {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("At most %d orders can be asked for at once", maxOrderDocumentBatch)})
+		return
+	}
+	if s.db == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "DATABASE_URL is not set, orders cannot be checked"})
+		return
+	}
+
+	rows, err := s.db.Query(c.Request.Context(),
+		"SELECT id, buyer_id, seller_id, "+orderDocuments["receipt"]+", "+orderDocuments["shipping"]+" FROM orders WHERE id = ANY($1)",
+		body.Orders,
+	)
+	if err != nil {
+		fmt.Printf("Order Lookup Error: %v\n", err)
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Failed to look up orders"})
+		return
+	}
+	defer rows.Close()
+
+	links := make(map[string]map[string]string)
+	for rows.Next() {
+		var id, buyerID, sellerID int
+		var receipt, shipping *string
+		if err := rows.Scan(&id, &buyerID, &sellerID, &receipt, &shipping); err != nil {
+			fmt.Printf("Order Lookup Error: %v\n", err)
+			c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Failed to look up orders"})
+			return
+		}
+		if user.Role != roleAdmin && user.ID != buyerID && user.ID != sellerID {
+			continue
+		}
+		docs := make(map[string]string)
+		for document, stored := range map[string]*string{"receipt": receipt, "shipping": shipping} {
+			if stored != nil && *stored != "" {
+				docs[document], _ = s.orderDocumentLink(*stored)
+			}
+		}
+		links[strconv.Itoa(id)] = docs
+	}
+	if err := rows.Err(); err != nil {
+		fmt.Printf("Order Lookup Error: %v\n", err)
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Failed to look up orders"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"orders": links})
+}
+
+// orderDocumentLink turns the URL saved with an order into a fresh signed
+// link, with when it expires.
+func (s *mediaService) orderDocumentLink(stored string) (string, *time.Time) {
+	obj, ok := s.objectFromURL(stored)
+	if !ok || obj.Bucket != s.privateBucket {
+		// Uploaded before documents were private, the URL never expires
+		return stored, nil
+	}
+	link, expiresAt := s.signedURL(obj.Key)
+	return link, &expiresAt
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestSignDownload(t *testing.T) {
+	secret := []byte("secret")
+	sig := signDownload(secret, "receipts/a.png", 1700000000)
+	if sig != signDownload(secret, "receipts/a.png", 1700000000) {
+		t.Error("signDownload() is not deterministic")
+	}
+	others := map[string]string{
+		"other key":          signDownload(secret, "receipts/b.png", 1700000000),
+		"later expiry":       signDownload(secret, "receipts/a.png", 1700000001),
+		"other secret":       signDownload([]byte("other"), "receipts/a.png", 1700000000),
+		"transform of a key": signTransform(secret, "receipts/a.png", url.Values{"expires": {"1700000000"}}),
+	}
+	for name, other := range others {
+		if other == sig {
+			t.Errorf("signDownload() matches the signature for the %s", name)
+		}
+	}
+}
+
+func TestPrivateDownload(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	store := testLocalStore(t)
+	s := &mediaService{
+		store:         store,
+		privateBucket: "private",
+		signingKey:    []byte("secret"),
+		serviceURL:    "http://media.test",
+		signedURLTTL:  time.Minute,
+	}
+	r := gin.New()
+	r.GET("api/v1/media/private/*key", s.handlePrivateDownload)
+	if err := store.Put("private", "receipts/ảnh 1.png", []byte("png"), "image/png", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	link, expiresAt := s.signedURL("receipts/ảnh 1.png")
+	if remaining := time.Until(expiresAt); remaining <= 0 || remaining > time.Minute {
+		t.Errorf("signedURL() expires in %v, want the TTL", remaining)
+	}
+	if !strings.HasPrefix(link, "http://media.test"+privateDownloadPath) {
+		t.Fatalf("signedURL() = %q", link)
+	}
+	path := strings.TrimPrefix(link, "http://media.test")
+
+	expired := time.Now().Add(-time.Minute).Unix()
+	expiredLink := privateDownloadPath + "receipts/a.png?" + url.Values{
+		"expires": {strconv.FormatInt(expired, 10)},
+		"s":       {signDownload(s.signingKey, "receipts/a.png", expired)},
+	}.Encode()
+	missing, _ := s.signedURL("receipts/missing.png")
+
+	tests := []struct {
+		name string
+		path string
+		want int
+	}{
+		{name: "signed link", path: path, want: http.StatusOK},
+		{name: "other key", path: strings.Replace(path, "1.png", "2.png", 1), want: http.StatusForbidden},
+		{name: "no signature", path: strings.Split(path, "&s=")[0], want: http.StatusForbidden},
+		{name: "no expiry", path: privateDownloadPath + "receipts/a.png?s=x", want: http.StatusBadRequest},
+		{name: "key outside the bucket", path: privateDownloadPath + "../x?expires=1&s=x", want: http.StatusBadRequest},
+		{name: "expired", path: expiredLink, want: http.StatusGone},
+		{name: "missing file", path: strings.TrimPrefix(missing, "http://media.test"), want: http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, tt.path, nil))
+		if w.Code != tt.want {
+			t.Errorf("%s: GET = %d, want %d", tt.name, w.Code, tt.want)
+		}
+		if w.Code == http.StatusOK && (w.Body.String() != "png" || w.Header().Get("Content-Type") != "image/png") {
+			t.Errorf("%s: GET = %q as %s", tt.name, w.Body.String(), w.Header().Get("Content-Type"))
+		}
+	}
+}
+
+func TestSignResult(t *testing.T) {
+	s := &mediaService{signingKey: []byte("secret"), serviceURL: "http://media.test", signedURLTTL: time.Minute}
+	result := &uploadResult{
+		URL:       "http://media.test/files/private/receipts/a_full.png",
+		Variants:  []variantResult{{Name: "full", Key: "receipts/a_full.png"}},
+		Animation: &animationResult{Key: "receipts/a.gif"},
+	}
+	s.signResult(result)
+	if !strings.HasPrefix(result.URL, "http://media.test"+privateDownloadPath+"receipts/a_full.png?") || result.URL != result.Variants[0].URL {
+		t.Errorf("signResult() URL = %q, variant %q", result.URL, result.Variants[0].URL)
+	}
+	if !strings.Contains(result.Animation.URL, "receipts/a.gif?") {
+		t.Errorf("signResult() animation = %q", result.Animation.URL)
+	}
+	if result.ExpiresAt == nil || result.ExpiresAt.Before(time.Now()) {
+		t.Errorf("signResult() expires_at = %v", result.ExpiresAt)
+	}
+}
+
+func TestOrderDocumentLink(t *testing.T) {
+	s := &mediaService{
+		store:         testLocalStore(t),
+		publicBucket:  "public",
+		privateBucket: "private",
+		signingKey:    []byte("secret"),
+		serviceURL:    "http://media.test",
+		signedURLTTL:  time.Minute,
+	}
+	link, expiresAt := s.orderDocumentLink("http://media.test/files/private/receipts/a.png?expires=1&s=x")
+	if !strings.HasPrefix(link, "http://media.test"+privateDownloadPath+"receipts/a.png?") || strings.Contains(link, "expires=1&") || expiresAt == nil {
+		t.Errorf("orderDocumentLink() of a private file = %q, %v", link, expiresAt)
+	}
+	// Documents uploaded before they were private keep their URL
+	public := "http://media.test/files/public/receipts/a.png"
+	if link, expiresAt := s.orderDocumentLink(public); link != public || expiresAt != nil {
+		t.Errorf("orderDocumentLink() of a public file = %q, %v", link, expiresAt)
+	}
+}
+
+func TestOrderDocumentsRequest(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	s := &mediaService{}
+	r := gin.New()
+	r.POST("/orders/documents", func(c *gin.Context) {
+		c.Set("user", &authUser{ID: 1, Role: "BIDDER"})
+	}, s.handleOrderDocuments)
+
+	tooMany := make([]string, maxOrderDocumentBatch+1)
+	for i := range tooMany {
+		tooMany[i] = strconv.Itoa(i + 1)
+	}
+	tests := []struct {
+		name string
+		body string
+		want int
+	}{
+		{name: "no body", body: "", want: http.StatusBadRequest},
+		{name: "no orders", body: `{"orders":[]}`, want: http.StatusBadRequest},
+		{name: "not IDs", body: `{"orders":["a"]}`, want: http.StatusBadRequest},
+		{name: "too many", body: `{"orders":[` + strings.Join(tooMany, ",") + `]}`, want: http.StatusBadRequest},
+		{name: "no database", body: `{"orders":[1,2]}`, want: http.StatusServiceUnavailable},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/orders/documents", strings.NewReader(tt.body)))
+		if w.Code != tt.want {
+			t.Errorf("%s: POST = %d, want %d", tt.name, w.Code, tt.want)
+		}
+	}
+}
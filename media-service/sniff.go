@@ -0,0 +1,145 @@
+package main
+
+import (
+	"fmt"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	codeTypeNotAllowed = "UNSUPPORTED_MEDIA_TYPE"
+	codeTypeMismatch   = "CONTENT_TYPE_MISMATCH"
+)
+
+const defaultAllowedTypes = "image/jpeg,image/png,image/webp,image/gif"
+
+// decodableTypes are the formats the image pipeline can read. Together
+// with storedTypes they are the only ones an allowlist may contain.
+var decodableTypes = map[string]bool{
+	"image/jpeg": true,
+	"image/png":  true,
+	"image/webp": true,
+	"image/gif":  true,
+}
+
+// storedTypes are accepted without decoding, they are validated and stored
+// as uploaded.
+var storedTypes = map[string]bool{
+	"application/pdf": true,
+}
+
+// typeExtensions lists the file extensions accepted for each type.
+var typeExtensions = map[string][]string{
+	"image/jpeg": {".jpg", ".jpeg", ".jfif"},
+	"image/png":  {".png"},
+	"image/webp": {".webp"},
+	"image/gif":  {".gif"},
+
+	"application/pdf": {".pdf"},
+}
+
+// typeAliases maps non-standard Content-Type values browsers still send.
+var typeAliases = map[string]string{
+	"image/jpg":   "image/jpeg",
+	"image/pjpeg": "image/jpeg",
+	"image/x-png": "image/png",
+}
+
+// loadAllowedTypes reads MEDIA_ALLOWED_TYPES_<PURPOSE> for every built-in
+// purpose, e.g. MEDIA_ALLOWED_TYPES_RECEIPT=image/jpeg,image/png. Receipts
+// also take PDFs unless configured otherwise.
+func loadAllowedTypes() (map[string]map[string]bool, error) {
+	allowed := make(map[string]map[string]bool)
+	for _, purpose := range builtinPurposes {
+		name := "MEDIA_ALLOWED_TYPES_" + strings.ToUpper(purpose)
+		spec := os.Getenv(name)
+		if spec == "" {
+			spec = defaultAllowedTypes
+			if purpose == purposeReceipt {
+				spec += ",application/pdf"
+			}
+		}
+		types, err := parseAllowedTypes(strings.Split(spec, ","))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		allowed[purpose] = types
+	}
+	return allowed, nil
+}
+
+func parseAllowedTypes(list []string) (map[string]bool, error) {
+	types := make(map[string]bool)
+	for _, t := range list {
+		t = strings.ToLower(strings.TrimSpace(t))
+		if t == "" {
+			continue
+		}
+		if !decodableTypes[t] && !storedTypes[t] {
+			return nil, fmt.Errorf("%q is not a supported type", t)
+		}
+		types[t] = true
+	}
+	if len(types) == 0 {
+		return nil, fmt.Errorf("at least one type is required")
+	}
+	return types, nil
+}
+
+// sniffContentType detects the type from the leading bytes of the file,
+// ignoring whatever the client claims it is.
+func sniffContentType(data []byte) string {
+	t, _, _ := mime.ParseMediaType(http.DetectContentType(data))
+	return t
+}
+
+// checkContentType sniffs data and rejects it if the type is not allowed
+// for the purpose, or if the filename extension or declared Content-Type
+// disagree with it. Missing extensions and missing or generic declarations
+// are not a mismatch.
+func (s *mediaService) checkContentType(req uploadRequest) (string, error) {
+	detected := sniffContentType(req.Data)
+	if !req.Preset.AllowedTypes[detected] {
+		return detected, &uploadError{
+			Status:  http.StatusUnsupportedMediaType,
+			Code:    codeTypeNotAllowed,
+			Message: fmt.Sprintf("File type %s is not allowed for %s uploads", detected, req.Purpose),
+		}
+	}
+
+	if ext := strings.ToLower(filepath.Ext(req.Filename)); ext != "" && !hasExtension(detected, ext) {
+		return detected, &uploadError{
+			Status:  http.StatusBadRequest,
+			Code:    codeTypeMismatch,
+			Message: fmt.Sprintf("File extension %s does not match its content (%s)", ext, detected),
+		}
+	}
+
+	declared, _, err := mime.ParseMediaType(req.ContentType)
+	if err == nil {
+		declared = strings.ToLower(declared)
+		if alias, ok := typeAliases[declared]; ok {
+			declared = alias
+		}
+		if declared != "application/octet-stream" && declared != detected {
+			return detected, &uploadError{
+				Status:  http.StatusBadRequest,
+				Code:    codeTypeMismatch,
+				Message: fmt.Sprintf("Declared Content-Type %s does not match the file content (%s)", declared, detected),
+			}
+		}
+	}
+	return detected, nil
+}
+
+func hasExtension(contentType, ext string) bool {
+	for _, e := range typeExtensions[contentType] {
+		if e == ext {
+			return true
+		}
+	}
+	return false
+}
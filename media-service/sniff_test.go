@@ -0,0 +1,105 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSniffContentType(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		want string
+	}{
+		{name: "jpeg", data: []byte("\xFF\xD8\xFF\xE0\x00\x10JFIF\x00"), want: "image/jpeg"},
+		{name: "png", data: []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\x0dIHDR"), want: "image/png"},
+		{name: "gif", data: []byte("GIF89a\x01\x00\x01\x00"), want: "image/gif"},
+		{name: "webp", data: []byte("RIFF\x00\x00\x00\x00WEBPVP8 "), want: "image/webp"},
+		{name: "pdf", data: []byte("%PDF-1.7\n"), want: "application/pdf"},
+		{name: "html", data: []byte("<html><body>"), want: "text/html"},
+		{name: "empty", data: nil, want: "text/plain"},
+	}
+	for _, tt := range tests {
+		if got := sniffContentType(tt.data); got != tt.want {
+			t.Errorf("%s: sniffContentType() = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestParseAllowedTypes(t *testing.T) {
+	tests := []struct {
+		list    []string
+		want    map[string]bool
+		wantErr bool
+	}{
+		{list: []string{"image/jpeg", " IMAGE/PNG ", ""}, want: map[string]bool{"image/jpeg": true, "image/png": true}},
+		{list: []string{"application/pdf"}, want: map[string]bool{"application/pdf": true}},
+		{list: []string{"image/jpeg", "image/jpeg"}, want: map[string]bool{"image/jpeg": true}},
+		{list: []string{"image/svg+xml"}, wantErr: true},
+		{list: []string{"image/jpg"}, wantErr: true},
+		{list: []string{"", " "}, wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseAllowedTypes(tt.list)
+		if (err != nil) != tt.wantErr || (!tt.wantErr && !reflect.DeepEqual(got, tt.want)) {
+			t.Errorf("parseAllowedTypes(%q) = %v, %v, want %v (error %v)", tt.list, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestLoadAllowedTypes(t *testing.T) {
+	t.Setenv("MEDIA_ALLOWED_TYPES_AVATAR", "image/jpeg")
+	allowed, err := loadAllowedTypes()
+	if err != nil {
+		t.Fatalf("loadAllowedTypes() error = %v", err)
+	}
+	if !allowed[purposeReceipt]["application/pdf"] || allowed[purposeProduct]["application/pdf"] {
+		t.Errorf("PDFs should only be allowed for receipts by default: %v", allowed)
+	}
+	if !reflect.DeepEqual(allowed[purposeAvatar], map[string]bool{"image/jpeg": true}) {
+		t.Errorf("avatar types = %v, want only image/jpeg", allowed[purposeAvatar])
+	}
+
+	t.Setenv("MEDIA_ALLOWED_TYPES_SHIPPING", "image/tiff")
+	if _, err := loadAllowedTypes(); err == nil {
+		t.Error("loadAllowedTypes() accepted image/tiff")
+	}
+}
+
+func TestCheckContentType(t *testing.T) {
+	s := &mediaService{}
+	preset := &purposePreset{AllowedTypes: map[string]bool{"image/jpeg": true, "image/png": true}}
+	jpegData := []byte("\xFF\xD8\xFF\xE0\x00\x10JFIF\x00")
+	pdfData := []byte("%PDF-1.7\n")
+
+	tests := []struct {
+		name        string
+		filename    string
+		contentType string
+		data        []byte
+		wantCode    string
+	}{
+		{name: "matching", filename: "photo.jpg", contentType: "image/jpeg", data: jpegData},
+		{name: "upper case extension", filename: "PHOTO.JPEG", contentType: "image/jpeg", data: jpegData},
+		{name: "no extension", filename: "photo", data: jpegData},
+		{name: "generic declaration", filename: "photo.jpg", contentType: "application/octet-stream", data: jpegData},
+		{name: "alias declaration", filename: "photo.jpg", contentType: "image/pjpeg", data: jpegData},
+		{name: "declaration with parameters", filename: "photo.jpg", contentType: "image/jpeg; charset=binary", data: jpegData},
+		{name: "unparseable declaration", filename: "photo.jpg", contentType: "image/", data: jpegData},
+		{name: "image extension of another type", filename: "photo.png", data: jpegData, wantCode: codeTypeMismatch},
+		{name: "pdf extension on an image", filename: "photo.pdf", data: jpegData, wantCode: codeTypeMismatch},
+		{name: "html extension", filename: "x.html", contentType: "image/jpeg", data: jpegData, wantCode: codeTypeMismatch},
+		{name: "svg extension", filename: "x.svg", data: jpegData, wantCode: codeTypeMismatch},
+		{name: "executable extension", filename: "x.exe", data: jpegData, wantCode: codeTypeMismatch},
+		{name: "unknown extension", filename: "photo.final", data: jpegData, wantCode: codeTypeMismatch},
+		{name: "declared type differs", filename: "photo.jpg", contentType: "image/png", data: jpegData, wantCode: codeTypeMismatch},
+		{name: "type not allowed", filename: "scan.pdf", contentType: "application/pdf", data: pdfData, wantCode: codeTypeNotAllowed},
+	}
+	for _, tt := range tests {
+		req := uploadRequest{Filename: tt.filename, ContentType: tt.contentType, Data: tt.data, Preset: preset}
+		_, err := s.checkContentType(req)
+		if got := errorCode(err); (err != nil) != (tt.wantCode != "") || got != tt.wantCode {
+			t.Errorf("%s: checkContentType() error = %v (code %q), want code %q", tt.name, err, got, tt.wantCode)
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+	"unicode"
+)
+
+var errObjectNotFound = errors.New("object not found")
+
+// objectStore is where uploaded files are kept. Buckets are Supabase or S3
+// buckets, or directories for the local driver, and keys may contain
+// slashes.
+type objectStore interface {
+	// Put creates or replaces an object. metadata is kept with it where
+	// the backend supports user metadata.
+	Put(bucket, key string, data []byte, contentType string, metadata map[string]string) error
+	// Get and Stat return errObjectNotFound for missing objects
+	Get(bucket, key string) ([]byte, error)
+	Stat(bucket, key string) (storageObject, error)
+	// Open streams an object for callers that bound how much they read,
+	// and also returns errObjectNotFound for missing objects
+	Open(bucket, key string) (io.ReadCloser, error)
+	// Delete ignores keys that do not exist
+	Delete(bucket string, keys []string) error
+	// List returns the files directly under prefix, least recently written
+	// first, with names relative to the prefix
+	List(bucket, prefix string, limit, offset int) ([]storageObject, error)
+	// URL is where clients fetch an object from
+	URL(bucket, key string) string
+	// PresignPut returns a URL clients can PUT an object to without
+	// credentials until ttl has passed
+	PresignPut(bucket, key string, ttl time.Duration) (string, error)
+}
+
+type storageObject struct {
+	Name        string    `json:"name"`
+	Size        int64     `json:"-"`
+	ContentType string    `json:"-"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+// newObjectStore picks the driver named by MEDIA_STORAGE_DRIVER: supabase
+// (the default), local or s3. SUPABASE_BUCKET and SUPABASE_PRIVATE_BUCKET
+// name the buckets whichever driver is used.
+func newObjectStore() (objectStore, error) {
+	driver := strings.ToLower(os.Getenv("MEDIA_STORAGE_DRIVER"))
+	switch driver {
+	case "", "supabase":
+		return newSupabaseStore()
+	case "local":
+		return newLocalStore()
+	case "s3":
+		return newS3Store()
+	}
+	return nil, fmt.Errorf("unknown MEDIA_STORAGE_DRIVER %q, expected supabase, local or s3", driver)
+}
+
+// validObjectKey rejects keys that could escape their bucket on backends
+// that map keys to paths, and keys with control characters.
+func validObjectKey(key string) bool {
+	if key == "" || strings.HasPrefix(key, "/") || strings.Contains(key, "\\") {
+		return false
+	}
+	if strings.ContainsFunc(key, unicode.IsControl) {
+		return false
+	}
+	for _, part := range strings.Split(key, "/") {
+		if part == "" || part == "." || part == ".." {
+			return false
+		}
+	}
+	return true
+}
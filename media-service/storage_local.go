@@ -0,0 +1,344 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// localStore keeps objects as files under root/<bucket>/<key>, for
+// development and single machine deployments. Content types and metadata
+// go to a JSON file per object under root/.meta.
+type localStore struct {
+	root    string
+	baseURL string
+	// private is never served over HTTP
+	private string
+	// secret signs upload URLs
+	secret []byte
+}
+
+type localMeta struct {
+	ContentType string            `json:"content_type"`
+	Metadata    map[string]string `json:"metadata,omitempty"`
+}
+
+func newLocalStore() (*localStore, error) {
+	root := os.Getenv("MEDIA_LOCAL_STORAGE_DIR")
+	if root == "" {
+		root = "storage"
+	}
+	root, err := filepath.Abs(root)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(root, 0o755); err != nil {
+		return nil, fmt.Errorf("MEDIA_LOCAL_STORAGE_DIR: %w", err)
+	}
+
+	baseURL := os.Getenv("MEDIA_LOCAL_STORAGE_URL")
+	if baseURL == "" {
+		baseURL = publicServiceURL() + "/api/v1/media/files"
+	}
+
+	return &localStore{
+		root:    root,
+		baseURL: strings.TrimRight(baseURL, "/"),
+		private: os.Getenv("SUPABASE_PRIVATE_BUCKET"),
+		secret:  []byte(os.Getenv("MEDIA_SIGNING_KEY")),
+	}, nil
+}
+
+// paths returns where an object and its metadata live on disk.
+func (s *localStore) paths(bucket, key string) (string, string, error) {
+	if !validObjectKey(bucket) || strings.Contains(bucket, "/") || strings.HasPrefix(bucket, ".") {
+		return "", "", fmt.Errorf("invalid bucket %q", bucket)
+	}
+	if !validObjectKey(key) {
+		return "", "", fmt.Errorf("invalid object key %q", key)
+	}
+	rel := filepath.FromSlash(key)
+	return filepath.Join(s.root, bucket, rel), filepath.Join(s.root, ".meta", bucket, rel+".json"), nil
+}
+
+func (s *localStore) URL(bucket, key string) string {
+	parts := strings.Split(key, "/")
+	for i, p := range parts {
+		parts[i] = url.PathEscape(p)
+	}
+	return s.baseURL + "/" + url.PathEscape(bucket) + "/" + strings.Join(parts, "/")
+}
+
+func (s *localStore) Put(bucket, key string, data []byte, contentType string, metadata map[string]string) error {
+	file, metaFile, err := s.paths(bucket, key)
+	if err != nil {
+		return err
+	}
+	meta, err := json.Marshal(localMeta{ContentType: contentType, Metadata: metadata})
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(metaFile, meta); err != nil {
+		return err
+	}
+	return writeFileAtomic(file, data)
+}
+
+// writeFileAtomic writes through a temporary file so readers never see a
+// partly written object.
+func writeFileAtomic(path string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func (s *localStore) Get(bucket, key string) ([]byte, error) {
+	file, _, err := s.paths(bucket, key)
+	if err != nil {
+		return nil, errObjectNotFound
+	}
+	data, err := os.ReadFile(file)
+	// A directory is part of longer keys, not an object, as in Stat
+	if errors.Is(err, fs.ErrNotExist) || errors.Is(err, syscall.EISDIR) {
+		return nil, errObjectNotFound
+	}
+	return data, err
+}
+
+func (s *localStore) Open(bucket, key string) (io.ReadCloser, error) {
+	file, _, err := s.paths(bucket, key)
+	if err != nil {
+		return nil, errObjectNotFound
+	}
+	f, err := os.Open(file)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, errObjectNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if info, err := f.Stat(); err != nil || info.IsDir() {
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+		return nil, errObjectNotFound
+	}
+	return f, nil
+}
+
+func (s *localStore) Stat(bucket, key string) (storageObject, error) {
+	file, metaFile, err := s.paths(bucket, key)
+	if err != nil {
+		return storageObject{}, errObjectNotFound
+	}
+	info, err := os.Stat(file)
+	if errors.Is(err, fs.ErrNotExist) || (err == nil && info.IsDir()) {
+		return storageObject{}, errObjectNotFound
+	}
+	if err != nil {
+		return storageObject{}, err
+	}
+
+	obj := storageObject{Name: key, Size: info.Size(), UpdatedAt: info.ModTime()}
+	var meta localMeta
+	if raw, err := os.ReadFile(metaFile); err == nil && json.Unmarshal(raw, &meta) == nil {
+		obj.ContentType = meta.ContentType
+	}
+	if obj.ContentType == "" {
+		obj.ContentType = mime.TypeByExtension(filepath.Ext(key))
+	}
+	return obj, nil
+}
+
+func (s *localStore) Delete(bucket string, keys []string) error {
+	for _, key := range keys {
+		file, metaFile, err := s.paths(bucket, key)
+		if err != nil {
+			return err
+		}
+		for _, path := range []string{file, metaFile} {
+			if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// List reads the directory prefix falls in. A prefix that does not end in
+// a slash also matches the start of file names, as it does on Supabase.
+func (s *localStore) List(bucket, prefix string, limit, offset int) ([]storageObject, error) {
+	dir, namePrefix := "", prefix
+	if i := strings.LastIndex(prefix, "/"); i >= 0 {
+		dir, namePrefix = prefix[:i], prefix[i+1:]
+	}
+	path := filepath.Join(s.root, bucket)
+	if dir != "" {
+		if !validObjectKey(dir) {
+			return nil, fmt.Errorf("invalid prefix %q", prefix)
+		}
+		path = filepath.Join(path, filepath.FromSlash(dir))
+	}
+
+	entries, err := os.ReadDir(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var objects []storageObject
+	for _, e := range entries {
+		name := e.Name()
+		if !e.Type().IsRegular() || strings.HasPrefix(name, ".tmp-") || !strings.HasPrefix(name, namePrefix) {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+		objects = append(objects, storageObject{
+			Name:      strings.TrimPrefix(name, namePrefix),
+			Size:      info.Size(),
+			UpdatedAt: info.ModTime(),
+		})
+	}
+	sort.SliceStable(objects, func(i, j int) bool {
+		return objects[i].UpdatedAt.Before(objects[j].UpdatedAt)
+	})
+
+	if offset >= len(objects) {
+		return nil, nil
+	}
+	objects = objects[offset:]
+	if limit > 0 && len(objects) > limit {
+		objects = objects[:limit]
+	}
+	return objects, nil
+}
+
+// handleFile serves stored files at the URLs the store hands out. The
+// private bucket answers 404 like any missing file.
+func (s *localStore) handleFile(c *gin.Context) {
+	bucket := c.Param("bucket")
+	key := strings.TrimPrefix(c.Param("key"), "/")
+	if bucket == s.private {
+		c.JSON(http.StatusNotFound, gin.H{"error": "File not found"})
+		return
+	}
+
+	obj, err := s.Stat(bucket, key)
+	if errors.Is(err, errObjectNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "File not found"})
+		return
+	}
+	if err != nil {
+		fmt.Printf("Storage Stat Error: %v\n", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read file"})
+		return
+	}
+	data, err := s.Get(bucket, key)
+	if err != nil {
+		fmt.Printf("Storage Download Error: %v\n", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read file"})
+		return
+	}
+
+	if obj.ContentType != "" {
+		c.Header("Content-Type", obj.ContentType)
+	}
+	c.Header("X-Content-Type-Options", "nosniff")
+	// Same default as Supabase Storage
+	c.Header("Cache-Control", "max-age=3600")
+	http.ServeContent(c.Writer, c.Request, "", obj.UpdatedAt, bytes.NewReader(data))
+}
+
+// signLocalPut signs an upload URL. The prefix keeps these signatures
+// apart from transform and download signatures.
+func signLocalPut(secret []byte, bucket, key string, expires int64) string {
+	query := url.Values{"expires": {strconv.FormatInt(expires, 10)}}
+	return signTransform(secret, "put:"+bucket+"/"+key, query)
+}
+
+// PresignPut returns a URL handleSignedPut accepts uploads at.
+func (s *localStore) PresignPut(bucket, key string, ttl time.Duration) (string, error) {
+	if _, _, err := s.paths(bucket, key); err != nil {
+		return "", err
+	}
+	expires := time.Now().Add(ttl).Unix()
+	query := url.Values{
+		"expires": {strconv.FormatInt(expires, 10)},
+		"s":       {signLocalPut(s.secret, bucket, key, expires)},
+	}
+	return s.URL(bucket, key) + "?" + query.Encode(), nil
+}
+
+// handleSignedPut stores request bodies of up to maxBytes at URLs from
+// PresignPut, the private bucket included.
+func (s *localStore) handleSignedPut(maxBytes int64) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		bucket := c.Param("bucket")
+		key := strings.TrimPrefix(c.Param("key"), "/")
+		expires, err := strconv.ParseInt(c.Query("expires"), 10, 64)
+		if err != nil || !hmac.Equal([]byte(c.Query("s")), []byte(signLocalPut(s.secret, bucket, key, expires))) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Invalid signature"})
+			return
+		}
+		if time.Now().Unix() > expires {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Upload URL has expired"})
+			return
+		}
+
+		data, err := io.ReadAll(http.MaxBytesReader(c.Writer, c.Request.Body, maxBytes))
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": fmt.Sprintf("File is larger than %d bytes", maxBytes)})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to read file"})
+			return
+		}
+		if err := s.Put(bucket, key, data, c.ContentType(), nil); err != nil {
+			fmt.Printf("Storage Upload Error: %v\n", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to store file"})
+			return
+		}
+		c.Status(http.StatusOK)
+	}
+}
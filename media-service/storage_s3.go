@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+// s3Store works against AWS S3 and compatible servers such as MinIO. The
+// buckets must already exist and the public one must allow anonymous reads
+// for the returned URLs to work.
+type s3Store struct {
+	client *minio.Client
+	// Objects are served from <publicURL>/<bucket>/<key>
+	publicURL string
+}
+
+func newS3Store() (*s3Store, error) {
+	endpoint := os.Getenv("MEDIA_S3_ENDPOINT")
+	if endpoint == "" {
+		return nil, fmt.Errorf("MEDIA_S3_ENDPOINT is required for the s3 storage driver")
+	}
+
+	secure := true
+	if raw := os.Getenv("MEDIA_S3_USE_SSL"); raw != "" {
+		var err error
+		if secure, err = strconv.ParseBool(raw); err != nil {
+			return nil, fmt.Errorf("MEDIA_S3_USE_SSL must be true or false")
+		}
+	}
+
+	client, err := minio.New(endpoint, &minio.Options{
+		Creds:  credentials.NewStaticV4(os.Getenv("MEDIA_S3_ACCESS_KEY"), os.Getenv("MEDIA_S3_SECRET_KEY"), ""),
+		Secure: secure,
+		Region: os.Getenv("MEDIA_S3_REGION"),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("MEDIA_S3_ENDPOINT: %w", err)
+	}
+
+	publicURL := os.Getenv("MEDIA_S3_PUBLIC_URL")
+	if publicURL == "" {
+		publicURL = client.EndpointURL().String()
+	}
+
+	return &s3Store{
+		client:    client,
+		publicURL: strings.TrimRight(publicURL, "/"),
+	}, nil
+}
+
+func (s *s3Store) URL(bucket, key string) string {
+	return s.publicURL + "/" + bucket + "/" + key
+}
+
+// isNotFound reports whether err is S3's answer for a missing object.
+func isNotFound(err error) bool {
+	resp := minio.ToErrorResponse(err)
+	return resp.Code == minio.NoSuchKey || resp.StatusCode == http.StatusNotFound
+}
+
+// Put URL-escapes metadata values, S3 only accepts ASCII in headers and
+// file names are often Vietnamese.
+func (s *s3Store) Put(bucket, key string, data []byte, contentType string, metadata map[string]string) error {
+	fmt.Printf("Uploading %s to %s\n", key, s.URL(bucket, key))
+
+	userMeta := make(map[string]string, len(metadata))
+	for k, v := range metadata {
+		userMeta[k] = url.PathEscape(v)
+	}
+	_, err := s.client.PutObject(context.Background(), bucket, key, bytes.NewReader(data), int64(len(data)), minio.PutObjectOptions{
+		ContentType:  contentType,
+		UserMetadata: userMeta,
+	})
+	return err
+}
+
+func (s *s3Store) Get(bucket, key string) ([]byte, error) {
+	obj, err := s.client.GetObject(context.Background(), bucket, key, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, err
+	}
+	defer obj.Close()
+
+	// Errors only surface once the body is read
+	data, err := io.ReadAll(obj)
+	if isNotFound(err) {
+		return nil, errObjectNotFound
+	}
+	return data, err
+}
+
+func (s *s3Store) Open(bucket, key string) (io.ReadCloser, error) {
+	obj, err := s.client.GetObject(context.Background(), bucket, key, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, err
+	}
+	// Stat sends the request, so a missing object is reported here
+	if _, err := obj.Stat(); err != nil {
+		obj.Close()
+		if isNotFound(err) {
+			return nil, errObjectNotFound
+		}
+		return nil, err
+	}
+	return obj, nil
+}
+
+func (s *s3Store) Stat(bucket, key string) (storageObject, error) {
+	info, err := s.client.StatObject(context.Background(), bucket, key, minio.StatObjectOptions{})
+	if isNotFound(err) {
+		return storageObject{}, errObjectNotFound
+	}
+	if err != nil {
+		return storageObject{}, err
+	}
+	return storageObject{
+		Name:        key,
+		Size:        info.Size,
+		ContentType: info.ContentType,
+		UpdatedAt:   info.LastModified,
+	}, nil
+}
+
+func (s *s3Store) Delete(bucket string, keys []string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	fmt.Printf("Deleting %d objects from %s\n", len(keys), bucket)
+
+	objects := make(chan minio.ObjectInfo, len(keys))
+	for _, key := range keys {
+		objects <- minio.ObjectInfo{Key: key}
+	}
+	close(objects)
+
+	var failed []string
+	for result := range s.client.RemoveObjects(context.Background(), bucket, objects, minio.RemoveObjectsOptions{}) {
+		if result.Err != nil && !isNotFound(result.Err) {
+			failed = append(failed, fmt.Sprintf("%s: %v", result.ObjectName, result.Err))
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("delete failed for %s", strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+// List has to read every key under the prefix, S3 only lists in key
+// order.
+func (s *s3Store) List(bucket, prefix string, limit, offset int) ([]storageObject, error) {
+	var objects []storageObject
+	for info := range s.client.ListObjects(context.Background(), bucket, minio.ListObjectsOptions{Prefix: prefix}) {
+		if info.Err != nil {
+			return nil, info.Err
+		}
+		// Common prefixes are the folders under prefix
+		if strings.HasSuffix(info.Key, "/") {
+			continue
+		}
+		objects = append(objects, storageObject{
+			Name:      strings.TrimPrefix(info.Key, prefix),
+			Size:      info.Size,
+			UpdatedAt: info.LastModified,
+		})
+	}
+	sort.SliceStable(objects, func(i, j int) bool {
+		return objects[i].UpdatedAt.Before(objects[j].UpdatedAt)
+	})
+
+	if offset >= len(objects) {
+		return nil, nil
+	}
+	objects = objects[offset:]
+	if limit > 0 && len(objects) > limit {
+		objects = objects[:limit]
+	}
+	return objects, nil
+}
+
+// PresignPut signs against MEDIA_S3_ENDPOINT, which clients must be able
+// to reach for direct uploads.
+func (s *s3Store) PresignPut(bucket, key string, ttl time.Duration) (string, error) {
+	u, err := s.client.PresignedPutObject(context.Background(), bucket, key, ttl)
+	if err != nil {
+		return "", err
+	}
+	return u.String(), nil
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+// supabaseStore talks to the Supabase Storage REST API with the service
+// key, so it can read and write private buckets too.
+type supabaseStore struct {
+	url        string
+	serviceKey string
+	client     *http.Client
+}
+
+func newSupabaseStore() (*supabaseStore, error) {
+	url := os.Getenv("SUPABASE_URL")
+	if url == "" {
+		return nil, fmt.Errorf("SUPABASE_URL is required for the supabase storage driver")
+	}
+	return &supabaseStore{
+		url:        url,
+		serviceKey: os.Getenv("SUPABASE_SERVICE_KEY"),
+		client:     &http.Client{},
+	}, nil
+}
+
+func (s *supabaseStore) URL(bucketName string, filename string) string {
+	return fmt.Sprintf("%s/storage/v1/object/%s/%s", s.url, bucketName, filename)
+}
+
+func (s *supabaseStore) do(method, url string, body io.Reader, contentType string) (*http.Response, error) {
+	req, err := http.NewRequest(method, url, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+s.serviceKey)
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	return s.client.Do(req)
+}
+
+// Put stores metadata as the object's user metadata, which Supabase takes
+// as base64 encoded JSON.
+func (s *supabaseStore) Put(bucketName string, filename string, data []byte, contentType string, metadata map[string]string) error {
+	uploadUrl := s.URL(bucketName, filename)
+	fmt.Printf("Uploading %s to %s\n", filename, uploadUrl)
+
+	req, err := http.NewRequest("PUT", uploadUrl, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Authorization", "Bearer "+s.serviceKey)
+	req.Header.Set("Content-Type", contentType)
+	// Per-user keys and retention refreshes replace the existing file
+	req.Header.Set("x-upsert", "true")
+	if len(metadata) > 0 {
+		encoded, err := json.Marshal(metadata)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("x-metadata", base64.StdEncoding.EncodeToString(encoded))
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		bodyBytes, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("status %d: %s", resp.StatusCode, string(bodyBytes))
+	}
+	return nil
+}
+
+// Stat reads the object's headers without downloading it.
+func (s *supabaseStore) Stat(bucketName string, filename string) (storageObject, error) {
+	resp, err := s.do("HEAD", s.URL(bucketName, filename), nil, "")
+	if err != nil {
+		return storageObject{}, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound, http.StatusBadRequest:
+		return storageObject{}, errObjectNotFound
+	default:
+		return storageObject{}, fmt.Errorf("status %d", resp.StatusCode)
+	}
+
+	obj := storageObject{Name: filename, ContentType: resp.Header.Get("Content-Type")}
+	obj.Size, _ = strconv.ParseInt(resp.Header.Get("Content-Length"), 10, 64)
+	obj.UpdatedAt, _ = time.Parse(http.TimeFormat, resp.Header.Get("Last-Modified"))
+	return obj, nil
+}
+
+func (s *supabaseStore) Get(bucketName string, filename string) ([]byte, error) {
+	body, err := s.Open(bucketName, filename)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	return io.ReadAll(body)
+}
+
+func (s *supabaseStore) Open(bucketName string, filename string) (io.ReadCloser, error) {
+	resp, err := s.do("GET", s.URL(bucketName, filename), nil, "")
+	if err != nil {
+		return nil, err
+	}
+
+	// Supabase answers 400 with a not_found body for missing objects
+	if resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusBadRequest {
+		resp.Body.Close()
+		return nil, errObjectNotFound
+	}
+	if resp.StatusCode != 200 {
+		bodyBytes, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		return nil, fmt.Errorf("status %d: %s", resp.StatusCode, string(bodyBytes))
+	}
+	return resp.Body, nil
+}
+
+func (s *supabaseStore) Delete(bucketName string, filenames []string) error {
+	if len(filenames) == 0 {
+		return nil
+	}
+	payload, err := json.Marshal(map[string][]string{"prefixes": filenames})
+	if err != nil {
+		return err
+	}
+
+	deleteUrl := fmt.Sprintf("%s/storage/v1/object/%s", s.url, bucketName)
+	fmt.Printf("Deleting %d objects from %s\n", len(filenames), bucketName)
+
+	resp, err := s.do("DELETE", deleteUrl, bytes.NewReader(payload), "application/json")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		bodyBytes, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("status %d: %s", resp.StatusCode, string(bodyBytes))
+	}
+	return nil
+}
+
+// PresignPut asks for a signed upload URL. Supabase fixes their lifetime
+// at two hours, ttl is not used.
+func (s *supabaseStore) PresignPut(bucketName string, filename string, ttl time.Duration) (string, error) {
+	signUrl := fmt.Sprintf("%s/storage/v1/object/upload/sign/%s/%s", s.url, bucketName, filename)
+
+	resp, err := s.do("POST", signUrl, nil, "")
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		bodyBytes, _ := io.ReadAll(resp.Body)
+		return "", fmt.Errorf("status %d: %s", resp.StatusCode, string(bodyBytes))
+	}
+
+	// The URL is relative to the storage API
+	var signed struct {
+		URL string `json:"url"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&signed); err != nil {
+		return "", err
+	}
+	return s.url + "/storage/v1" + signed.URL, nil
+}
+
+func (s *supabaseStore) List(bucketName string, prefix string, limit int, offset int) ([]storageObject, error) {
+	payload, err := json.Marshal(map[string]any{
+		"prefix": prefix,
+		"limit":  limit,
+		"offset": offset,
+		"sortBy": map[string]string{"column": "updated_at", "order": "asc"},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	listUrl := fmt.Sprintf("%s/storage/v1/object/list/%s", s.url, bucketName)
+
+	resp, err := s.do("POST", listUrl, bytes.NewReader(payload), "application/json")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		bodyBytes, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("status %d: %s", resp.StatusCode, string(bodyBytes))
+	}
+
+	var objects []storageObject
+	if err := json.NewDecoder(resp.Body).Decode(&objects); err != nil {
+		return nil, err
+	}
+	// Folders come back without timestamps
+	files := objects[:0]
+	for _, obj := range objects {
+		if !obj.UpdatedAt.IsZero() {
+			files = append(files, obj)
+		}
+	}
+	return files, nil
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestValidObjectKey(t *testing.T) {
+	tests := []struct {
+		key  string
+		want bool
+	}{
+		{key: "products/abc.jpg", want: true},
+		{key: "abc.jpg", want: true},
+		{key: "originals/receipts/abc.png", want: true},
+		{key: "..abc", want: true},
+		{key: "", want: false},
+		{key: "/etc/passwd", want: false},
+		{key: "../secret", want: false},
+		{key: "products/../../secret", want: false},
+		{key: "products/./abc.jpg", want: false},
+		{key: "products//abc.jpg", want: false},
+		{key: "products/", want: false},
+		{key: `products\..\secret`, want: false},
+		{key: "products/a\x00.jpg", want: false},
+		{key: "products/a\n.jpg", want: false},
+	}
+	for _, tt := range tests {
+		if got := validObjectKey(tt.key); got != tt.want {
+			t.Errorf("validObjectKey(%q) = %v, want %v", tt.key, got, tt.want)
+		}
+	}
+}
+
+func TestNewObjectStore(t *testing.T) {
+	t.Setenv("MEDIA_LOCAL_STORAGE_DIR", t.TempDir())
+	t.Setenv("MEDIA_STORAGE_DRIVER", "Local")
+	if store, err := newObjectStore(); err != nil {
+		t.Errorf("newObjectStore(local) error = %v", err)
+	} else if _, ok := store.(*localStore); !ok {
+		t.Errorf("newObjectStore(local) = %T", store)
+	}
+
+	t.Setenv("MEDIA_STORAGE_DRIVER", "ftp")
+	if _, err := newObjectStore(); err == nil {
+		t.Error("newObjectStore() accepted an unknown driver")
+	}
+}
+
+// testLocalStore is a local store in a temporary directory with "private"
+// as the private bucket.
+func testLocalStore(t *testing.T) *localStore {
+	t.Setenv("MEDIA_LOCAL_STORAGE_DIR", t.TempDir())
+	t.Setenv("MEDIA_LOCAL_STORAGE_URL", "http://media.test/files/")
+	t.Setenv("SUPABASE_PRIVATE_BUCKET", "private")
+	t.Setenv("MEDIA_SIGNING_KEY", "secret")
+	store, err := newLocalStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+func TestLocalStoreObjects(t *testing.T) {
+	store := testLocalStore(t)
+
+	if err := store.Put("public", "products/a.jpg", []byte("jpeg"), "image/jpeg", map[string]string{"original_name": "a.jpg"}); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := store.Get("public", "products/a.jpg"); err != nil || string(data) != "jpeg" {
+		t.Errorf("Get() = %q, %v", data, err)
+	}
+	obj, err := store.Stat("public", "products/a.jpg")
+	if err != nil || obj.Size != 4 || obj.ContentType != "image/jpeg" || obj.Name != "products/a.jpg" {
+		t.Errorf("Stat() = %+v, %v", obj, err)
+	}
+
+	// Directories and keys outside the bucket are not objects
+	for _, key := range []string{"products", "../public/products/a.jpg", "missing.jpg"} {
+		if _, err := store.Stat("public", key); !errors.Is(err, errObjectNotFound) {
+			t.Errorf("Stat(%q) error = %v, want errObjectNotFound", key, err)
+		}
+		if _, err := store.Get("public", key); !errors.Is(err, errObjectNotFound) {
+			t.Errorf("Get(%q) error = %v, want errObjectNotFound", key, err)
+		}
+	}
+	for _, bucket := range []string{"", ".meta", "a/b", ".."} {
+		if err := store.Put(bucket, "x.jpg", nil, "", nil); err == nil {
+			t.Errorf("Put() accepted bucket %q", bucket)
+		}
+	}
+	if err := store.Put("public", "../x.jpg", nil, "", nil); err == nil {
+		t.Error("Put() accepted a key outside the bucket")
+	}
+
+	if err := store.Delete("public", []string{"products/a.jpg", "products/missing.jpg"}); err != nil {
+		t.Errorf("Delete() error = %v", err)
+	}
+	if _, err := store.Stat("public", "products/a.jpg"); !errors.Is(err, errObjectNotFound) {
+		t.Errorf("Stat() after Delete() error = %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(store.root, ".meta", "public", "products", "a.jpg.json")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("metadata left after Delete(): %v", err)
+	}
+}
+
+func TestLocalStoreList(t *testing.T) {
+	store := testLocalStore(t)
+	start := time.Now().Add(-time.Hour)
+	for i, key := range []string{"receipts/b.png", "receipts/a.png", "receipts/nested/c.png", "root.png", "receipts/other.jpg"} {
+		if err := store.Put("public", key, []byte("x"), "", nil); err != nil {
+			t.Fatal(err)
+		}
+		file, _, _ := store.paths("public", key)
+		at := start.Add(time.Duration(i) * time.Minute)
+		if err := os.Chtimes(file, at, at); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		prefix        string
+		limit, offset int
+		want          []string
+	}{
+		{prefix: "receipts/", want: []string{"b.png", "a.png", "other.jpg"}},
+		{prefix: "receipts/", limit: 2, offset: 1, want: []string{"a.png", "other.jpg"}},
+		{prefix: "receipts/", offset: 3},
+		{prefix: "receipts/o", want: []string{"ther.jpg"}},
+		{prefix: "", want: []string{"root.png"}},
+		{prefix: "missing/"},
+	}
+	for _, tt := range tests {
+		objects, err := store.List("public", tt.prefix, tt.limit, tt.offset)
+		if err != nil {
+			t.Errorf("List(%q) error = %v", tt.prefix, err)
+			continue
+		}
+		var names []string
+		for _, obj := range objects {
+			names = append(names, obj.Name)
+		}
+		if len(names) != len(tt.want) {
+			t.Errorf("List(%q, %d, %d) = %v, want %v", tt.prefix, tt.limit, tt.offset, names, tt.want)
+			continue
+		}
+		for i := range names {
+			if names[i] != tt.want[i] {
+				t.Errorf("List(%q, %d, %d) = %v, want %v", tt.prefix, tt.limit, tt.offset, names, tt.want)
+				break
+			}
+		}
+	}
+
+	if _, err := store.List("public", "../", 0, 0); err == nil {
+		t.Error("List() accepted a prefix outside the bucket")
+	}
+}
+
+func TestLocalStoreURL(t *testing.T) {
+	store := testLocalStore(t)
+	if got := store.URL("public", "products/ảnh #1.jpg"); got != "http://media.test/files/public/products/%E1%BA%A3nh%20%231.jpg" {
+		t.Errorf("URL() = %q", got)
+	}
+}
+
+func TestLocalStoreHandleFile(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	store := testLocalStore(t)
+	r := gin.New()
+	r.GET("/files/:bucket/*key", store.handleFile)
+
+	for _, bucket := range []string{"public", "private"} {
+		if err := store.Put(bucket, "products/a.jpg", []byte("jpeg"), "image/jpeg", nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		path string
+		want int
+	}{
+		{path: "/files/public/products/a.jpg", want: http.StatusOK},
+		{path: "/files/public/products/b.jpg", want: http.StatusNotFound},
+		{path: "/files/private/products/a.jpg", want: http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, tt.path, nil))
+		if w.Code != tt.want {
+			t.Errorf("GET %s = %d, want %d", tt.path, w.Code, tt.want)
+		}
+		if w.Code == http.StatusOK && (w.Body.String() != "jpeg" || w.Header().Get("Content-Type") != "image/jpeg") {
+			t.Errorf("GET %s = %q as %s", tt.path, w.Body.String(), w.Header().Get("Content-Type"))
+		}
+	}
+}
+
+func TestSignLocalPut(t *testing.T) {
+	secret := []byte("secret")
+	sig := signLocalPut(secret, "private", "staging/a.jpg", 1700000000)
+	others := map[string]string{
+		"other bucket": signLocalPut(secret, "public", "staging/a.jpg", 1700000000),
+		"other key":    signLocalPut(secret, "private", "staging/b.jpg", 1700000000),
+		"later expiry": signLocalPut(secret, "private", "staging/a.jpg", 1700000001),
+		"other secret": signLocalPut([]byte("other"), "private", "staging/a.jpg", 1700000000),
+		"download":     signDownload(secret, "staging/a.jpg", 1700000000),
+	}
+	for name, other := range others {
+		if other == sig {
+			t.Errorf("signLocalPut() matches the signature for the %s", name)
+		}
+	}
+}
+
+func TestLocalStoreSignedPut(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	store := testLocalStore(t)
+	r := gin.New()
+	r.PUT("/files/:bucket/*key", store.handleSignedPut(8))
+
+	presigned := func(key string, ttl time.Duration) string {
+		link, err := store.PresignPut("private", key, ttl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return strings.TrimPrefix(link, "http://media.test")
+	}
+	if _, err := store.PresignPut("private", "../a.jpg", time.Minute); err == nil {
+		t.Error("PresignPut() accepted a key outside the bucket")
+	}
+
+	valid := presigned("staging/a.jpg", time.Minute)
+	tests := []struct {
+		name string
+		path string
+		body string
+		want int
+	}{
+		{name: "signed", path: valid, body: "jpeg", want: http.StatusOK},
+		{name: "other key", path: strings.Replace(valid, "a.jpg", "b.jpg", 1), body: "jpeg", want: http.StatusForbidden},
+		{name: "other bucket", path: strings.Replace(valid, "/private/", "/public/", 1), body: "jpeg", want: http.StatusForbidden},
+		{name: "no signature", path: strings.Split(valid, "&s=")[0], body: "jpeg", want: http.StatusForbidden},
+		{name: "expired", path: presigned("staging/c.jpg", -time.Minute), body: "jpeg", want: http.StatusForbidden},
+		{name: "too large", path: presigned("staging/d.jpg", time.Minute), body: "123456789", want: http.StatusRequestEntityTooLarge},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodPut, tt.path, strings.NewReader(tt.body))
+		req.Header.Set("Content-Type", "image/jpeg")
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		if w.Code != tt.want {
+			t.Errorf("%s: PUT = %d, want %d", tt.name, w.Code, tt.want)
+		}
+	}
+
+	if obj, err := store.Stat("private", "staging/a.jpg"); err != nil || obj.Size != 4 || obj.ContentType != "image/jpeg" {
+		t.Errorf("Stat() of the signed upload = %+v, %v", obj, err)
+	}
+	for _, key := range []string{"staging/b.jpg", "staging/c.jpg", "staging/d.jpg"} {
+		if _, err := store.Stat("private", key); !errors.Is(err, errObjectNotFound) {
+			t.Errorf("Stat(%q) error = %v, want errObjectNotFound", key, err)
+		}
+	}
+	if _, err := store.Stat("public", "staging/a.jpg"); !errors.Is(err, errObjectNotFound) {
+		t.Errorf("Stat() in the public bucket error = %v, want errObjectNotFound", err)
+	}
+}
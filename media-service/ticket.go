@@ -0,0 +1,321 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	// Clients upload directly to storage under this prefix of the private
+	// bucket, media-service processes the file from there
+	stagingPrefix = "staging/"
+	// A ticket can still be completed this long after its upload URL
+	// expired, staged files older than both are swept
+	ticketCompleteGrace  = time.Hour
+	stagingSweepInterval = time.Hour
+	// Storage and service clocks differ a little, and a PUT started just
+	// before the ticket expired may finish after it
+	ticketUploadSlack = time.Minute
+
+	codeNothingUploaded = "NOTHING_UPLOADED"
+	codeTicketExpired   = "TICKET_EXPIRED"
+)
+
+// The form fields of a regular upload a ticket keeps for processing
+var uploadOptionFields = []string{
+	"purpose", "format", "focal", "background", "crop", "auto_trim", "normalize_background", "enhance",
+}
+
+// uploadTicket is an upload whose file goes straight to storage.
+type uploadTicket struct {
+	ID          string            `json:"id"`
+	Fields      map[string]string `json:"fields"`
+	Owner       int               `json:"owner,omitempty"`
+	Filename    string            `json:"filename"`
+	ContentType string            `json:"content_type"`
+	// ExpiresAt is when the ticket stops taking uploads, whatever the
+	// storage driver allows its upload URL
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+func (t *uploadTicket) stagedKey() string {
+	return stagingPrefix + t.ID
+}
+
+// ticketStore keeps tickets in Redis until they are completed or expire.
+type ticketStore struct {
+	rdb *redis.Client
+	// ttl is how long a ticket takes uploads. Supabase upload URLs stay
+	// valid longer, so files written later are refused on completion
+	ttl time.Duration
+}
+
+func newTicketStore(rdb *redis.Client) (*ticketStore, error) {
+	minutes, err := envInt("MEDIA_UPLOAD_TICKET_TTL_MINUTES", 15)
+	if err != nil {
+		return nil, err
+	}
+	return &ticketStore{rdb: rdb, ttl: time.Duration(minutes) * time.Minute}, nil
+}
+
+func ticketKey(id string) string {
+	return "media:ticket:" + id
+}
+
+func (ts *ticketStore) Save(ctx context.Context, t *uploadTicket, ttl time.Duration) error {
+	data, err := json.Marshal(t)
+	if err != nil {
+		return err
+	}
+	return ts.rdb.Set(ctx, ticketKey(t.ID), data, ttl).Err()
+}
+
+// Take removes a ticket so only one request completes it, and returns how
+// long it had left for putting it back. It returns nil for unknown or
+// expired tickets.
+func (ts *ticketStore) Take(ctx context.Context, id string) (*uploadTicket, time.Duration, error) {
+	pipe := ts.rdb.TxPipeline()
+	ttlCmd := pipe.PTTL(ctx, ticketKey(id))
+	getCmd := pipe.GetDel(ctx, ticketKey(id))
+	if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+		return nil, 0, err
+	}
+	data, err := getCmd.Bytes()
+	if err == redis.Nil {
+		return nil, 0, nil
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	var t uploadTicket
+	if err := json.Unmarshal(data, &t); err != nil {
+		return nil, 0, err
+	}
+	return &t, ttlCmd.Val(), nil
+}
+
+// handleUploadTicket checks the options of an upload up front and hands
+// out a URL to PUT the file to, so its bytes do not pass through this
+// service until it is processed.
+func (s *mediaService) handleUploadTicket(c *gin.Context) {
+	req, err := s.parseUploadOptions(c)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	if v := c.PostForm("size"); v != "" {
+		size, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || size <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid size"})
+			return
+		}
+		if size > req.Preset.MaxBytes {
+			respondError(c, fileTooLarge(size, req.Preset.MaxBytes))
+			return
+		}
+	}
+
+	ticket := &uploadTicket{
+		Fields:      make(map[string]string),
+		Owner:       req.Owner,
+		Filename:    c.PostForm("filename"),
+		ContentType: c.PostForm("content_type"),
+		ExpiresAt:   time.Now().Add(s.tickets.ttl).Truncate(time.Second),
+	}
+	for _, name := range uploadOptionFields {
+		if v, ok := c.GetPostForm(name); ok {
+			ticket.Fields[name] = v
+		}
+	}
+	if ticket.ID, err = newUploadID(); err != nil {
+		fmt.Printf("Upload Ticket Error: %v\n", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create upload ticket"})
+		return
+	}
+
+	uploadURL, err := s.store.PresignPut(s.privateBucket, ticket.stagedKey(), s.tickets.ttl)
+	if err != nil {
+		fmt.Printf("Storage Presign Error: %v\n", err)
+		c.JSON(http.StatusBadGateway, gin.H{"error": "Failed to create upload URL"})
+		return
+	}
+	if err := s.tickets.Save(c.Request.Context(), ticket, s.tickets.ttl+ticketCompleteGrace); err != nil {
+		fmt.Printf("Upload Ticket Error: %v\n", err)
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Failed to create upload ticket"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"ticket":       ticket.ID,
+		"upload_url":   uploadURL,
+		"method":       http.MethodPut,
+		"expires_at":   ticket.ExpiresAt,
+		"complete_url": s.serviceURL + "/api/v1/media/upload/ticket/" + ticket.ID + "/complete",
+	})
+}
+
+// handleCompleteTicket processes a file the client uploaded with a ticket
+// like a regular upload and deletes the staged copy. Failures on our side
+// keep the ticket so the client can ask again.
+func (s *mediaService) handleCompleteTicket(c *gin.Context) {
+	ctx := c.Request.Context()
+	id := c.Param("id")
+	if !uploadIDPattern.MatchString(id) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Upload ticket not found or expired"})
+		return
+	}
+	ticket, remaining, err := s.tickets.Take(ctx, id)
+	if err != nil {
+		fmt.Printf("Upload Ticket Error: %v\n", err)
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Failed to load upload ticket"})
+		return
+	}
+	if ticket == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Upload ticket not found or expired"})
+		return
+	}
+	keep := func() {
+		if err := s.tickets.Save(ctx, ticket, remaining); err != nil {
+			fmt.Printf("Upload Ticket Error: %v\n", err)
+		}
+	}
+
+	if ticket.Owner != 0 {
+		if user, err := bearerUser(c); err != nil || user.ID != ticket.Owner {
+			keep()
+			c.JSON(http.StatusForbidden, gin.H{"error": "Only the user the ticket was issued to can complete it"})
+			return
+		}
+	}
+
+	staged, err := s.store.Stat(s.privateBucket, ticket.stagedKey())
+	if errors.Is(err, errObjectNotFound) {
+		keep()
+		c.JSON(http.StatusConflict, gin.H{"error": "Nothing has been uploaded for this ticket yet", "code": codeNothingUploaded})
+		return
+	}
+	if err != nil {
+		keep()
+		fmt.Printf("Storage Stat Error: %v\n", err)
+		c.JSON(http.StatusBadGateway, gin.H{"error": "Failed to load uploaded file"})
+		return
+	}
+
+	result, err := s.processTicket(ctx, ticket, staged)
+	if err != nil {
+		// A file the pipeline rejects never gets better
+		if errorStatus(err) < http.StatusInternalServerError {
+			s.deleteStaged(ticket)
+		} else {
+			keep()
+		}
+		respondError(c, err)
+		return
+	}
+	s.deleteStaged(ticket)
+	c.JSON(http.StatusOK, result)
+}
+
+func (s *mediaService) processTicket(ctx context.Context, ticket *uploadTicket, staged storageObject) (*uploadResult, error) {
+	req, err := s.uploadOptions(func(name string) (string, bool) {
+		v, ok := ticket.Fields[name]
+		return v, ok
+	}, ticket.Owner)
+	if err != nil {
+		return nil, err
+	}
+	// Presigned URLs cannot limit the size, so it is checked here
+	if staged.Size > req.Preset.MaxBytes {
+		return nil, fileTooLarge(staged.Size, req.Preset.MaxBytes)
+	}
+	if staged.UpdatedAt.After(ticket.ExpiresAt.Add(ticketUploadSlack)) {
+		return nil, &uploadError{
+			Status:  http.StatusGone,
+			Code:    codeTicketExpired,
+			Message: "The file was uploaded after the ticket expired",
+		}
+	}
+
+	// Storage keeps whatever the client sent with the PUT, only the type
+	// declared for the ticket is checked against the content
+	req.Filename = ticket.Filename
+	req.ContentType = ticket.ContentType
+	req.Data, err = s.readStaged(ticket, req.Preset.MaxBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	result, err := s.processUpload(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.recordUpload(ctx, result, req.Owner, nil); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// readStaged loads a staged file, reading at most one byte past limit. The
+// upload URL is still valid after the size was checked, so the file may
+// have been replaced with a larger one since.
+func (s *mediaService) readStaged(ticket *uploadTicket, limit int64) ([]byte, error) {
+	body, err := s.store.Open(s.privateBucket, ticket.stagedKey())
+	if err != nil {
+		fmt.Printf("Storage Download Error: %v\n", err)
+		return nil, failedUpload("Failed to load uploaded file")
+	}
+	defer body.Close()
+
+	data, err := io.ReadAll(io.LimitReader(body, limit+1))
+	if err != nil {
+		fmt.Printf("Storage Download Error: %v\n", err)
+		return nil, failedUpload("Failed to load uploaded file")
+	}
+	if int64(len(data)) > limit {
+		return nil, &uploadError{
+			Status:  http.StatusRequestEntityTooLarge,
+			Code:    codeFileTooLarge,
+			Message: fmt.Sprintf("File is larger than the maximum of %d bytes", limit),
+		}
+	}
+	return data, nil
+}
+
+func (s *mediaService) deleteStaged(ticket *uploadTicket) {
+	if err := s.store.Delete(s.privateBucket, []string{ticket.stagedKey()}); err != nil {
+		fmt.Printf("Storage Delete Error: %v\n", err)
+	}
+}
+
+// startStagingSweeper deletes staged files whose ticket expired without
+// being completed.
+func (s *mediaService) startStagingSweeper() {
+	for {
+		cutoff := time.Now().Add(-s.tickets.ttl - ticketCompleteGrace)
+		stale, _, err := s.listOlderThan(objectRef{s.privateBucket, stagingPrefix}, cutoff)
+		if err != nil {
+			fmt.Printf("Staging Sweep Error: %v\n", err)
+		}
+		keys := make([]string, len(stale))
+		for i, obj := range stale {
+			keys[i] = obj.Key
+		}
+		if len(keys) > 0 {
+			if err := s.store.Delete(s.privateBucket, keys); err != nil {
+				fmt.Printf("Staging Sweep Error: %v\n", err)
+			} else {
+				fmt.Printf("Staging sweep deleted %d abandoned uploads\n", len(keys))
+			}
+		}
+		time.Sleep(stagingSweepInterval)
+	}
+}
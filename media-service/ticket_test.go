@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// testTicketService is a media service on local storage and a fake Redis
+// with the ticket routes, taking uploads of up to 1 MB.
+func testTicketService(t *testing.T) (*mediaService, *gin.Engine) {
+	gin.SetMode(gin.TestMode)
+	presetEnv(t)
+	watermarkEnv(t)
+	testLocalStore(t)
+	t.Setenv("MEDIA_MAX_UPLOAD_MB", "1")
+	t.Setenv("MEDIA_STORAGE_DRIVER", "local")
+	t.Setenv("MEDIA_PUBLIC_URL", "http://media.test")
+	t.Setenv("MEDIA_TUS_DIR", t.TempDir())
+	t.Setenv("MEDIA_TRANSFORM_CACHE_DIR", "")
+	t.Setenv("MEDIA_UPLOAD_TICKET_TTL_MINUTES", "")
+	t.Setenv("DATABASE_URL", "")
+	rdb, _ := testRedis(t)
+	s, err := newMediaService(rdb)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := gin.New()
+	r.POST("/ticket", s.handleUploadTicket)
+	r.POST("/ticket/:id/complete", s.handleCompleteTicket)
+	return s, r
+}
+
+func issueTicket(t *testing.T, r *gin.Engine) (string, time.Time) {
+	req := httptest.NewRequest(http.MethodPost, "/ticket", strings.NewReader("filename=a.png&content_type=image/png"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	var body struct {
+		Ticket    string    `json:"ticket"`
+		UploadURL string    `json:"upload_url"`
+		ExpiresAt time.Time `json:"expires_at"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &body); w.Code != http.StatusOK || err != nil || body.UploadURL == "" {
+		t.Fatalf("POST /ticket = %d %s", w.Code, w.Body)
+	}
+	return body.Ticket, body.ExpiresAt
+}
+
+func completeTicket(r *gin.Engine, id string) int {
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/ticket/"+id+"/complete", nil))
+	return w.Code
+}
+
+func stageFile(t *testing.T, s *mediaService, id string, data []byte) {
+	if err := s.store.Put(s.privateBucket, stagingPrefix+id, data, "image/png", nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func staged(s *mediaService, id string) bool {
+	_, err := s.store.Stat(s.privateBucket, stagingPrefix+id)
+	return !errors.Is(err, errObjectNotFound)
+}
+
+func TestUploadTicketExpiry(t *testing.T) {
+	s, r := testTicketService(t)
+	id, expiresAt := issueTicket(t, r)
+	if remaining := time.Until(expiresAt); remaining <= 14*time.Minute || remaining > 15*time.Minute {
+		t.Errorf("expires_at is in %v, want the 15 minute ticket TTL", remaining)
+	}
+	ticket, _, err := s.tickets.Take(context.Background(), id)
+	if err != nil || ticket == nil || !ticket.ExpiresAt.Equal(expiresAt) {
+		t.Errorf("stored ticket = %+v, %v, want it to expire at %v", ticket, err, expiresAt)
+	}
+}
+
+func TestCompleteTicket(t *testing.T) {
+	s, r := testTicketService(t)
+
+	id, _ := issueTicket(t, r)
+	if code := completeTicket(r, id); code != http.StatusConflict {
+		t.Errorf("complete before the upload = %d, want 409", code)
+	}
+	// The ticket is kept until something was uploaded
+	if code := completeTicket(r, id); code != http.StatusConflict {
+		t.Errorf("complete again before the upload = %d, want 409", code)
+	}
+
+	stageFile(t, s, id, encodePNG(t, 400, 400))
+	if code := completeTicket(r, id); code != http.StatusOK {
+		t.Fatalf("complete = %d, want 200", code)
+	}
+	if staged(s, id) {
+		t.Error("the staged file is kept after processing")
+	}
+	if code := completeTicket(r, id); code != http.StatusNotFound {
+		t.Errorf("complete of a used ticket = %d, want 404", code)
+	}
+	if code := completeTicket(r, "0123456789abcdef0123456789abcdef"); code != http.StatusNotFound {
+		t.Errorf("complete of an unknown ticket = %d, want 404", code)
+	}
+}
+
+func TestCompleteTicketRejects(t *testing.T) {
+	s, r := testTicketService(t)
+	ctx := context.Background()
+
+	// Files over the preset limit are deleted along with the ticket
+	id, _ := issueTicket(t, r)
+	stageFile(t, s, id, make([]byte, 1<<20+1))
+	if code := completeTicket(r, id); code != http.StatusRequestEntityTooLarge {
+		t.Errorf("complete of an oversize file = %d, want 413", code)
+	}
+	if staged(s, id) {
+		t.Error("the oversize staged file is kept")
+	}
+	if code := completeTicket(r, id); code != http.StatusNotFound {
+		t.Errorf("complete after an oversize file = %d, want 404", code)
+	}
+
+	// Files written after the ticket expired, through a storage URL that
+	// outlives it
+	late := &uploadTicket{ID: "0123456789abcdef0123456789abcdef", Fields: map[string]string{}, ExpiresAt: time.Now().Add(-time.Hour)}
+	if err := s.tickets.Save(ctx, late, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	stageFile(t, s, late.ID, encodePNG(t, 400, 400))
+	if code := completeTicket(r, late.ID); code != http.StatusGone {
+		t.Errorf("complete of a late upload = %d, want 410", code)
+	}
+	if staged(s, late.ID) {
+		t.Error("the late staged file is kept")
+	}
+
+	expired := &uploadTicket{ID: "fedcba9876543210fedcba9876543210", Fields: map[string]string{}, ExpiresAt: time.Now()}
+	if err := s.tickets.Save(ctx, expired, time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(5 * time.Millisecond)
+	if code := completeTicket(r, expired.ID); code != http.StatusNotFound {
+		t.Errorf("complete of an expired ticket = %d, want 404", code)
+	}
+}
+
+func TestProcessTicketBoundsRead(t *testing.T) {
+	s, _ := testTicketService(t)
+	ticket := &uploadTicket{ID: "0123456789abcdef0123456789abcdef", Fields: map[string]string{}, ExpiresAt: time.Now().Add(time.Minute)}
+	// Replaced with a larger file after it was checked
+	stageFile(t, s, ticket.ID, bytes.Repeat([]byte{0}, 1<<20+1))
+	checked := storageObject{Size: 1000, UpdatedAt: time.Now()}
+	_, err := s.processTicket(context.Background(), ticket, checked)
+	if errorStatus(err) != http.StatusRequestEntityTooLarge || errorCode(err) != codeFileTooLarge {
+		t.Errorf("processTicket() of a grown file error = %v, want 413", err)
+	}
+}
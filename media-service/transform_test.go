@@ -0,0 +1,174 @@
+package main
+
+import (
+	"image/color"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestSignTransform(t *testing.T) {
+	secret := []byte("secret")
+	base := signTransform(secret, "products/a.jpg", url.Values{"w": {"300"}, "fit": {"cover"}})
+
+	if len(base) != 64 || strings.Trim(base, "0123456789abcdef") != "" {
+		t.Fatalf("signTransform() = %q, want 64 lowercase hex digits", base)
+	}
+	// Parameter order must not matter, url.Values.Encode sorts by name
+	if got := signTransform(secret, "products/a.jpg", url.Values{"fit": {"cover"}, "w": {"300"}}); got != base {
+		t.Errorf("signature depends on parameter order")
+	}
+
+	others := map[string]string{
+		"other key":    signTransform(secret, "products/b.jpg", url.Values{"w": {"300"}, "fit": {"cover"}}),
+		"other value":  signTransform(secret, "products/a.jpg", url.Values{"w": {"301"}, "fit": {"cover"}}),
+		"extra param":  signTransform(secret, "products/a.jpg", url.Values{"w": {"300"}, "fit": {"cover"}, "q": {"90"}}),
+		"other secret": signTransform([]byte("Secret"), "products/a.jpg", url.Values{"w": {"300"}, "fit": {"cover"}}),
+	}
+	for name, sig := range others {
+		if sig == base {
+			t.Errorf("%s: signature did not change", name)
+		}
+	}
+}
+
+func TestTransformURL(t *testing.T) {
+	s := &mediaService{signingKey: []byte("secret"), serviceURL: "https://media.example.com"}
+	link := s.transformURL("products/my photo.jpg", url.Values{"w": {"300"}, "s": {"stale"}})
+
+	u, err := url.Parse(link)
+	if err != nil {
+		t.Fatalf("transformURL() = %q: %v", link, err)
+	}
+	key, ok := strings.CutPrefix(u.Path, transformPath)
+	if !ok || key != "products/my photo.jpg" {
+		t.Fatalf("path = %q, want the key under %s", u.Path, transformPath)
+	}
+
+	// Checked the way handleTransform checks it
+	query := u.Query()
+	signature := query.Get("s")
+	query.Del("s")
+	if signature != signTransform(s.signingKey, key, query) {
+		t.Errorf("transformURL() = %q, signature does not verify", link)
+	}
+	if query.Get("w") != "300" {
+		t.Errorf("w = %q, want 300", query.Get("w"))
+	}
+}
+
+func TestTransformRejectsBadKeys(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	s := &mediaService{signingKey: []byte("secret")}
+	r := gin.New()
+	r.GET("api/v1/media/img/*key", s.handleTransform)
+
+	for _, key := range []string{"products//a.jpg", "products/./a.jpg", "products/a%00.jpg", "products/a%0A.jpg", "products/"} {
+		path := transformPath + key + "?w=100&s=" + signTransform(s.signingKey, key, url.Values{"w": {"100"}})
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("GET %s = %d, want 400", path, w.Code)
+		}
+	}
+}
+
+func TestParseTransformParams(t *testing.T) {
+	white := color.NRGBA{255, 255, 255, 255}
+	tests := []struct {
+		name    string
+		query   string
+		want    transformParams
+		wantErr bool
+	}{
+		{
+			name:  "defaults",
+			query: "",
+			want: transformParams{
+				Fit:     fitOptions{Fit: fitInside, Gravity: gravitySmart, Background: white},
+				Format:  formatAuto,
+				Quality: 80,
+			},
+		},
+		{
+			name:  "all parameters",
+			query: "w=300&h=200&fit=cover&focal=0.25,0.75&bg=000000&format=png&q=55&v=3",
+			want: transformParams{
+				Fit: fitOptions{
+					Width: 300, Height: 200, Fit: fitCover, Gravity: gravityFocal,
+					FocalX: 0.25, FocalY: 0.75, Background: color.NRGBA{0, 0, 0, 255},
+				},
+				Format:  formatPNG,
+				Quality: 55,
+			},
+		},
+		{
+			name:  "center gravity",
+			query: "w=10&fit=contain&gravity=center",
+			want: transformParams{
+				Fit:     fitOptions{Width: 10, Fit: fitContain, Gravity: gravityCenter, Background: white},
+				Format:  formatAuto,
+				Quality: 80,
+			},
+		},
+		{name: "unknown parameter", query: "width=300", wantErr: true},
+		{name: "zero width", query: "w=0", wantErr: true},
+		{name: "width too large", query: "w=4097", wantErr: true},
+		{name: "height not a number", query: "h=tall", wantErr: true},
+		{name: "unknown fit", query: "fit=stretch", wantErr: true},
+		{name: "unknown gravity", query: "gravity=north", wantErr: true},
+		{name: "focal gravity without point", query: "gravity=focal", wantErr: true},
+		{name: "focal out of range", query: "focal=1.5,0.5", wantErr: true},
+		{name: "bad background", query: "bg=red", wantErr: true},
+		{name: "bad format", query: "format=tiff", wantErr: true},
+		{name: "quality too low", query: "q=0", wantErr: true},
+		{name: "quality too high", query: "q=101", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			query, err := url.ParseQuery(tt.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := parseTransformParams(query)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("parseTransformParams(%q) = %+v, want error", tt.query, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseTransformParams(%q) error = %v", tt.query, err)
+			}
+			if got != tt.want {
+				t.Errorf("parseTransformParams(%q) = %+v, want %+v", tt.query, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseDimension(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    int
+		wantErr bool
+	}{
+		{in: "", want: 0},
+		{in: "1", want: 1},
+		{in: "4096", want: 4096},
+		{in: "0", wantErr: true},
+		{in: "-1", wantErr: true},
+		{in: "4097", wantErr: true},
+		{in: "1.5", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseDimension(tt.in)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("parseDimension(%q) = %d, %v, want %d (error %v)", tt.in, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
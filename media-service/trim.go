@@ -0,0 +1,236 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/disintegration/imaging"
+)
+
+const (
+	// trimTolerance is how far, per channel, a border pixel may be from
+	// the colour of the outermost row or column.
+	trimTolerance = 32
+	// trimCoverage is the share of a row or column that must match for it
+	// to count as border, so dust or a paper edge does not stop the trim.
+	trimCoverage = 0.97
+	// trimMarginRatio keeps a little of the border around the item.
+	trimMarginRatio = 0.02
+
+	// Near-white: bright and almost grey, so cream or pastel items are
+	// left alone.
+	whiteMinLevel  = 215
+	whiteMaxChroma = 24
+)
+
+// parseAspect reads W:H, e.g. 1:1 or 4:3.
+func parseAspect(s string) (float64, error) {
+	ws, hs, ok := strings.Cut(s, ":")
+	w, errW := strconv.ParseFloat(ws, 64)
+	h, errH := strconv.ParseFloat(hs, 64)
+	if !ok || errW != nil || errH != nil || w <= 0 || h <= 0 {
+		return 0, fmt.Errorf("aspect ratio must be W:H")
+	}
+	return w / h, nil
+}
+
+// normalizeAspect is the shape normalize_background pads listing photos
+// to, MEDIA_NORMALIZE_ASPECT or square.
+func normalizeAspect() (float64, error) {
+	v := os.Getenv("MEDIA_NORMALIZE_ASPECT")
+	if v == "" {
+		return 1, nil
+	}
+	aspect, err := parseAspect(v)
+	if err != nil {
+		return 0, fmt.Errorf("MEDIA_NORMALIZE_ASPECT: %w", err)
+	}
+	return aspect, nil
+}
+
+// autoTrim crops near-uniform borders, such as the sheet of paper an item
+// was photographed on. Each side is compared against its own outermost
+// line since lighting is rarely even across the sheet. The image is
+// returned unchanged when there is nothing to trim or when the whole image
+// looks like border.
+func autoTrim(img image.Image) (image.Image, bool) {
+	src := imaging.Clone(img)
+	b := src.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if w < 3 || h < 3 {
+		return img, false
+	}
+
+	rowMatches := func(y int, ref color.NRGBA, x0, x1 int) bool {
+		return lineMatches(src, ref, x1-x0, func(i int) (int, int) { return x0 + i, y })
+	}
+	colMatches := func(x int, ref color.NRGBA, y0, y1 int) bool {
+		return lineMatches(src, ref, y1-y0, func(i int) (int, int) { return x, y0 + i })
+	}
+
+	top, bottom, left, right := 0, h, 0, w
+	ref := lineAverage(src, w, func(i int) (int, int) { return i, 0 })
+	for top < bottom-1 && rowMatches(top, ref, 0, w) {
+		top++
+	}
+	ref = lineAverage(src, w, func(i int) (int, int) { return i, h - 1 })
+	for bottom > top+1 && rowMatches(bottom-1, ref, 0, w) {
+		bottom--
+	}
+	ref = lineAverage(src, h, func(i int) (int, int) { return 0, i })
+	for left < right-1 && colMatches(left, ref, top, bottom) {
+		left++
+	}
+	ref = lineAverage(src, h, func(i int) (int, int) { return w - 1, i })
+	for right > left+1 && colMatches(right-1, ref, top, bottom) {
+		right--
+	}
+
+	// A blank page or a near-solid image has no item to keep
+	if (right-left)*(bottom-top) < w*h/100 {
+		return img, false
+	}
+	if top == 0 && left == 0 && bottom == h && right == w {
+		return img, false
+	}
+
+	margin := int(float64(max(right-left, bottom-top)) * trimMarginRatio)
+	rect := image.Rect(
+		max(left-margin, 0), max(top-margin, 0),
+		min(right+margin, w), min(bottom+margin, h),
+	)
+	return imaging.Crop(src, rect), true
+}
+
+func lineAverage(img *image.NRGBA, n int, at func(int) (int, int)) color.NRGBA {
+	var r, g, bl int
+	for i := 0; i < n; i++ {
+		c := img.NRGBAAt(at(i))
+		r += int(c.R)
+		g += int(c.G)
+		bl += int(c.B)
+	}
+	return color.NRGBA{R: uint8(r / n), G: uint8(g / n), B: uint8(bl / n), A: 255}
+}
+
+func lineMatches(img *image.NRGBA, ref color.NRGBA, n int, at func(int) (int, int)) bool {
+	misses := 0
+	allowed := int(float64(n) * (1 - trimCoverage))
+	for i := 0; i < n; i++ {
+		c := img.NRGBAAt(at(i))
+		if absDiff(c.R, ref.R) > trimTolerance || absDiff(c.G, ref.G) > trimTolerance || absDiff(c.B, ref.B) > trimTolerance {
+			misses++
+			if misses > allowed {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func absDiff(a, b uint8) int {
+	if a > b {
+		return int(a - b)
+	}
+	return int(b - a)
+}
+
+// normalizeBackground flood fills near-white regions connected to the
+// edges with pure white, so off-white paper and uneven studio light become
+// the same white as the listing grid, then pads with white to the target
+// aspect ratio. Near-white areas inside the item are not connected to the
+// edge and keep their colour.
+func normalizeBackground(img image.Image, aspect float64) image.Image {
+	dst := imaging.Clone(img)
+	w, h := dst.Bounds().Dx(), dst.Bounds().Dy()
+
+	// One bit per pixel marks what is filled already, since filled pixels
+	// are near-white themselves
+	filled := make([]uint64, (w*h+63)/64)
+	fillable := func(x, y int) bool {
+		i := y*w + x
+		return filled[i/64]&(1<<(i%64)) == 0 && isNearWhite(dst.Pix[y*dst.Stride+x*4:])
+	}
+
+	// Scanline fill: a seed is widened to its whole run on the row, and the
+	// rows above and below get one seed per run they share with it, so the
+	// stack holds runs rather than pixels
+	type seed struct{ x, y int32 }
+	stack := make([]seed, 0, 2*(w+h))
+	for x := 0; x < w; x++ {
+		stack = append(stack, seed{int32(x), 0}, seed{int32(x), int32(h - 1)})
+	}
+	for y := 0; y < h; y++ {
+		stack = append(stack, seed{0, int32(y)}, seed{int32(w - 1), int32(y)})
+	}
+
+	for len(stack) > 0 {
+		s := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		x, y := int(s.x), int(s.y)
+		if !fillable(x, y) {
+			continue
+		}
+
+		left, right := x, x
+		for left > 0 && fillable(left-1, y) {
+			left--
+		}
+		for right < w-1 && fillable(right+1, y) {
+			right++
+		}
+		for x := left; x <= right; x++ {
+			i := y*w + x
+			filled[i/64] |= 1 << (i % 64)
+			p := dst.Pix[y*dst.Stride+x*4:]
+			p[0], p[1], p[2], p[3] = 255, 255, 255, 255
+		}
+
+		for _, ny := range [2]int{y - 1, y + 1} {
+			if ny < 0 || ny >= h {
+				continue
+			}
+			inRun := false
+			for x := left; x <= right; x++ {
+				ok := fillable(x, ny)
+				if ok && !inRun {
+					stack = append(stack, seed{int32(x), int32(ny)})
+				}
+				inRun = ok
+			}
+		}
+	}
+
+	return padToAspect(dst, aspect)
+}
+
+func isNearWhite(p []uint8) bool {
+	if p[3] < 128 {
+		// Transparent backgrounds are treated as white too
+		return true
+	}
+	r, g, b := p[0], p[1], p[2]
+	lo, hi := min(r, g, b), max(r, g, b)
+	return lo >= whiteMinLevel && int(hi-lo) <= whiteMaxChroma
+}
+
+// padToAspect centres img on a white canvas with the given width/height
+// ratio. Images already at that ratio are returned as is.
+func padToAspect(img *image.NRGBA, aspect float64) image.Image {
+	w, h := img.Bounds().Dx(), img.Bounds().Dy()
+	cw, ch := w, h
+	if float64(w)/float64(h) > aspect {
+		ch = int(float64(w)/aspect + 0.5)
+	} else {
+		cw = int(float64(h)*aspect + 0.5)
+	}
+	if cw == w && ch == h {
+		return img
+	}
+	canvas := imaging.New(cw, ch, color.White)
+	return imaging.PasteCenter(canvas, img)
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"testing"
+
+	"github.com/disintegration/imaging"
+)
+
+func TestParseAspect(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    float64
+		wantErr bool
+	}{
+		{in: "1:1", want: 1},
+		{in: "4:3", want: 4.0 / 3},
+		{in: "1.5:1", want: 1.5},
+		{in: "4", wantErr: true},
+		{in: "4:0", wantErr: true},
+		{in: "-4:3", wantErr: true},
+		{in: "4x3", wantErr: true},
+		{in: ":", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseAspect(tt.in)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("parseAspect(%q) = %v, %v, want %v (error %v)", tt.in, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestNormalizeAspect(t *testing.T) {
+	t.Setenv("MEDIA_NORMALIZE_ASPECT", "")
+	if got, err := normalizeAspect(); err != nil || got != 1 {
+		t.Errorf("normalizeAspect() = %v, %v, want square", got, err)
+	}
+	t.Setenv("MEDIA_NORMALIZE_ASPECT", "16:9")
+	if got, err := normalizeAspect(); err != nil || got != 16.0/9 {
+		t.Errorf("normalizeAspect() = %v, %v, want 16:9", got, err)
+	}
+	t.Setenv("MEDIA_NORMALIZE_ASPECT", "wide")
+	if _, err := normalizeAspect(); err == nil {
+		t.Error("normalizeAspect() accepted wide")
+	}
+}
+
+func TestAutoTrim(t *testing.T) {
+	paper := color.NRGBA{240, 238, 230, 255}
+	item := color.NRGBA{40, 60, 120, 255}
+
+	photo := imaging.New(200, 100, paper)
+	for x := 60; x < 140; x++ {
+		for y := 30; y < 70; y++ {
+			photo.Set(x, y, item)
+		}
+	}
+	trimmed, ok := autoTrim(photo)
+	// 80x40 item plus a 2% margin of the longest side on every side
+	if !ok || trimmed.Bounds().Dx() != 82 || trimmed.Bounds().Dy() != 42 {
+		t.Errorf("autoTrim() = %v, %v, want 82x42", trimmed.Bounds(), ok)
+	}
+
+	tests := []struct {
+		name string
+		img  image.Image
+	}{
+		{name: "blank page", img: imaging.New(100, 100, paper)},
+		{name: "no border", img: imaging.New(100, 100, item)},
+		{name: "too small", img: imaging.New(2, 2, paper)},
+	}
+	for _, tt := range tests {
+		if got, ok := autoTrim(tt.img); ok || got != tt.img {
+			t.Errorf("%s: autoTrim() trimmed to %v", tt.name, got.Bounds())
+		}
+	}
+}
+
+func TestNormalizeBackground(t *testing.T) {
+	offWhite := color.NRGBA{235, 232, 225, 255}
+	dark := color.NRGBA{20, 20, 20, 255}
+	white := color.NRGBA{255, 255, 255, 255}
+
+	// An off-white sheet with a dark ring; the off-white inside the ring
+	// is part of the item
+	img := imaging.New(100, 50, offWhite)
+	for x := 30; x < 70; x++ {
+		for y := 10; y < 40; y++ {
+			if x < 33 || x >= 67 || y < 13 || y >= 37 {
+				img.Set(x, y, dark)
+			}
+		}
+	}
+	// A near-white pixel that only touches the background diagonally
+	for _, p := range []image.Point{{2, 1}, {1, 2}, {3, 2}, {2, 3}} {
+		img.Set(p.X, p.Y, dark)
+	}
+
+	out := imaging.Clone(normalizeBackground(img, 1))
+	if out.Bounds().Dx() != 100 || out.Bounds().Dy() != 100 {
+		t.Fatalf("normalizeBackground() size = %v, want padded to 100x100", out.Bounds())
+	}
+
+	// Source pixels sit 25 rows down after padding
+	tests := []struct {
+		name string
+		x, y int
+		want color.NRGBA
+	}{
+		{name: "padding", x: 50, y: 5, want: white},
+		{name: "background", x: 5, y: 25 + 5, want: white},
+		{name: "background right of the item", x: 90, y: 25 + 25, want: white},
+		{name: "item", x: 31, y: 25 + 20, want: dark},
+		{name: "enclosed near-white", x: 50, y: 25 + 25, want: offWhite},
+		{name: "diagonal neighbour", x: 1, y: 25 + 1, want: white},
+		{name: "diagonal only", x: 2, y: 25 + 2, want: offWhite},
+	}
+	for _, tt := range tests {
+		if got := out.NRGBAAt(tt.x, tt.y); got != tt.want {
+			t.Errorf("%s: pixel at %d,%d = %v, want %v", tt.name, tt.x, tt.y, got, tt.want)
+		}
+	}
+}
+
+func TestNormalizeBackgroundMaze(t *testing.T) {
+	// A serpentine corridor forces the fill through every row in turn
+	const size = 401
+	img := imaging.New(size, size, color.NRGBA{20, 20, 20, 255})
+	corridor := color.NRGBA{230, 230, 230, 255}
+	for y := 0; y < size; y += 2 {
+		for x := 1; x < size-1; x++ {
+			img.Set(x, y, corridor)
+		}
+		gap := 1
+		if (y/2)%2 == 0 {
+			gap = size - 2
+		}
+		img.Set(gap, y+1, corridor)
+	}
+
+	out := imaging.Clone(normalizeBackground(img, 1))
+	for _, p := range []image.Point{{1, 0}, {200, 200}, {size - 2, size - 1}} {
+		if got := out.NRGBAAt(p.X, p.Y); got != (color.NRGBA{255, 255, 255, 255}) {
+			t.Errorf("corridor at %v = %v, want white", p, got)
+		}
+	}
+	if got := out.NRGBAAt(100, 1); got != (color.NRGBA{20, 20, 20, 255}) {
+		t.Errorf("wall = %v, want unchanged", got)
+	}
+}
+
+func TestPadToAspect(t *testing.T) {
+	tests := []struct {
+		w, h   int
+		aspect float64
+		want   image.Point
+	}{
+		{w: 200, h: 100, aspect: 1, want: image.Pt(200, 200)},
+		{w: 100, h: 200, aspect: 1, want: image.Pt(200, 200)},
+		{w: 300, h: 200, aspect: 4.0 / 3, want: image.Pt(300, 225)},
+		{w: 120, h: 90, aspect: 4.0 / 3, want: image.Pt(120, 90)},
+	}
+	for _, tt := range tests {
+		got := padToAspect(imaging.New(tt.w, tt.h, color.Black), tt.aspect)
+		if got.Bounds().Size() != tt.want {
+			t.Errorf("padToAspect(%dx%d, %v) = %v, want %v", tt.w, tt.h, tt.aspect, got.Bounds().Size(), tt.want)
+		}
+	}
+}
@@ -0,0 +1,587 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Resumable uploads follow tus 1.0 (https://tus.io/protocols/resumable-upload)
+// with the creation and expiration extensions. Abandoned uploads are left
+// to expire.
+const (
+	tusVersion       = "1.0.0"
+	tusExtensions    = "creation,expiration"
+	tusPath          = "/api/v1/media/tus/"
+	tusSweepInterval = time.Hour
+
+	codeUploadQuota = "UPLOAD_QUOTA_EXCEEDED"
+)
+
+var errTusNotFound = errors.New("upload not found")
+
+// tusUpload is kept as JSON next to the bytes received so far. The offset
+// is the size of the data file.
+type tusUpload struct {
+	ID     string `json:"id"`
+	Length int64  `json:"length"`
+	// Metadata is the Upload-Metadata header as the client sent it
+	Metadata string `json:"metadata,omitempty"`
+	Owner    int    `json:"owner,omitempty"`
+	// Client is who the open upload counts against, the user or for
+	// uploads without an access token the IP address
+	Client    string    `json:"client"`
+	ExpiresAt time.Time `json:"expires_at"`
+	// Result is set once the upload was processed, its data is gone then
+	Result json.RawMessage `json:"result,omitempty"`
+}
+
+// tusStore keeps partial uploads on local disk until they complete or
+// expire, whichever storage backend the finished files go to.
+type tusStore struct {
+	dir    string
+	expiry time.Duration
+	// Bytes open uploads may take on disk, in total and per client. Uploads
+	// count with their full length from the moment they are created.
+	maxOpen, maxOpenPerClient int64
+	// One request at a time may write to an upload
+	locks sync.Map
+	// Creates are checked against the quota one at a time
+	createMu sync.Mutex
+}
+
+func newTusStore() (*tusStore, error) {
+	dir := os.Getenv("MEDIA_TUS_DIR")
+	if dir == "" {
+		dir = "tus-uploads"
+	}
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("MEDIA_TUS_DIR: %w", err)
+	}
+	hours, err := envInt("MEDIA_TUS_EXPIRY_HOURS", 24)
+	if err != nil {
+		return nil, err
+	}
+	maxOpenMB, err := envInt("MEDIA_TUS_MAX_OPEN_MB", 2048)
+	if err != nil {
+		return nil, err
+	}
+	perClientMB, err := envInt("MEDIA_TUS_MAX_OPEN_PER_CLIENT_MB", 200)
+	if err != nil {
+		return nil, err
+	}
+	return &tusStore{
+		dir:              dir,
+		expiry:           time.Duration(hours) * time.Hour,
+		maxOpen:          int64(maxOpenMB) << 20,
+		maxOpenPerClient: int64(perClientMB) << 20,
+	}, nil
+}
+
+func (t *tusStore) infoPath(id string) string {
+	return filepath.Join(t.dir, id+".info")
+}
+
+func (t *tusStore) dataPath(id string) string {
+	return filepath.Join(t.dir, id+".bin")
+}
+
+// Create starts an upload with no bytes received, if the quota leaves
+// room for its length.
+func (t *tusStore) Create(u *tusUpload) error {
+	t.createMu.Lock()
+	defer t.createMu.Unlock()
+
+	open, err := t.openUploads()
+	if err != nil {
+		return err
+	}
+	if err := t.checkQuota(open, u); err != nil {
+		return err
+	}
+	if err := os.WriteFile(t.dataPath(u.ID), nil, 0o600); err != nil {
+		return err
+	}
+	return t.Save(u)
+}
+
+// checkQuota fails when an upload would not fit next to the open ones.
+func (t *tusStore) checkQuota(open []*tusUpload, u *tusUpload) error {
+	var total, client int64
+	for _, o := range open {
+		total += o.Length
+		if o.Client == u.Client {
+			client += o.Length
+		}
+	}
+	if client+u.Length > t.maxOpenPerClient {
+		return &uploadError{
+			Status:  http.StatusTooManyRequests,
+			Code:    codeUploadQuota,
+			Message: fmt.Sprintf("Unfinished uploads would take %d bytes, the maximum is %d, finish or wait for earlier ones to expire", client+u.Length, t.maxOpenPerClient),
+		}
+	}
+	if total+u.Length > t.maxOpen {
+		return &uploadError{
+			Status:  http.StatusServiceUnavailable,
+			Code:    codeUploadQuota,
+			Message: "Too many uploads in progress, try again later",
+		}
+	}
+	return nil
+}
+
+// openUploads returns the uploads still receiving bytes.
+func (t *tusStore) openUploads() ([]*tusUpload, error) {
+	entries, err := os.ReadDir(t.dir)
+	if err != nil {
+		return nil, err
+	}
+	var open []*tusUpload
+	for _, entry := range entries {
+		id, ok := strings.CutSuffix(entry.Name(), ".info")
+		if !ok {
+			continue
+		}
+		u, err := t.Load(id)
+		if errors.Is(err, errTusNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if u.Result == nil {
+			open = append(open, u)
+		}
+	}
+	return open, nil
+}
+
+func (t *tusStore) Save(u *tusUpload) error {
+	data, err := json.Marshal(u)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(t.infoPath(u.ID), data)
+}
+
+// Load returns an upload that has not expired yet.
+func (t *tusStore) Load(id string) (*tusUpload, error) {
+	if !uploadIDPattern.MatchString(id) {
+		return nil, errTusNotFound
+	}
+	data, err := os.ReadFile(t.infoPath(id))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, errTusNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	var u tusUpload
+	if err := json.Unmarshal(data, &u); err != nil {
+		return nil, err
+	}
+	if time.Now().After(u.ExpiresAt) {
+		return nil, errTusNotFound
+	}
+	return &u, nil
+}
+
+// Offset returns how many bytes of an upload were received.
+func (t *tusStore) Offset(u *tusUpload) (int64, error) {
+	if u.Result != nil {
+		return u.Length, nil
+	}
+	info, err := os.Stat(t.dataPath(u.ID))
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+// Lock reserves an upload for one request. It returns false while another
+// request holds it.
+func (t *tusStore) Lock(id string) (func(), bool) {
+	v, _ := t.locks.LoadOrStore(id, &sync.Mutex{})
+	mu := v.(*sync.Mutex)
+	if !mu.TryLock() {
+		return nil, false
+	}
+	return mu.Unlock, true
+}
+
+func (t *tusStore) Remove(id string) {
+	for _, path := range []string{t.dataPath(id), t.infoPath(id)} {
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			fmt.Printf("Tus Cleanup Error: %v\n", err)
+		}
+	}
+	t.locks.Delete(id)
+}
+
+// Sweep removes expired uploads and returns how many there were.
+func (t *tusStore) Sweep() (int, error) {
+	entries, err := os.ReadDir(t.dir)
+	if err != nil {
+		return 0, err
+	}
+	removed := 0
+	for _, entry := range entries {
+		id, ok := strings.CutSuffix(entry.Name(), ".info")
+		if !ok || !uploadIDPattern.MatchString(id) {
+			continue
+		}
+		if _, err := t.Load(id); errors.Is(err, errTusNotFound) {
+			t.Remove(id)
+			removed++
+		}
+	}
+	return removed, nil
+}
+
+// startTusSweeper deletes expired partial uploads and the results of
+// finished ones.
+func (s *mediaService) startTusSweeper() {
+	for {
+		removed, err := s.tus.Sweep()
+		if err != nil {
+			fmt.Printf("Tus Sweep Error: %v\n", err)
+		}
+		if removed > 0 {
+			fmt.Printf("Tus sweep removed %d expired uploads\n", removed)
+		}
+		time.Sleep(tusSweepInterval)
+	}
+}
+
+// parseTusMetadata decodes an Upload-Metadata header, comma separated
+// keys each followed by a space and the base64 encoded value.
+func parseTusMetadata(header string) (map[string]string, error) {
+	meta := make(map[string]string)
+	for _, pair := range strings.Split(header, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		key, encoded, _ := strings.Cut(pair, " ")
+		value, err := base64.StdEncoding.DecodeString(encoded)
+		if key == "" || err != nil {
+			return nil, fmt.Errorf("invalid Upload-Metadata entry %q", key)
+		}
+		meta[key] = string(value)
+	}
+	return meta, nil
+}
+
+// tusOptions reads the upload options from the metadata under the same
+// names as the form fields of a regular upload.
+func (s *mediaService) tusOptions(u *tusUpload) (uploadRequest, map[string]string, error) {
+	meta, err := parseTusMetadata(u.Metadata)
+	if err != nil {
+		return uploadRequest{}, nil, badUpload("%v", err)
+	}
+	req, err := s.uploadOptions(func(name string) (string, bool) {
+		v, ok := meta[name]
+		return v, ok
+	}, u.Owner)
+	return req, meta, err
+}
+
+// tusProtocol answers requests from clients speaking another tus version
+// with 412.
+func tusProtocol() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Header("Tus-Resumable", tusVersion)
+		if c.Request.Method != http.MethodOptions && c.GetHeader("Tus-Resumable") != tusVersion {
+			c.Header("Tus-Version", tusVersion)
+			c.AbortWithStatusJSON(http.StatusPreconditionFailed, gin.H{"error": "Unsupported tus version, " + tusVersion + " is required"})
+			return
+		}
+		c.Next()
+	}
+}
+
+func (s *mediaService) handleTusOptions(c *gin.Context) {
+	c.Header("Tus-Version", tusVersion)
+	c.Header("Tus-Extension", tusExtensions)
+	c.Header("Tus-Max-Size", strconv.FormatInt(s.maxUploadBytes(), 10))
+	c.Status(http.StatusNoContent)
+}
+
+// handleTusCreate starts a resumable upload. The options of a regular
+// upload come in Upload-Metadata, together with filename and filetype, and
+// are checked before any bytes are sent.
+func (s *mediaService) handleTusCreate(c *gin.Context) {
+	if c.GetHeader("Upload-Defer-Length") != "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Upload-Length is required, deferred lengths are not supported"})
+		return
+	}
+	length, err := strconv.ParseInt(c.GetHeader("Upload-Length"), 10, 64)
+	if err != nil || length < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid Upload-Length"})
+		return
+	}
+	if length == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "File is required"})
+		return
+	}
+
+	u := &tusUpload{
+		Length:    length,
+		Metadata:  c.GetHeader("Upload-Metadata"),
+		ExpiresAt: time.Now().Add(s.tus.expiry),
+	}
+	if user, err := bearerUser(c); err == nil {
+		u.Owner = user.ID
+		u.Client = "user:" + strconv.Itoa(user.ID)
+	} else {
+		u.Client = "ip:" + c.ClientIP()
+	}
+	req, _, err := s.tusOptions(u)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	if length > req.Preset.MaxBytes {
+		respondError(c, fileTooLarge(length, req.Preset.MaxBytes))
+		return
+	}
+
+	if u.ID, err = newUploadID(); err == nil {
+		err = s.tus.Create(u)
+	}
+	var quotaErr *uploadError
+	if errors.As(err, &quotaErr) {
+		respondError(c, err)
+		return
+	}
+	if err != nil {
+		fmt.Printf("Tus Create Error: %v\n", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start upload"})
+		return
+	}
+
+	c.Header("Location", s.serviceURL+tusPath+u.ID)
+	c.Header("Upload-Expires", u.ExpiresAt.UTC().Format(http.TimeFormat))
+	c.Status(http.StatusCreated)
+}
+
+// loadTusUpload answers 404 for unknown or expired uploads.
+func (s *mediaService) loadTusUpload(c *gin.Context) (*tusUpload, bool) {
+	u, err := s.tus.Load(c.Param("id"))
+	if errors.Is(err, errTusNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Upload not found or expired"})
+		return nil, false
+	}
+	if err != nil {
+		fmt.Printf("Tus Load Error: %v\n", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load upload"})
+		return nil, false
+	}
+	return u, true
+}
+
+// lockTusUpload loads an upload and reserves it for this request.
+func (s *mediaService) lockTusUpload(c *gin.Context) (*tusUpload, func(), bool) {
+	// Only existing uploads get a lock
+	if _, ok := s.loadTusUpload(c); !ok {
+		return nil, nil, false
+	}
+	unlock, ok := s.tus.Lock(c.Param("id"))
+	if !ok {
+		c.JSON(http.StatusConflict, gin.H{"error": "Upload is being written by another request"})
+		return nil, nil, false
+	}
+	// Another request may have finished it in the meantime
+	u, ok := s.loadTusUpload(c)
+	if !ok {
+		unlock()
+		return nil, nil, false
+	}
+	return u, unlock, true
+}
+
+// handleTusHead reports how much of an upload was received, so a client
+// can resume after losing its connection.
+func (s *mediaService) handleTusHead(c *gin.Context) {
+	u, ok := s.loadTusUpload(c)
+	if !ok {
+		return
+	}
+	offset, err := s.tus.Offset(u)
+	if err != nil {
+		fmt.Printf("Tus Offset Error: %v\n", err)
+		c.Status(http.StatusInternalServerError)
+		return
+	}
+	c.Header("Cache-Control", "no-store")
+	c.Header("Upload-Offset", strconv.FormatInt(offset, 10))
+	c.Header("Upload-Length", strconv.FormatInt(u.Length, 10))
+	if u.Metadata != "" {
+		c.Header("Upload-Metadata", u.Metadata)
+	}
+	c.Header("Upload-Expires", u.ExpiresAt.UTC().Format(http.TimeFormat))
+	c.Status(http.StatusOK)
+}
+
+// handleTusPatch appends a chunk at the offset the client states. The
+// request completing the upload processes it and answers 200 with the
+// same result as a regular upload instead of 204.
+func (s *mediaService) handleTusPatch(c *gin.Context) {
+	if c.ContentType() != "application/offset+octet-stream" {
+		c.JSON(http.StatusUnsupportedMediaType, gin.H{"error": "Content-Type must be application/offset+octet-stream"})
+		return
+	}
+	u, unlock, ok := s.lockTusUpload(c)
+	if !ok {
+		return
+	}
+	defer unlock()
+
+	offset, err := s.tus.Offset(u)
+	if err != nil {
+		fmt.Printf("Tus Offset Error: %v\n", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load upload"})
+		return
+	}
+	claimed, err := strconv.ParseInt(c.GetHeader("Upload-Offset"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid Upload-Offset"})
+		return
+	}
+	c.Header("Upload-Offset", strconv.FormatInt(offset, 10))
+	if claimed != offset {
+		c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("Upload-Offset is %d, not %d", offset, claimed)})
+		return
+	}
+	// The response to the last chunk was lost, answer it again
+	if u.Result != nil {
+		c.Data(http.StatusOK, "application/json; charset=utf-8", u.Result)
+		return
+	}
+
+	written, err := s.appendTusChunk(u, offset, c.Request.Body)
+	offset += written
+	c.Header("Upload-Offset", strconv.FormatInt(offset, 10))
+	if errors.Is(err, errChunkTooLong) {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": fmt.Sprintf("Upload is %d bytes, the chunk goes past the end", u.Length)})
+		return
+	}
+	if err != nil {
+		// Whatever arrived before the connection dropped is kept
+		fmt.Printf("Tus Write Error: %v\n", err)
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Upload was interrupted, resume from Upload-Offset"})
+		return
+	}
+
+	u.ExpiresAt = time.Now().Add(s.tus.expiry)
+	if err := s.tus.Save(u); err != nil {
+		fmt.Printf("Tus Save Error: %v\n", err)
+	}
+	c.Header("Upload-Expires", u.ExpiresAt.UTC().Format(http.TimeFormat))
+	if offset < u.Length {
+		c.Status(http.StatusNoContent)
+		return
+	}
+
+	result, err := s.completeTusUpload(c.Request.Context(), u)
+	if err != nil {
+		// A file the pipeline rejects never gets better, failures on our
+		// side can be retried with an empty PATCH
+		if errorStatus(err) < http.StatusInternalServerError {
+			s.tus.Remove(u.ID)
+		}
+		respondError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, result)
+}
+
+var errChunkTooLong = errors.New("chunk goes past the upload length")
+
+// appendTusChunk writes a request body to the end of the upload and
+// returns how much of it was kept.
+func (s *mediaService) appendTusChunk(u *tusUpload, offset int64, body io.Reader) (int64, error) {
+	file, err := os.OpenFile(s.tus.dataPath(u.ID), os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return 0, err
+	}
+	remaining := u.Length - offset
+	written, err := io.Copy(file, io.LimitReader(body, remaining+1))
+	if written > remaining {
+		written = remaining
+		err = errChunkTooLong
+		if terr := file.Truncate(u.Length); terr != nil {
+			fmt.Printf("Tus Write Error: %v\n", terr)
+		}
+	}
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	return written, err
+}
+
+// completeTusUpload runs a fully received upload through the regular
+// pipeline and keeps the result until the upload expires.
+func (s *mediaService) completeTusUpload(ctx context.Context, u *tusUpload) (*uploadResult, error) {
+	req, meta, err := s.tusOptions(u)
+	if err != nil {
+		return nil, err
+	}
+	req.Filename = meta["filename"]
+	req.ContentType = meta["filetype"]
+	req.Data, err = os.ReadFile(s.tus.dataPath(u.ID))
+	if err != nil {
+		fmt.Printf("Tus Read Error: %v\n", err)
+		return nil, failedUpload("Failed to read upload")
+	}
+
+	result, err := s.processUpload(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.recordUpload(ctx, result, req.Owner, nil); err != nil {
+		return nil, err
+	}
+
+	if u.Result, err = json.Marshal(result); err == nil {
+		err = s.tus.Save(u)
+	}
+	if err != nil {
+		fmt.Printf("Tus Save Error: %v\n", err)
+	}
+	if err := os.Remove(s.tus.dataPath(u.ID)); err != nil {
+		fmt.Printf("Tus Cleanup Error: %v\n", err)
+	}
+	return result, nil
+}
+
+// handleTusResult returns the result of a finished upload, for clients
+// that resumed after the last chunk was stored but never saw the answer.
+func (s *mediaService) handleTusResult(c *gin.Context) {
+	u, ok := s.loadTusUpload(c)
+	if !ok {
+		return
+	}
+	if u.Result == nil {
+		c.JSON(http.StatusConflict, gin.H{"error": "Upload is not complete"})
+		return
+	}
+	c.Data(http.StatusOK, "application/json; charset=utf-8", u.Result)
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestParseTusMetadata(t *testing.T) {
+	b64 := func(s string) string { return base64.StdEncoding.EncodeToString([]byte(s)) }
+	tests := []struct {
+		header  string
+		want    map[string]string
+		wantErr bool
+	}{
+		{header: "", want: map[string]string{}},
+		{
+			header: "filename " + b64("ảnh 1.jpg") + ", purpose " + b64("product") + ",crop",
+			want:   map[string]string{"filename": "ảnh 1.jpg", "purpose": "product", "crop": ""},
+		},
+		{header: " , filetype " + b64("image/png") + " ,", want: map[string]string{"filetype": "image/png"}},
+		{header: "filename not-base64!", wantErr: true},
+		{header: " " + b64("product"), want: map[string]string{b64("product"): ""}},
+	}
+	for _, tt := range tests {
+		got, err := parseTusMetadata(tt.header)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("parseTusMetadata(%q) = %v, want error", tt.header, got)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseTusMetadata(%q) = %v, %v, want %v", tt.header, got, err, tt.want)
+		}
+	}
+}
+
+// testTusStore is a tus store in a temporary directory with a 100 byte
+// quota, 40 bytes of it per client.
+func testTusStore(t *testing.T) *tusStore {
+	t.Setenv("MEDIA_TUS_DIR", t.TempDir())
+	t.Setenv("MEDIA_TUS_EXPIRY_HOURS", "")
+	t.Setenv("MEDIA_TUS_MAX_OPEN_MB", "")
+	t.Setenv("MEDIA_TUS_MAX_OPEN_PER_CLIENT_MB", "")
+	store, err := newTusStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if store.maxOpen != 2048<<20 || store.maxOpenPerClient != 200<<20 || store.expiry != 24*time.Hour {
+		t.Errorf("newTusStore() = %+v", store)
+	}
+	store.maxOpen, store.maxOpenPerClient = 100, 40
+	return store
+}
+
+func createTusUpload(t *testing.T, store *tusStore, client string, length int64) (*tusUpload, error) {
+	id, err := newUploadID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	u := &tusUpload{ID: id, Length: length, Client: client, ExpiresAt: time.Now().Add(time.Hour)}
+	return u, store.Create(u)
+}
+
+func TestTusStoreQuota(t *testing.T) {
+	store := testTusStore(t)
+
+	first, err := createTusUpload(t, store, "ip:192.0.2.1", 30)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name   string
+		client string
+		length int64
+		status int
+	}{
+		{name: "past the client quota", client: "ip:192.0.2.1", length: 11, status: http.StatusTooManyRequests},
+		{name: "up to the client quota", client: "ip:192.0.2.1", length: 10},
+		{name: "another client", client: "user:7", length: 40},
+		{name: "past the total quota", client: "ip:192.0.2.2", length: 21, status: http.StatusServiceUnavailable},
+		{name: "up to the total quota", client: "ip:192.0.2.2", length: 20},
+	}
+	for _, tt := range tests {
+		_, err := createTusUpload(t, store, tt.client, tt.length)
+		if tt.status == 0 {
+			if err != nil {
+				t.Errorf("%s: Create() error = %v", tt.name, err)
+			}
+			continue
+		}
+		if errorStatus(err) != tt.status || errorCode(err) != codeUploadQuota {
+			t.Errorf("%s: Create() error = %v, want %d %s", tt.name, err, tt.status, codeUploadQuota)
+		}
+	}
+
+	// Finished and expired uploads free their share
+	first.Result = []byte(`{}`)
+	if err := store.Save(first); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := createTusUpload(t, store, "ip:192.0.2.1", 30); err != nil {
+		t.Errorf("Create() after finishing an upload error = %v", err)
+	}
+	open, err := store.openUploads()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, u := range open {
+		if u.Client == "user:7" {
+			u.ExpiresAt = time.Now().Add(-time.Minute)
+			if err := store.Save(u); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if _, err := createTusUpload(t, store, "user:8", 40); err != nil {
+		t.Errorf("Create() after an upload expired error = %v", err)
+	}
+}
+
+func TestTusCreateClientAddress(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	presetEnv(t)
+	t.Setenv("MEDIA_TRUSTED_PROXIES", "")
+	presets, err := loadPresets(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &mediaService{tus: testTusStore(t), presets: presets, serviceURL: "http://media.test"}
+	r := gin.New()
+	if err := r.SetTrustedProxies(trustedProxies()); err != nil {
+		t.Fatal(err)
+	}
+	r.POST("/tus", s.handleTusCreate)
+
+	create := func(forwardedFor string) int {
+		req := httptest.NewRequest(http.MethodPost, "/tus", nil)
+		req.RemoteAddr = "192.0.2.1:5000"
+		req.Header.Set("Upload-Length", "30")
+		if forwardedFor != "" {
+			req.Header.Set("X-Forwarded-For", forwardedFor)
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w.Code
+	}
+	if code := create(""); code != http.StatusCreated {
+		t.Fatalf("first POST = %d, want 201", code)
+	}
+	// Without trusted proxies a forged header is the same client
+	if code := create("198.51.100.7"); code != http.StatusTooManyRequests {
+		t.Errorf("POST with a forged X-Forwarded-For = %d, want 429", code)
+	}
+}
+
+func TestAppendTusChunk(t *testing.T) {
+	s := &mediaService{tus: testTusStore(t)}
+	u, err := createTusUpload(t, s.tus, "user:1", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n, err := s.appendTusChunk(u, 0, strings.NewReader("abcd")); n != 4 || err != nil {
+		t.Errorf("appendTusChunk() = %d, %v, want 4", n, err)
+	}
+	if offset, err := s.tus.Offset(u); offset != 4 || err != nil {
+		t.Errorf("Offset() = %d, %v, want 4", offset, err)
+	}
+
+	// A dropped connection keeps what arrived
+	body := io.MultiReader(strings.NewReader("ef"), failingReader{errors.New("connection reset")})
+	if n, err := s.appendTusChunk(u, 4, body); n != 2 || err == nil {
+		t.Errorf("appendTusChunk() of a broken body = %d, %v, want 2 and an error", n, err)
+	}
+
+	if n, err := s.appendTusChunk(u, 6, strings.NewReader("ghijklmn")); n != 4 || !errors.Is(err, errChunkTooLong) {
+		t.Errorf("appendTusChunk() past the end = %d, %v, want 4, errChunkTooLong", n, err)
+	}
+	if data, _ := os.ReadFile(s.tus.dataPath(u.ID)); string(data) != "abcdefghij" {
+		t.Errorf("upload data = %q, want the first 10 bytes", data)
+	}
+
+	u.Result = []byte(`{}`)
+	if offset, err := s.tus.Offset(u); offset != 10 || err != nil {
+		t.Errorf("Offset() of a finished upload = %d, %v, want its length", offset, err)
+	}
+}
+
+// failingReader is a reader that always fails.
+type failingReader struct{ err error }
+
+func (r failingReader) Read([]byte) (int, error) { return 0, r.err }
+
+func TestTusPatchOffset(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	s := &mediaService{tus: testTusStore(t)}
+	r := gin.New()
+	r.HEAD("/tus/:id", s.handleTusHead)
+	r.PATCH("/tus/:id", s.handleTusPatch)
+	u, err := createTusUpload(t, s.tus, "user:1", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name        string
+		offset      string
+		contentType string
+		body        string
+		want        int
+		wantOffset  string
+	}{
+		{name: "first chunk", offset: "0", body: "abcd", want: http.StatusNoContent, wantOffset: "4"},
+		{name: "stale offset", offset: "0", body: "abcd", want: http.StatusConflict, wantOffset: "4"},
+		{name: "offset ahead", offset: "8", body: "ij", want: http.StatusConflict, wantOffset: "4"},
+		{name: "bad offset", offset: "x", body: "ef", want: http.StatusBadRequest},
+		{name: "wrong content type", offset: "4", contentType: "application/octet-stream", body: "ef", want: http.StatusUnsupportedMediaType},
+		{name: "too long", offset: "4", body: "efghijk", want: http.StatusRequestEntityTooLarge, wantOffset: "10"},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodPatch, "/tus/"+u.ID, strings.NewReader(tt.body))
+		req.Header.Set("Upload-Offset", tt.offset)
+		req.Header.Set("Content-Type", "application/offset+octet-stream")
+		if tt.contentType != "" {
+			req.Header.Set("Content-Type", tt.contentType)
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		if w.Code != tt.want || w.Header().Get("Upload-Offset") != tt.wantOffset {
+			t.Errorf("%s: PATCH = %d at offset %q, want %d at %q", tt.name, w.Code, w.Header().Get("Upload-Offset"), tt.want, tt.wantOffset)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodHead, "/tus/"+u.ID, nil))
+	if w.Code != http.StatusOK || w.Header().Get("Upload-Offset") != "10" || w.Header().Get("Upload-Length") != "10" {
+		t.Errorf("HEAD = %d at offset %q of %q", w.Code, w.Header().Get("Upload-Offset"), w.Header().Get("Upload-Length"))
+	}
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodHead, "/tus/0123456789abcdef0123456789abcdef", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("HEAD of an unknown upload = %d, want 404", w.Code)
+	}
+}
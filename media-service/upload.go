@@ -0,0 +1,738 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/gif"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/disintegration/imaging"
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	purposeProduct  = "product"
+	purposeAvatar   = "avatar"
+	purposeReceipt  = "receipt"
+	purposeShipping = "shipping"
+)
+
+// builtinPurposes always have a preset, configured from the environment
+// unless the presets file overrides them.
+var builtinPurposes = []string{purposeProduct, purposeAvatar, purposeReceipt, purposeShipping}
+
+func validPurpose(p string) bool {
+	switch p {
+	case purposeProduct, purposeAvatar, purposeReceipt, purposeShipping:
+		return true
+	}
+	return false
+}
+
+type mediaService struct {
+	presets       map[string]*purposePreset
+	watermark     *watermark
+	store         objectStore
+	publicBucket  string
+	privateBucket string
+	signingKey    []byte
+	// serviceURL is where clients reach this service, for signed links
+	serviceURL   string
+	signedURLTTL time.Duration
+	renderCache  *renderCache
+	phash        *phashIndex
+	batch        batchConfig
+	limits       *decodeLimits
+	animation    animationConfig
+	aspect       float64
+	registry     *mediaRegistry
+	// db is app-service's database, nil when DATABASE_URL is not set
+	db      *pgxpool.Pool
+	gc      gcConfig
+	gcMu    sync.Mutex
+	tus     *tusStore
+	tickets *ticketStore
+}
+
+func newMediaService(rdb *redis.Client) (*mediaService, error) {
+	wm, err := loadWatermark()
+	if err != nil {
+		return nil, err
+	}
+
+	presets, err := loadPresets(wm)
+	if err != nil {
+		return nil, err
+	}
+
+	store, err := newObjectStore()
+	if err != nil {
+		return nil, err
+	}
+
+	cache, err := newRenderCache()
+	if err != nil {
+		return nil, err
+	}
+
+	phash, err := newPhashIndex(rdb)
+	if err != nil {
+		return nil, err
+	}
+
+	batch, err := loadBatchConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	limits, err := loadDecodeLimits()
+	if err != nil {
+		return nil, err
+	}
+
+	animation, err := loadAnimationConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	aspect, err := normalizeAspect()
+	if err != nil {
+		return nil, err
+	}
+
+	db, err := newReferenceDB()
+	if err != nil {
+		return nil, err
+	}
+
+	gc, err := loadGCConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	tus, err := newTusStore()
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range presets {
+		if p.MaxBytes > tus.maxOpenPerClient {
+			return nil, fmt.Errorf("MEDIA_TUS_MAX_OPEN_PER_CLIENT_MB is below the %d MB %s uploads may take", p.MaxBytes>>20, p.Name)
+		}
+	}
+
+	tickets, err := newTicketStore(rdb)
+	if err != nil {
+		return nil, err
+	}
+
+	signingKey := os.Getenv("MEDIA_SIGNING_KEY")
+	if signingKey == "" {
+		return nil, fmt.Errorf("MEDIA_SIGNING_KEY is required to sign transform and private download links")
+	}
+	signedURLTTL, err := loadSignedURLTTL()
+	if err != nil {
+		return nil, err
+	}
+
+	return &mediaService{
+		presets:       presets,
+		watermark:     wm,
+		store:         store,
+		publicBucket:  os.Getenv("SUPABASE_BUCKET"),
+		privateBucket: os.Getenv("SUPABASE_PRIVATE_BUCKET"),
+		signingKey:    []byte(signingKey),
+		serviceURL:    publicServiceURL(),
+		signedURLTTL:  signedURLTTL,
+		renderCache:   cache,
+		phash:         phash,
+		batch:         batch,
+		limits:        limits,
+		animation:     animation,
+		aspect:        aspect,
+		registry:      &mediaRegistry{rdb: rdb},
+		db:            db,
+		gc:            gc,
+		tus:           tus,
+		tickets:       tickets,
+	}, nil
+}
+
+// Resumable uploads and upload tickets are named by random IDs
+var uploadIDPattern = regexp.MustCompile(`^[0-9a-f]{32}$`)
+
+func newUploadID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// maxUploadBytes is the size limit of the most permissive purpose.
+func (s *mediaService) maxUploadBytes() int64 {
+	var largest int64
+	for _, p := range s.presets {
+		largest = max(largest, p.MaxBytes)
+	}
+	return largest
+}
+
+// uploadRequest is one file plus the options shared by single and batch
+// uploads.
+type uploadRequest struct {
+	Filename    string
+	ContentType string
+	Data        []byte
+	Purpose     string
+	Preset      *purposePreset
+	Format      outputFormat
+	Fit         fitOptions
+	// Clean-up applied to the source before any resizing
+	AutoTrim            bool
+	NormalizeBackground bool
+	// Enhance runs on every variant after it is resized
+	Enhance bool
+	// Crop is the client's crop rectangle for square presets, nil for the
+	// centre square
+	Crop *image.Rectangle
+	// Owner is the uploading user, zero for anonymous uploads. Presets
+	// with per-user keys require one.
+	Owner int
+}
+
+type uploadResult struct {
+	URL                  string           `json:"url"`
+	Width                int              `json:"width"`
+	Height               int              `json:"height"`
+	AspectRatio          float64          `json:"aspect_ratio"`
+	BlurHash             string           `json:"blurhash"`
+	LQIP                 string           `json:"lqip"`
+	DominantColor        string           `json:"dominant_color"`
+	OriginalName         string           `json:"original_name"`
+	DetectedType         string           `json:"detected_type"`
+	Processed            bool             `json:"processed"`
+	Purpose              string           `json:"purpose"`
+	Format               outputFormat     `json:"format"`
+	Version              int64            `json:"version,omitempty"`
+	MetadataRemoved      bool             `json:"metadata_removed"`
+	Trimmed              bool             `json:"trimmed"`
+	BackgroundNormalized bool             `json:"background_normalized"`
+	DeskewAngle          float64          `json:"deskew_angle,omitempty"`
+	Watermarked          bool             `json:"watermarked"`
+	Variants             []variantResult  `json:"variants"`
+	Enhancement          *enhanceStats    `json:"enhancement,omitempty"`
+	QualityCheck         *qualityReport   `json:"quality_check,omitempty"`
+	Animation            *animationResult `json:"animation,omitempty"`
+	OriginalKey          string           `json:"original_key,omitempty"`
+	Phash                string           `json:"phash,omitempty"`
+	Duplicates           []phashMatch     `json:"duplicates,omitempty"`
+	// ExpiresAt is when the signed URLs of a private upload stop working
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+
+	// frameHash lets a batch spot the same shot uploaded twice
+	frameHash      uint64
+	bucket         string
+	originalReused bool
+	// userFolder is set for per-user presets, whose earlier files are
+	// replaced once the upload is recorded
+	userFolder string
+}
+
+// uploadError carries the HTTP status a failed upload should be reported
+// with, and a machine readable code where clients need to tell failures
+// apart.
+type uploadError struct {
+	Status  int
+	Code    string
+	Message string
+}
+
+func (e *uploadError) Error() string {
+	return e.Message
+}
+
+func badUpload(format string, args ...any) error {
+	return &uploadError{Status: http.StatusBadRequest, Message: fmt.Sprintf(format, args...)}
+}
+
+func failedUpload(format string, args ...any) error {
+	return &uploadError{Status: http.StatusInternalServerError, Message: fmt.Sprintf(format, args...)}
+}
+
+func errorStatus(err error) int {
+	var ue *uploadError
+	if errors.As(err, &ue) {
+		return ue.Status
+	}
+	return http.StatusInternalServerError
+}
+
+func errorCode(err error) string {
+	var ue *uploadError
+	if errors.As(err, &ue) {
+		return ue.Code
+	}
+	return ""
+}
+
+func respondError(c *gin.Context, err error) {
+	body := gin.H{"error": err.Error()}
+	if code := errorCode(err); code != "" {
+		body["code"] = code
+	}
+	c.JSON(errorStatus(err), body)
+}
+
+// parseUploadOptions reads the form fields that apply to every file in
+// the request. The uploader may delete the file later, a bad token is
+// treated as none.
+func (s *mediaService) parseUploadOptions(c *gin.Context) (uploadRequest, error) {
+	owner := 0
+	if user, err := bearerUser(c); err == nil {
+		owner = user.ID
+	}
+	return s.uploadOptions(c.GetPostForm, owner)
+}
+
+// uploadOptions builds the options of an upload from its fields, looked
+// up like form fields. owner is zero for anonymous uploads.
+func (s *mediaService) uploadOptions(field func(string) (string, bool), owner int) (uploadRequest, error) {
+	value := func(name string) string {
+		v, _ := field(name)
+		return v
+	}
+
+	var req uploadRequest
+	req.Purpose = purposeProduct
+	if v, ok := field("purpose"); ok {
+		req.Purpose = v
+	}
+	req.Preset = s.presets[req.Purpose]
+	if req.Preset == nil {
+		return req, unknownPurpose(req.Purpose)
+	}
+
+	var err error
+	req.Format = req.Preset.Formats[0]
+	if requested := value("format"); requested != "" {
+		req.Format, err = parseOutputFormat(requested)
+		if err != nil {
+			return req, badUpload("%v", err)
+		}
+		if !req.Preset.allowsFormat(req.Format) {
+			return req, badUpload("Format %s is not available for %s uploads", req.Format, req.Purpose)
+		}
+	}
+
+	// Seller supplied crop hints for fixed-box variants
+	req.Fit = fitOptions{Gravity: gravitySmart, Background: color.NRGBA{255, 255, 255, 255}}
+	if v := value("focal"); v != "" {
+		req.Fit.FocalX, req.Fit.FocalY, err = parseFocalPoint(v)
+		if err != nil {
+			return req, badUpload("%v", err)
+		}
+		req.Fit.Gravity = gravityFocal
+	}
+	if v := value("background"); v != "" {
+		req.Fit.Background, err = parseHexColor(v)
+		if err != nil {
+			return req, badUpload("Invalid background: %v", err)
+		}
+	}
+
+	if v := value("crop"); v != "" {
+		if !req.Preset.SquareCrop {
+			return req, badUpload("crop is not supported for %s uploads", req.Purpose)
+		}
+		rect, err := parseCropRect(v)
+		if err != nil {
+			return req, badUpload("%v", err)
+		}
+		req.Crop = &rect
+	}
+
+	// Presets with per-user keys need to know whose file it is
+	req.Owner = owner
+	if owner == 0 && req.Preset.UserKey {
+		return req, authRequired(req.Purpose)
+	}
+
+	req.AutoTrim = value("auto_trim") == "true"
+	req.NormalizeBackground = value("normalize_background") == "true"
+
+	switch value("enhance") {
+	case "":
+		req.Enhance = req.Preset.Enhance
+	case enhanceAuto:
+		req.Enhance = true
+	case enhanceNone:
+		req.Enhance = false
+	default:
+		return req, badUpload("enhance must be %q or %q", enhanceAuto, enhanceNone)
+	}
+	return req, nil
+}
+
+func readUploadFile(header *multipart.FileHeader, maxBytes int64) ([]byte, error) {
+	if header.Size > maxBytes {
+		return nil, fileTooLarge(header.Size, maxBytes)
+	}
+	file, err := header.Open()
+	if err != nil {
+		return nil, failedUpload("Failed to read file")
+	}
+	defer file.Close()
+
+	data, err := io.ReadAll(file)
+	if err != nil {
+		return nil, failedUpload("Failed to read file")
+	}
+	return data, nil
+}
+
+func (s *mediaService) handleUpload(c *gin.Context) {
+	header, err := c.FormFile("file")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "File is required"})
+		return
+	}
+
+	req, err := s.parseUploadOptions(c)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	req.Filename = header.Filename
+	req.ContentType = header.Header.Get("Content-Type")
+	req.Data, err = readUploadFile(header, req.Preset.MaxBytes)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	result, err := s.processUpload(c.Request.Context(), req)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	if err := s.recordUpload(c.Request.Context(), result, req.Owner, nil); err != nil {
+		respondError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, result)
+}
+
+// recordUpload registers a finished upload so it can be deleted as a whole
+// later. Garbage collection takes objects without a record for files
+// stored before uploads were recorded, which only the database keeps
+// alive, so an upload that cannot be recorded is discarded. Objects of
+// kept are left alone.
+func (s *mediaService) recordUpload(ctx context.Context, result *uploadResult, owner int, kept []*uploadResult) error {
+	if err := s.registry.Record(ctx, result, s.privateBucket, owner); err != nil {
+		fmt.Printf("Media Registry Error: %v\n", err)
+		s.discardUploads(ctx, []*uploadResult{result}, kept)
+		return failedUpload("Failed to record upload")
+	}
+	if result.userFolder != "" {
+		s.replaceUserFiles(ctx, result)
+	}
+	return nil
+}
+
+// processUpload runs the image pipeline for one file and stores every
+// variant. If storing fails part way, objects already written are removed.
+func (s *mediaService) processUpload(ctx context.Context, req uploadRequest) (*uploadResult, error) {
+	detected, err := s.checkContentType(req)
+	if err != nil {
+		return nil, err
+	}
+	fmt.Printf("Detected type %s for %s (declared %q)\n", detected, req.Filename, req.ContentType)
+
+	// PDFs are only accepted where the purpose allows them and skip the
+	// image pipeline
+	if detected == "application/pdf" {
+		return s.storePDF(req)
+	}
+
+	metadata := detectMetadata(req.Data)
+	if len(metadata) > 0 {
+		fmt.Printf("Stripping metadata from %s: %v\n", req.Filename, metadata)
+	}
+
+	// GIFs keep their animation only where the purpose allows it, the
+	// static variants always use the first frame as a poster
+	var anim *animation
+	var srcImage image.Image
+	var release func()
+	preset := req.Preset
+	if detected == "image/gif" && preset.Animated {
+		var g *gif.GIF
+		g, release, err = s.limits.decodeGIF(ctx, req.Data)
+		if err != nil {
+			fmt.Printf("Image Decode Error: %v\n", err)
+			return nil, err
+		}
+		defer release()
+		if err := s.animation.check(g); err != nil {
+			return nil, err
+		}
+		anim = compositeGIF(g)
+		srcImage = anim.poster()
+	} else {
+		srcImage, release, err = s.limits.decode(ctx, req.Data)
+		if err != nil {
+			fmt.Printf("Image Decode Error: %v\n", err)
+			return nil, err
+		}
+		defer release()
+	}
+
+	// The gate looks at the photo as taken, before any clean-up
+	gate := preset.Gate
+	var report *qualityReport
+	var frameHash uint64
+	if gate != nil {
+		report = gate.evaluate(srcImage)
+		if gate.rejects(report) {
+			fmt.Printf("Quality gate rejected %s: %+v\n", req.Filename, report.Issues)
+			return nil, qualityRejection(report.Issues)
+		}
+		if gate.Duplicate > 0 {
+			frameHash = dHash(srcImage)
+		}
+	}
+
+	// Square presets use the client's crop, or the centre of the photo
+	if preset.SquareCrop {
+		srcImage, err = squareCrop(srcImage, req.Crop)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var deskew float64
+	if preset.Document {
+		srcImage, deskew = prepareDocument(srcImage)
+	}
+
+	// Clean-up only touches the static variants, a trimmed poster would no
+	// longer line up with the animation
+	var trimmed, normalized bool
+	if anim == nil {
+		if req.AutoTrim {
+			srcImage, trimmed = autoTrim(srcImage)
+		}
+		if req.NormalizeBackground {
+			srcImage = normalizeBackground(srcImage, s.aspect)
+			normalized = true
+		}
+	}
+	format := resolveFormat(req.Format, srcImage)
+
+	// Listing photos are checked against the perceptual hash index so
+	// moderators can spot the same stock photo re-listed across accounts
+	checkDuplicates := req.Purpose == purposeProduct
+	var phash uint64
+	var duplicates []phashMatch
+	if checkDuplicates {
+		phash = dHash(srcImage)
+		duplicates, err = s.phash.Find(ctx, phash, s.phash.maxDistance)
+		if err != nil {
+			fmt.Printf("Phash Lookup Error: %v\n", err)
+		}
+	}
+
+	// Files are stored by content, except for per-user presets which keep
+	// each upload's set in the user's folder
+	var baseName, folder string
+	var version int64
+	if preset.UserKey {
+		folder = userFolder(preset.Prefix, req.Owner)
+		version = time.Now().UnixMilli()
+		baseName = fmt.Sprintf("%s%d", folder, version)
+	}
+
+	result := &uploadResult{
+		OriginalName:         req.Filename,
+		DetectedType:         detected,
+		Processed:            true,
+		Purpose:              req.Purpose,
+		Format:               format,
+		MetadataRemoved:      len(metadata) > 0,
+		QualityCheck:         report,
+		Trimmed:              trimmed,
+		BackgroundNormalized: normalized,
+		DeskewAngle:          deskew,
+		Version:              version,
+		frameHash:            frameHash,
+		bucket:               preset.Bucket,
+		userFolder:           folder,
+	}
+
+	// The clean original of watermarked uploads is kept in the private
+	// bucket so the mark can be regenerated later.
+	var wm *watermark
+	if preset.Watermark {
+		wm = s.watermark
+		result.OriginalKey, result.originalReused, err = s.storeOriginal(srcImage, format, preset.Prefix, req.Filename)
+		if err != nil {
+			fmt.Printf("Original Upload Error: %v\n", err)
+			return nil, failedUpload("Failed to store original image: %v", err)
+		}
+	}
+
+	opts := renderOptions{
+		Format:       format,
+		Watermark:    wm,
+		Store:        s.store,
+		Bucket:       preset.Bucket,
+		Prefix:       preset.Prefix,
+		BaseName:     baseName,
+		OriginalName: req.Filename,
+		// Rewriting restarts the file's age for the retention sweep
+		Reuse:     preset.Retention == 0,
+		Quality:   preset.Quality,
+		Enhance:   req.Enhance,
+		Grayscale: preset.Document,
+		Fit:       req.Fit,
+	}
+	rendered := make([]image.Image, 0, len(preset.Variants))
+	for _, v := range preset.Variants {
+		variant, img, err := renderVariant(srcImage, v, opts)
+		if err != nil {
+			fmt.Printf("Variant %s Error: %v\n", v.Name, err)
+			s.discardUpload(ctx, result)
+			return nil, failedUpload("Failed to process variant %s: %v", v.Name, err)
+		}
+		result.Variants = append(result.Variants, variant)
+		rendered = append(rendered, img)
+	}
+
+	if anim != nil {
+		result.Animation, err = anim.render(s.animation.width, opts)
+		if err != nil {
+			fmt.Printf("Animation Error: %v\n", err)
+			s.discardUpload(ctx, result)
+			return nil, failedUpload("Failed to process animation: %v", err)
+		}
+	}
+
+	primaryIdx := primaryIndex(result.Variants)
+	primary := result.Variants[primaryIdx]
+	if checkDuplicates {
+		if err := s.phash.Add(ctx, primary.Key, phash); err != nil {
+			fmt.Printf("Phash Index Error: %v\n", err)
+		}
+		result.Phash = formatPhash(phash)
+		result.Duplicates = otherMatches(duplicates, primary.Key)
+	}
+
+	// The placeholder stands in for the primary variant, crop, enhancement
+	// and all
+	ph, err := computePlaceholder(rendered[primaryIdx])
+	if err != nil {
+		fmt.Printf("Placeholder Error: %v\n", err)
+	}
+
+	result.URL = primary.URL
+	result.Width = primary.Width
+	result.Height = primary.Height
+	result.AspectRatio = aspectRatio(primary.Width, primary.Height)
+	result.BlurHash = ph.BlurHash
+	result.LQIP = ph.LQIP
+	result.DominantColor = ph.DominantColor
+	result.Watermarked = wm != nil
+	result.Enhancement = primary.Enhancement
+	if preset.Private {
+		s.signResult(result)
+	}
+	return result, nil
+}
+
+// discardUpload deletes everything stored for result and drops it from
+// the duplicate index.
+func (s *mediaService) discardUpload(ctx context.Context, result *uploadResult) {
+	s.discardUploads(ctx, []*uploadResult{result}, nil)
+}
+
+// discardUploads deletes the files the discarded uploads created. Files
+// that were already stored before, or that a kept upload also refers to,
+// are shared and left alone. Errors are logged since there is nothing more
+// the caller can do about them.
+func (s *mediaService) discardUploads(ctx context.Context, discarded, kept []*uploadResult) {
+	inUse := make(map[objectRef]bool)
+	for _, r := range kept {
+		for _, obj := range r.objects(s.privateBucket) {
+			inUse[obj.objectRef] = true
+		}
+	}
+
+	created := make(map[string][]string)
+	var indexed []string
+	seen := make(map[objectRef]bool)
+	for _, r := range discarded {
+		var primary objectRef
+		if r.Phash != "" && len(r.Variants) > 0 {
+			primary = r.primaryRef()
+		}
+		for _, obj := range r.objects(s.privateBucket) {
+			if obj.Reused || inUse[obj.objectRef] || seen[obj.objectRef] {
+				continue
+			}
+			seen[obj.objectRef] = true
+			created[obj.Bucket] = append(created[obj.Bucket], obj.Key)
+			if obj.objectRef == primary {
+				indexed = append(indexed, obj.Key)
+			}
+		}
+	}
+
+	for bucket, keys := range created {
+		if err := s.store.Delete(bucket, keys); err != nil {
+			fmt.Printf("Storage Delete Error: %v\n", err)
+		}
+	}
+	for _, key := range indexed {
+		if err := s.phash.Remove(ctx, key); err != nil {
+			fmt.Printf("Phash Index Error: %v\n", err)
+		}
+	}
+}
+
+// decodeImage decodes an uploaded or stored file, rotating it according to
+// its EXIF orientation. The orientation tag itself is dropped with the rest
+// of the metadata.
+func decodeImage(data []byte) (image.Image, error) {
+	return imaging.Decode(bytes.NewReader(data), imaging.AutoOrientation(true))
+}
+
+// storeOriginal uploads the full resolution, metadata-free source to the
+// private bucket and returns its object key.
+func (s *mediaService) storeOriginal(srcImage image.Image, format outputFormat, prefix, originalName string) (string, bool, error) {
+	buf := new(bytes.Buffer)
+	if err := encodeImage(buf, srcImage, format, 95); err != nil {
+		return "", false, fmt.Errorf("compress: %w", err)
+	}
+
+	key := contentKey("originals/"+prefix, buf.Bytes(), format.Ext())
+	_, reused, err := storeContent(s.store, s.privateBucket, key, buf.Bytes(), format.ContentType(), originalName, true)
+	if err != nil {
+		return "", false, err
+	}
+	return key, reused, nil
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Variant sizes produced for every upload, overridable with MEDIA_VARIANTS
+// as a comma separated list. Each entry is name:width to cap the width, or
+// name:WIDTHxHEIGHT[:fit] for a fixed box (fit defaults to cover).
+const defaultVariants = "thumb:200,medium:640,large:1024,original:2048"
+
+type variantSpec struct {
+	Name   string
+	Width  int
+	Height int
+	Fit    string
+}
+
+type variantResult struct {
+	Name   string `json:"name"`
+	Key    string `json:"key"`
+	URL    string `json:"url"`
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+	Bytes  int    `json:"bytes"`
+	Format string `json:"format"`
+	// Quality is the lossy encoder setting used, zero for PNG
+	Quality     int           `json:"quality,omitempty"`
+	Budget      int           `json:"budget,omitempty"`
+	Enhancement *enhanceStats `json:"enhancement,omitempty"`
+	// Deduplicated is set when identical content was already stored
+	Deduplicated bool `json:"deduplicated,omitempty"`
+}
+
+// renderOptions carries the per-upload settings shared by all variants.
+type renderOptions struct {
+	Format    outputFormat
+	Watermark *watermark
+	Store     objectStore
+	Bucket    string
+	Prefix    string
+	// BaseName is set for per-user presets, which name files after the
+	// upload instead of storing by content
+	BaseName     string
+	OriginalName string
+	// Reuse skips the upload when identical content is already stored
+	Reuse     bool
+	Quality   qualityPolicy
+	Enhance   bool
+	Grayscale bool
+	// Gravity, focal point and background used by cover/contain variants
+	Fit fitOptions
+}
+
+func loadVariantSpecs() ([]variantSpec, error) {
+	raw := os.Getenv("MEDIA_VARIANTS")
+	if raw == "" {
+		raw = defaultVariants
+	}
+	return parseVariantList(strings.Split(raw, ","))
+}
+
+func parseVariantList(entries []string) ([]variantSpec, error) {
+	var specs []variantSpec
+	seen := make(map[string]bool)
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		spec, err := parseVariantSpec(entry)
+		if err != nil {
+			return nil, err
+		}
+		if seen[spec.Name] {
+			return nil, fmt.Errorf("duplicate variant %q", spec.Name)
+		}
+		seen[spec.Name] = true
+		specs = append(specs, spec)
+	}
+
+	if len(specs) == 0 {
+		return nil, fmt.Errorf("no variants configured")
+	}
+	return specs, nil
+}
+
+func parseVariantSpec(entry string) (variantSpec, error) {
+	parts := strings.Split(entry, ":")
+	if len(parts) < 2 || len(parts) > 3 || parts[0] == "" {
+		return variantSpec{}, fmt.Errorf("invalid variant %q, expected name:width or name:WxH[:fit]", entry)
+	}
+	spec := variantSpec{Name: parts[0], Fit: fitInside}
+
+	widthStr, heightStr, box := strings.Cut(parts[1], "x")
+	width, err := strconv.Atoi(widthStr)
+	if err != nil || width <= 0 {
+		return variantSpec{}, fmt.Errorf("invalid width for variant %q", spec.Name)
+	}
+	spec.Width = width
+
+	if box {
+		height, err := strconv.Atoi(heightStr)
+		if err != nil || height <= 0 {
+			return variantSpec{}, fmt.Errorf("invalid height for variant %q", spec.Name)
+		}
+		spec.Height = height
+		spec.Fit = fitCover
+	}
+	if len(parts) == 3 {
+		if !box {
+			return variantSpec{}, fmt.Errorf("variant %q needs WxH to use a fit mode", spec.Name)
+		}
+		if !validFit(parts[2]) {
+			return variantSpec{}, fmt.Errorf("invalid fit %q for variant %q", parts[2], spec.Name)
+		}
+		spec.Fit = parts[2]
+	}
+	return spec, nil
+}
+
+// primaryVariant picks the variant whose URL is returned as the top-level
+// "url" field, so existing clients keep working unchanged.
+func primaryVariant(results []variantResult) variantResult {
+	return results[primaryIndex(results)]
+}
+
+func primaryIndex(results []variantResult) int {
+	name := os.Getenv("MEDIA_PRIMARY_VARIANT")
+	if name == "" {
+		name = "large"
+	}
+	for i, v := range results {
+		if v.Name == name {
+			return i
+		}
+	}
+	return len(results) - 1
+}
+
+// renderVariant stores one variant and also returns the image as stored,
+// before compression.
+func renderVariant(srcImage image.Image, v variantSpec, opts renderOptions) (variantResult, image.Image, error) {
+	fit := opts.Fit
+	fit.Width, fit.Height, fit.Fit = v.Width, v.Height, v.Fit
+
+	dstImage := applyFit(srcImage, fit)
+	var enhancement *enhanceStats
+	if opts.Enhance {
+		enhanced, stats := autoEnhance(dstImage)
+		dstImage, enhancement = enhanced, &stats
+	}
+	if opts.Watermark != nil {
+		dstImage = opts.Watermark.apply(dstImage)
+	}
+	if opts.Grayscale {
+		dstImage = toGray(dstImage)
+	}
+
+	format := opts.Format
+	budget := opts.Quality.Budgets[v.Name]
+	var buf *bytes.Buffer
+	var quality int
+	var err error
+	if budget > 0 {
+		buf, quality, err = encodeWithinBudget(dstImage, format, budget, opts.Quality)
+	} else {
+		buf, quality = new(bytes.Buffer), opts.Quality.Default
+		if format == formatPNG {
+			quality = 0
+		}
+		err = encodeImage(buf, dstImage, format, quality)
+	}
+	if err != nil {
+		return variantResult{}, nil, fmt.Errorf("compress: %w", err)
+	}
+	size := buf.Len()
+
+	key, url, reused, err := opts.store(v.Name, buf.Bytes(), format.Ext(), format.ContentType())
+	if err != nil {
+		return variantResult{}, nil, fmt.Errorf("store: %w", err)
+	}
+
+	return variantResult{
+		Name:         v.Name,
+		Key:          key,
+		URL:          url,
+		Deduplicated: reused,
+		Width:        dstImage.Bounds().Dx(),
+		Height:       dstImage.Bounds().Dy(),
+		Bytes:        size,
+		Format:       string(format),
+		Quality:      quality,
+		Budget:       budget,
+		Enhancement:  enhancement,
+	}, dstImage, nil
+}
+
+// store writes one rendered file. Per-user presets write
+// <BaseName>_<name>, everything else is stored by content under Prefix.
+func (o renderOptions) store(name string, data []byte, ext, contentType string) (key, url string, reused bool, err error) {
+	if o.BaseName != "" {
+		key = fmt.Sprintf("%s_%s%s", o.BaseName, name, ext)
+		if err := o.Store.Put(o.Bucket, key, data, contentType, nil); err != nil {
+			return "", "", false, err
+		}
+		return key, o.Store.URL(o.Bucket, key), false, nil
+	}
+	key = contentKey(o.Prefix, data, ext)
+	url, reused, err = storeContent(o.Store, o.Bucket, key, data, contentType, o.OriginalName, o.Reuse)
+	return key, url, reused, err
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"image/color"
+	"reflect"
+	"testing"
+
+	"github.com/disintegration/imaging"
+)
+
+func TestLoadVariantSpecs(t *testing.T) {
+	tests := []struct {
+		name    string
+		env     string
+		want    []variantSpec
+		wantErr bool
+	}{
+		{
+			name: "default",
+			env:  "",
+			want: []variantSpec{
+				{Name: "thumb", Width: 200, Fit: fitInside},
+				{Name: "medium", Width: 640, Fit: fitInside},
+				{Name: "large", Width: 1024, Fit: fitInside},
+				{Name: "original", Width: 2048, Fit: fitInside},
+			},
+		},
+		{
+			name: "spaces and empty entries",
+			env:  " small:100 ,, big:900,",
+			want: []variantSpec{
+				{Name: "small", Width: 100, Fit: fitInside},
+				{Name: "big", Width: 900, Fit: fitInside},
+			},
+		},
+		{name: "missing width", env: "thumb", wantErr: true},
+		{name: "missing name", env: ":200", wantErr: true},
+		{name: "zero width", env: "thumb:0", wantErr: true},
+		{name: "negative width", env: "thumb:-5", wantErr: true},
+		{name: "non numeric width", env: "thumb:wide", wantErr: true},
+		{name: "duplicate name", env: "thumb:200,thumb:300", wantErr: true},
+		{name: "only separators", env: ", ,", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("MEDIA_VARIANTS", tt.env)
+			got, err := loadVariantSpecs()
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("loadVariantSpecs() = %+v, want error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("loadVariantSpecs() error = %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("loadVariantSpecs() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPrimaryVariant(t *testing.T) {
+	results := []variantResult{{Name: "thumb"}, {Name: "large"}, {Name: "original"}}
+	tests := []struct {
+		name string
+		env  string
+		want string
+	}{
+		{name: "defaults to large", env: "", want: "large"},
+		{name: "configured", env: "thumb", want: "thumb"},
+		{name: "unknown falls back to last", env: "huge", want: "original"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("MEDIA_PRIMARY_VARIANT", tt.env)
+			if got := primaryVariant(results).Name; got != tt.want {
+				t.Errorf("primaryVariant() = %q, want %q", got, tt.want)
+			}
+			if got := results[primaryIndex(results)].Name; got != tt.want {
+				t.Errorf("primaryIndex() picks %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRenderVariant(t *testing.T) {
+	src := imaging.New(400, 200, color.NRGBA{200, 30, 30, 255})
+	opts := renderOptions{
+		Format:    formatJPEG,
+		Store:     testLocalStore(t),
+		Bucket:    "public",
+		Prefix:    "receipts/",
+		Quality:   qualityPolicy{Default: 80, Min: 40, Max: 90},
+		Grayscale: true,
+	}
+	variant, img, err := renderVariant(src, variantSpec{Name: "thumb", Width: 100, Height: 100, Fit: fitCover}, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if img.Bounds().Dx() != variant.Width || img.Bounds().Dy() != variant.Height || variant.Width != 100 || variant.Height != 100 {
+		t.Errorf("renderVariant() image %v for a %dx%d variant", img.Bounds(), variant.Width, variant.Height)
+	}
+	// The placeholder of the returned image matches what was stored
+	ph, err := computePlaceholder(img)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c := ph.DominantColor; c[1:3] != c[3:5] || c[3:5] != c[5:7] {
+		t.Errorf("placeholder colour of a grayscale variant = %s", c)
+	}
+}
+
+func TestParseVariantSpec(t *testing.T) {
+	tests := []struct {
+		entry   string
+		want    variantSpec
+		wantErr bool
+	}{
+		{entry: "thumb:200", want: variantSpec{Name: "thumb", Width: 200, Fit: fitInside}},
+		{entry: "square:300x300", want: variantSpec{Name: "square", Width: 300, Height: 300, Fit: fitCover}},
+		{entry: "card:400x300:contain", want: variantSpec{Name: "card", Width: 400, Height: 300, Fit: fitContain}},
+		{entry: "banner:1200x400:fill", want: variantSpec{Name: "banner", Width: 1200, Height: 400, Fit: fitFill}},
+		{entry: "thumb:200:cover", wantErr: true},
+		{entry: "card:400x300:stretch", wantErr: true},
+		{entry: "card:400x", wantErr: true},
+		{entry: "card:x300", wantErr: true},
+		{entry: "card:400x0", wantErr: true},
+		{entry: "card:400x300:cover:extra", wantErr: true},
+		{entry: ":400x300", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseVariantSpec(tt.entry)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("parseVariantSpec(%q) = %+v, %v, want %+v (error %v)", tt.entry, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
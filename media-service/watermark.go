@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+	"os"
+	"strconv"
+
+	"github.com/disintegration/imaging"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/gofont/gobold"
+	"golang.org/x/image/font/opentype"
+	"golang.org/x/image/math/fixed"
+)
+
+type watermark struct {
+	mark     image.Image
+	position string
+	opacity  float64
+	scale    float64
+}
+
+// loadWatermark builds the listing watermark from MEDIA_WATERMARK_IMAGE (a
+// PNG logo) or MEDIA_WATERMARK_TEXT. It returns nil when neither is set.
+func loadWatermark() (*watermark, error) {
+	imagePath := os.Getenv("MEDIA_WATERMARK_IMAGE")
+	text := os.Getenv("MEDIA_WATERMARK_TEXT")
+	if imagePath == "" && text == "" {
+		return nil, nil
+	}
+
+	w := &watermark{position: "bottom-right", opacity: 0.5, scale: 0.2}
+
+	if v := os.Getenv("MEDIA_WATERMARK_POSITION"); v != "" {
+		switch v {
+		case "top-left", "top-right", "bottom-left", "bottom-right", "center":
+			w.position = v
+		default:
+			return nil, fmt.Errorf("invalid MEDIA_WATERMARK_POSITION %q", v)
+		}
+	}
+	if v := os.Getenv("MEDIA_WATERMARK_OPACITY"); v != "" {
+		opacity, err := strconv.ParseFloat(v, 64)
+		if err != nil || !(opacity > 0 && opacity <= 1) {
+			return nil, fmt.Errorf("MEDIA_WATERMARK_OPACITY must be in (0, 1]")
+		}
+		w.opacity = opacity
+	}
+	if v := os.Getenv("MEDIA_WATERMARK_SCALE"); v != "" {
+		scale, err := strconv.ParseFloat(v, 64)
+		if err != nil || !(scale > 0 && scale <= 1) {
+			return nil, fmt.Errorf("MEDIA_WATERMARK_SCALE must be in (0, 1]")
+		}
+		w.scale = scale
+	}
+
+	var err error
+	if imagePath != "" {
+		w.mark, err = imaging.Open(imagePath)
+		if err != nil {
+			return nil, fmt.Errorf("open watermark image: %w", err)
+		}
+	} else {
+		w.mark, err = renderTextMark(text)
+		if err != nil {
+			return nil, fmt.Errorf("render watermark text: %w", err)
+		}
+	}
+	return w, nil
+}
+
+// renderTextMark draws white text with a dark shadow so the mark stays
+// readable on both light and dark photos. It is rendered once at a large
+// size and scaled down per image like a logo.
+func renderTextMark(text string) (image.Image, error) {
+	f, err := opentype.Parse(gobold.TTF)
+	if err != nil {
+		return nil, err
+	}
+	face, err := opentype.NewFace(f, &opentype.FaceOptions{Size: 96, DPI: 72, Hinting: font.HintingFull})
+	if err != nil {
+		return nil, err
+	}
+	defer face.Close()
+
+	metrics := face.Metrics()
+	shadow := 4
+	width := font.MeasureString(face, text).Ceil() + shadow
+	height := (metrics.Ascent + metrics.Descent).Ceil() + shadow
+
+	mark := image.NewNRGBA(image.Rect(0, 0, width, height))
+	drawer := &font.Drawer{Dst: mark, Face: face}
+
+	drawer.Src = image.NewUniform(color.NRGBA{0, 0, 0, 160})
+	drawer.Dot = fixed.Point26_6{X: fixed.I(shadow), Y: metrics.Ascent + fixed.I(shadow)}
+	drawer.DrawString(text)
+
+	drawer.Src = image.NewUniform(color.White)
+	drawer.Dot = fixed.Point26_6{X: 0, Y: metrics.Ascent}
+	drawer.DrawString(text)
+
+	return mark, nil
+}
+
+// apply composites the mark onto img, sized relative to the image width.
+func (w *watermark) apply(img image.Image) *image.NRGBA {
+	bounds := img.Bounds()
+	markWidth := int(math.Round(float64(bounds.Dx()) * w.scale))
+	if markWidth < 1 {
+		markWidth = 1
+	}
+	mark := imaging.Resize(w.mark, markWidth, 0, imaging.Lanczos)
+
+	margin := int(math.Round(float64(bounds.Dx()) * 0.02))
+	mw, mh := mark.Bounds().Dx(), mark.Bounds().Dy()
+
+	var pos image.Point
+	switch w.position {
+	case "top-left":
+		pos = image.Pt(margin, margin)
+	case "top-right":
+		pos = image.Pt(bounds.Dx()-mw-margin, margin)
+	case "bottom-left":
+		pos = image.Pt(margin, bounds.Dy()-mh-margin)
+	case "center":
+		pos = image.Pt((bounds.Dx()-mw)/2, (bounds.Dy()-mh)/2)
+	default:
+		pos = image.Pt(bounds.Dx()-mw-margin, bounds.Dy()-mh-margin)
+	}
+
+	return imaging.Overlay(img, mark, bounds.Min.Add(pos), w.opacity)
+}
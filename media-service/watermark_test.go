@@ -0,0 +1,154 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"path/filepath"
+	"testing"
+
+	"github.com/disintegration/imaging"
+)
+
+// watermarkEnv clears the watermark settings.
+func watermarkEnv(t *testing.T) {
+	for _, name := range []string{
+		"MEDIA_WATERMARK_IMAGE", "MEDIA_WATERMARK_TEXT", "MEDIA_WATERMARK_POSITION",
+		"MEDIA_WATERMARK_OPACITY", "MEDIA_WATERMARK_SCALE",
+	} {
+		t.Setenv(name, "")
+	}
+}
+
+func TestLoadWatermark(t *testing.T) {
+	logo := filepath.Join(t.TempDir(), "logo.png")
+	if err := imaging.Save(imaging.New(40, 20, color.White), logo); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		env     map[string]string
+		wantErr bool
+	}{
+		{name: "logo", env: map[string]string{"MEDIA_WATERMARK_IMAGE": logo}},
+		{name: "text", env: map[string]string{"MEDIA_WATERMARK_TEXT": "Auction", "MEDIA_WATERMARK_POSITION": "center", "MEDIA_WATERMARK_OPACITY": "1", "MEDIA_WATERMARK_SCALE": "0.5"}},
+		{name: "missing logo", env: map[string]string{"MEDIA_WATERMARK_IMAGE": filepath.Join(t.TempDir(), "missing.png")}, wantErr: true},
+		{name: "unknown position", env: map[string]string{"MEDIA_WATERMARK_TEXT": "x", "MEDIA_WATERMARK_POSITION": "middle"}, wantErr: true},
+		{name: "zero opacity", env: map[string]string{"MEDIA_WATERMARK_TEXT": "x", "MEDIA_WATERMARK_OPACITY": "0"}, wantErr: true},
+		{name: "opacity above 1", env: map[string]string{"MEDIA_WATERMARK_TEXT": "x", "MEDIA_WATERMARK_OPACITY": "1.5"}, wantErr: true},
+		{name: "opacity NaN", env: map[string]string{"MEDIA_WATERMARK_TEXT": "x", "MEDIA_WATERMARK_OPACITY": "NaN"}, wantErr: true},
+		{name: "scale not a number", env: map[string]string{"MEDIA_WATERMARK_TEXT": "x", "MEDIA_WATERMARK_SCALE": "big"}, wantErr: true},
+		{name: "negative scale", env: map[string]string{"MEDIA_WATERMARK_TEXT": "x", "MEDIA_WATERMARK_SCALE": "-0.2"}, wantErr: true},
+		{name: "scale NaN", env: map[string]string{"MEDIA_WATERMARK_TEXT": "x", "MEDIA_WATERMARK_SCALE": "NaN"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			watermarkEnv(t)
+			for name, v := range tt.env {
+				t.Setenv(name, v)
+			}
+			w, err := loadWatermark()
+			if tt.wantErr {
+				if err == nil {
+					t.Error("loadWatermark() accepted the settings")
+				}
+				return
+			}
+			if err != nil || w == nil || w.mark == nil {
+				t.Fatalf("loadWatermark() = %+v, %v", w, err)
+			}
+		})
+	}
+
+	watermarkEnv(t)
+	if w, err := loadWatermark(); w != nil || err != nil {
+		t.Errorf("loadWatermark() without a mark = %+v, %v, want nil", w, err)
+	}
+}
+
+func TestWatermarkApply(t *testing.T) {
+	mark := imaging.New(100, 50, color.White)
+	base := imaging.New(1000, 500, color.Black)
+	// A 200x100 mark with a 20px margin, for the 1000px wide image
+	tests := []struct {
+		position string
+		at       image.Rectangle
+	}{
+		{position: "top-left", at: image.Rect(20, 20, 220, 120)},
+		{position: "top-right", at: image.Rect(780, 20, 980, 120)},
+		{position: "bottom-left", at: image.Rect(20, 380, 220, 480)},
+		{position: "bottom-right", at: image.Rect(780, 380, 980, 480)},
+		{position: "center", at: image.Rect(400, 200, 600, 300)},
+	}
+	for _, tt := range tests {
+		w := &watermark{mark: mark, position: tt.position, opacity: 1, scale: 0.2}
+		got := w.apply(base)
+		if got.Bounds() != base.Bounds() {
+			t.Errorf("%s: apply() bounds = %v", tt.position, got.Bounds())
+		}
+		if marked := markedArea(got); marked != tt.at {
+			t.Errorf("%s: mark at %v, want %v", tt.position, marked, tt.at)
+		}
+	}
+}
+
+func TestWatermarkOpacity(t *testing.T) {
+	mark := imaging.New(100, 50, color.White)
+	base := imaging.New(500, 500, color.Black)
+	tests := []struct {
+		opacity float64
+		lo, hi  uint8
+	}{
+		{opacity: 1, lo: 255, hi: 255},
+		{opacity: 0.5, lo: 126, hi: 129},
+		{opacity: 0.2, lo: 49, hi: 53},
+	}
+	for _, tt := range tests {
+		w := &watermark{mark: mark, position: "center", opacity: tt.opacity, scale: 0.5}
+		if v := w.apply(base).NRGBAAt(250, 250).R; v < tt.lo || v > tt.hi {
+			t.Errorf("opacity %v: mark pixel = %d, want %d..%d", tt.opacity, v, tt.lo, tt.hi)
+		}
+	}
+}
+
+func TestWatermarkScale(t *testing.T) {
+	mark := imaging.New(100, 50, color.White)
+	tests := []struct {
+		base  image.Rectangle
+		scale float64
+		want  image.Point
+	}{
+		{base: image.Rect(0, 0, 1000, 500), scale: 0.2, want: image.Pt(200, 100)},
+		{base: image.Rect(0, 0, 400, 800), scale: 0.5, want: image.Pt(200, 100)},
+		{base: image.Rect(0, 0, 2000, 1000), scale: 0.1, want: image.Pt(200, 100)},
+		// Offset bounds, as cropped sources can have
+		{base: image.Rect(30, 40, 530, 540), scale: 0.2, want: image.Pt(100, 50)},
+		// The mark never vanishes
+		{base: image.Rect(0, 0, 2, 2), scale: 0.1, want: image.Pt(1, 1)},
+	}
+	for _, tt := range tests {
+		base := image.NewNRGBA(tt.base)
+		for i := 3; i < len(base.Pix); i += 4 {
+			base.Pix[i] = 255
+		}
+		w := &watermark{mark: mark, position: "top-left", opacity: 1, scale: tt.scale}
+		if size := markedArea(w.apply(base)).Size(); size != tt.want {
+			t.Errorf("%v at scale %v: mark is %v, want %v", tt.base, tt.scale, size, tt.want)
+		}
+	}
+}
+
+// markedArea returns the bounding box of the bright pixels, relative to
+// the image origin.
+func markedArea(img *image.NRGBA) image.Rectangle {
+	var area image.Rectangle
+	b := img.Bounds()
+	for y := 0; y < b.Dy(); y++ {
+		for x := 0; x < b.Dx(); x++ {
+			if img.Pix[y*img.Stride+x*4] > 128 {
+				area = area.Union(image.Rect(x, y, x+1, y+1))
+			}
+		}
+	}
+	return area
+}